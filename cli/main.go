@@ -16,7 +16,11 @@ func main() {
 		log.Fatalf("flag parsing error: %v", err)
 	}
 
-	if err := cmd.Run(cfg); err != nil {
+	run := cmd.Run
+	if cfg.Command == config.ReplayCommand {
+		run = cmd.Replay
+	}
+	if err := run(cfg); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,10 +1,31 @@
 package config
 
+import "time"
+
 var Version = "unknown"
 
 type Config struct {
 	Config string
-	Data   Data
+	// Command is the subcommand given on the command line, run by default
+	Command string
+	Replay  ReplayConfig
+	Data    Data
+}
+
+// ReplayConfig holds the flags of the replay command
+type ReplayConfig struct {
+	// File is the recording written by the record option of a server
+	File string
+	// Session limits the replay to one recorded session, all of them if empty
+	Session string
+	// Upstream is the ws:// or wss:// url dialed instead of the upstream of the route
+	Upstream string
+	// Path is the request uri replayed instead of the recorded one, if set
+	Path string
+	// Speed scales the recorded timing, 2 replays twice faster and 0 sends without waiting
+	Speed float64
+	// Wait is how long the replies are waited for after the last message is sent
+	Wait time.Duration
 }
 
 type Data struct {
@@ -14,17 +35,69 @@ type Data struct {
 
 type GlobalConfig struct {
 	LogLevel string `default:"info"`
+	// WatchInterval is how often the config file is checked for changes, 0 to disable
+	WatchInterval string `default:"2s"`
+	// DrainTimeout is how long the shutdown waits for the websocket sessions to close
+	DrainTimeout string `default:"10s"`
+	Admin        GlobalAdminConfig
+}
+
+type GlobalAdminConfig struct {
+	// Listen is the ip:port of the admin server exposing the metrics, empty to disable it
+	Listen string
+	// AllowRemote lets the admin server listen on a non-loopback address
+	AllowRemote bool
 }
 
 type ServerConfig struct {
-	Ip       string `default:"0.0.0.0"`
-	Port     int    `default:"80"`
-	Match    ServerMatchUrlConfig
-	Upstream ServerUpstreamConfig
+	// Name labels the route in the metrics, "server-<index>" if empty
+	Name          string
+	Ip            string `default:"0.0.0.0"`
+	Port          int    `default:"80"`
+	Tls           ServerTlsConfig
+	ProxyProtocol ServerProxyProtocolConfig
+	Match         ServerMatchUrlConfig
+	Forwarded     ServerForwardedConfig
+	Record        ServerRecordConfig
+	Upstream      ServerUpstreamConfig
+}
+
+type ServerRecordConfig struct {
+	// File is the JSON Lines file the messages are written to, empty to record nothing
+	File string
+	// Sample is the fraction of the sessions recorded, 1 if unset
+	Sample     float64
+	MaxSize    int64
+	MaxBackups int
+	MaxPayload int
+}
+
+type ServerProxyProtocolConfig struct {
+	Enable bool
+	// TrustedSources must send the header and are required once enabled
+	TrustedSources []string
+}
+
+type ServerForwardedConfig struct {
+	Enable         bool
+	TrustedProxies []string
+}
+
+type ServerTlsConfig struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites []string
+	ClientCaFile string
 }
 
 type ServerMatchUrlConfig struct {
-	Path []ServerMatchConfig
+	Priority    int
+	Path        []ServerMatchConfig
+	Host        []ServerMatchConfig
+	Headers     []ServerMatchKeyConfig
+	Query       []ServerMatchKeyConfig
+	Subprotocol []string
 }
 
 type ServerMatchConfig struct {
@@ -32,25 +105,112 @@ type ServerMatchConfig struct {
 	Value string
 }
 
+type ServerMatchKeyConfig struct {
+	Key   string
+	Type  string `default:"exact"`
+	Value string
+}
+
 type ServerUpstreamConfig struct {
-	Ip       string
-	Port     int
-	Override ServerUpstreamOverrideConfig
+	Scheme        string `default:"ws"`
+	Ip            string
+	Port          int
+	ProxyProtocol string
+	Upstreams     []ServerUpstreamTargetConfig
+	Balance       ServerUpstreamBalanceConfig
+	HealthCheck   ServerUpstreamHealthCheckConfig
+	Tls           ServerUpstreamTlsConfig
+	Message       ServerUpstreamMessageConfig
+	Override      ServerUpstreamOverrideConfig
+}
+
+type ServerUpstreamTargetConfig struct {
+	Ip     string
+	Port   int
+	Weight int `default:"1"`
+}
+
+type ServerUpstreamBalanceConfig struct {
+	Strategy string `default:"round-robin"`
+	HashOn   string
+	HashKey  string
+}
+
+type ServerUpstreamHealthCheckConfig struct {
+	Type        string
+	Interval    string `default:"10s"`
+	Timeout     string `default:"2s"`
+	Path        string `default:"/"`
+	Send        string
+	Expect      string
+	MaxFails    int
+	FailTimeout string `default:"30s"`
+}
+
+type ServerUpstreamTlsConfig struct {
+	CaFile             string
+	ServerName         string
+	InsecureSkipVerify bool
+	CertFile           string
+	KeyFile            string
+}
+
+type ServerUpstreamMessageConfig struct {
+	MaxSize    int
+	Refragment bool
+	Deflate    bool
 }
 
 type ServerUpstreamOverrideConfig struct {
 	Host             string
+	Path             ServerUpstreamOverridePathConfig
+	StripHopByHop    bool
+	StripSensitive   bool
 	Headers          []ServerUpstreamOverrideHeadersConfig
+	ResponseHeaders  []ServerUpstreamOverrideHeadersConfig
 	WebsocketPayload []ServerUpstreamOverrideWebsocketPayloadConfig
 }
 
-type ServerUpstreamOverrideHeadersConfig struct {
+type ServerUpstreamOverridePathConfig struct {
+	StripPrefix string
+	AddPrefix   string
+	Regex       string
+	Replace     string
+	Query       ServerUpstreamOverrideQueryConfig
+}
+
+type ServerUpstreamOverrideQueryConfig struct {
+	Add    []ServerUpstreamOverrideQueryParamConfig
+	Remove []string
+	Rename []ServerUpstreamOverrideQueryRenameConfig
+}
+
+type ServerUpstreamOverrideQueryParamConfig struct {
 	Key   string
 	Value string
 }
 
+type ServerUpstreamOverrideQueryRenameConfig struct {
+	From string
+	To   string
+}
+
+type ServerUpstreamOverrideHeadersConfig struct {
+	Key    string
+	Value  string
+	Action string `default:"set"`
+}
+
 type ServerUpstreamOverrideWebsocketPayloadConfig struct {
-	Type  string `default:"exact"`
-	Match string
-	Value string
+	// Name labels the rule in the metrics, "rule-<index>" if empty
+	Name      string
+	Type      string `default:"exact"`
+	Direction string `default:"client"`
+	Match     string
+	Path      string
+	Operation string `default:"set"`
+	Value     string
+	// Mode is enforce to modify the messages, or shadow to only log and count what the
+	// rule would change while the messages are forwarded unmodified
+	Mode string `default:"enforce"`
 }
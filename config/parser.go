@@ -4,11 +4,22 @@ import (
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/gookit/config/v2"
 	"github.com/gookit/config/v2/yaml"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	RunCommand    = "run"
+	ReplayCommand = "replay"
 )
 
 var defaultConfig = &Config{
 	Config: "config.yaml",
+	Replay: ReplayConfig{
+		Speed: 1,
+		Wait:  time.Second,
+	},
 }
 
 func NewConfig() *Config {
@@ -22,10 +33,21 @@ func (cfg *Config) ParseFlags(args []string) error {
 
 	app.Flag("config", "The config file (Default: ./config.yaml)").Default(defaultConfig.Config).StringVar(&cfg.Config)
 
-	_, err := app.Parse(args)
+	app.Command(RunCommand, "Run the reverse proxy").Default()
+
+	replay := app.Command(ReplayCommand, "Replay the recorded sessions against the upstream and diff the replies")
+	replay.Flag("file", "The recording file").Required().StringVar(&cfg.Replay.File)
+	replay.Flag("session", "The recorded session to replay (Default: all)").StringVar(&cfg.Replay.Session)
+	replay.Flag("upstream", "The ws:// or wss:// url to replay against (Default: the upstream of the route)").StringVar(&cfg.Replay.Upstream)
+	replay.Flag("path", "The request uri replayed instead of the recorded one (Default: the recorded one)").StringVar(&cfg.Replay.Path)
+	replay.Flag("speed", "The timing scale, 0 to send without waiting").Default(strconv.FormatFloat(defaultConfig.Replay.Speed, 'f', -1, 64)).Float64Var(&cfg.Replay.Speed)
+	replay.Flag("wait", "How long the replies are waited for after the last message").Default(defaultConfig.Replay.Wait.String()).DurationVar(&cfg.Replay.Wait)
+
+	command, err := app.Parse(args)
 	if err != nil {
 		return err
 	}
+	cfg.Command = command
 
 	if err := cfg.parseConfig(); err != nil {
 		return err
@@ -35,20 +57,31 @@ func (cfg *Config) ParseFlags(args []string) error {
 }
 
 func (cfg *Config) parseConfig() error {
+	data, err := cfg.Reload()
+	if err != nil {
+		return err
+	}
+
+	cfg.Data = data
+
+	return nil
+}
+
+// Reload parses the config file again. The data is returned without replacing cfg.Data,
+// so the caller can keep the current one if the new data is rejected.
+func (cfg *Config) Reload() (Data, error) {
 	config.WithOptions(config.ParseDefault)
 	c := config.New("test").WithOptions(config.ParseDefault).WithDriver(yaml.Driver)
 	if err := c.LoadFiles(cfg.Config); err != nil {
-		return err
+		return Data{}, err
 	}
 
 	data := Data{}
 	if err := c.Decode(&data); err != nil {
-		return err
+		return Data{}, err
 	}
 
 	data.Global.LogLevel = strings.ToLower(data.Global.LogLevel)
 
-	cfg.Data = data
-
-	return nil
+	return data, nil
 }
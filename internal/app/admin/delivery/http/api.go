@@ -0,0 +1,200 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const defaultCloseCode = 1000
+
+type routeResponse struct {
+	Name      string             `json:"name"`
+	Listener  string             `json:"listener,omitempty"`
+	Priority  int                `json:"priority"`
+	Paths     []pathResponse     `json:"paths"`
+	Scheme    string             `json:"scheme"`
+	Upstreams []upstreamResponse `json:"upstreams"`
+	Rules     []ruleResponse     `json:"rules"`
+}
+
+type pathResponse struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type upstreamResponse struct {
+	Addr      string `json:"addr"`
+	Weight    int    `json:"weight"`
+	Available bool   `json:"available"`
+	Active    int64  `json:"active"`
+}
+
+type ruleResponse struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode,omitempty"`
+}
+
+type sessionResponse struct {
+	Id            string    `json:"id"`
+	ClientAddr    string    `json:"clientAddr"`
+	Route         string    `json:"route"`
+	Upstream      string    `json:"upstream"`
+	ClientBytes   uint64    `json:"clientBytes"`
+	UpstreamBytes uint64    `json:"upstreamBytes"`
+	StartedAt     time.Time `json:"startedAt"`
+	Age           string    `json:"age"`
+}
+
+type toggleRuleRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *handler) routes(w http.ResponseWriter, _ *http.Request) {
+	res := []routeResponse{}
+	for _, r := range h.adminUsecase.Routes() {
+		route := routeResponse{
+			Name:      r.Name,
+			Listener:  r.Listener,
+			Priority:  r.Priority,
+			Paths:     []pathResponse{},
+			Scheme:    r.Scheme,
+			Upstreams: []upstreamResponse{},
+			Rules:     []ruleResponse{},
+		}
+		for _, p := range r.Paths {
+			route.Paths = append(route.Paths, pathResponse{Type: matchTypeName(p.Type), Value: p.Value})
+		}
+		for _, u := range r.Upstreams {
+			route.Upstreams = append(route.Upstreams, upstreamResponse(u))
+		}
+		for _, rule := range r.Rules {
+			route.Rules = append(route.Rules, ruleResponse{Name: rule.Name, Enabled: rule.Enabled, Mode: ruleModeName(rule.Mode)})
+		}
+		res = append(res, route)
+	}
+
+	h.writeJson(w, http.StatusOK, res)
+}
+
+func (h *handler) toggleRule(w http.ResponseWriter, r *http.Request) {
+	var req toggleRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		h.writeJson(w, http.StatusBadRequest, errorResponse{Error: `the body must be {"enabled": true|false}`})
+		return
+	}
+
+	route, rule := r.PathValue("route"), r.PathValue("rule")
+	if err := h.adminUsecase.ToggleRule(route, rule, *req.Enabled); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.log.WithFields(logrus.Fields{"route": route, "rule": rule, "enabled": *req.Enabled}).Info("Rule toggled")
+
+	h.writeJson(w, http.StatusOK, ruleResponse{Name: rule, Enabled: *req.Enabled})
+}
+
+func (h *handler) sessions(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	res := []sessionResponse{}
+	for _, s := range h.adminUsecase.Sessions() {
+		res = append(res, sessionResponse{
+			Id:            s.Id,
+			ClientAddr:    s.ClientAddr,
+			Route:         s.Route,
+			Upstream:      s.Upstream,
+			ClientBytes:   s.ClientBytes,
+			UpstreamBytes: s.UpstreamBytes,
+			StartedAt:     s.StartedAt,
+			Age:           now.Sub(s.StartedAt).Round(time.Second).String(),
+		})
+	}
+
+	h.writeJson(w, http.StatusOK, res)
+}
+
+// closeSession closes the session with the code of the query, 1000 if there is none
+func (h *handler) closeSession(w http.ResponseWriter, r *http.Request) {
+	code := uint64(defaultCloseCode)
+	if v := r.URL.Query().Get("code"); v != "" {
+		var err error
+		if code, err = strconv.ParseUint(v, 10, 16); err != nil {
+			h.writeError(w, domain.ErrInvalidCloseCode)
+			return
+		}
+	}
+
+	id := r.PathValue("id")
+	if err := h.adminUsecase.CloseSession(id, uint16(code)); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.log.WithFields(logrus.Fields{"session": id, "code": code}).Info("Session closed")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *handler) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := h.reload(r.Context()); err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, domain.ErrShuttingDown) {
+			status = http.StatusServiceUnavailable
+		}
+		h.writeJson(w, status, errorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, domain.ErrSessionNotFound), errors.Is(err, domain.ErrRuleNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, domain.ErrInvalidCloseCode):
+		status = http.StatusBadRequest
+	}
+
+	h.writeJson(w, status, errorResponse{Error: err.Error()})
+}
+
+func (h *handler) writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Error(err)
+	}
+}
+
+func matchTypeName(t domain.FindMatch) string {
+	switch t {
+	case domain.RegexMatch:
+		return "regex"
+	case domain.PrefixMatch:
+		return "prefix"
+	case domain.WildcardMatch:
+		return "wildcard"
+	}
+
+	return "exact"
+}
+
+func ruleModeName(mode domain.RuleMode) string {
+	if mode == domain.ShadowMode {
+		return "shadow"
+	}
+
+	return "enforce"
+}
@@ -0,0 +1,8 @@
+package http
+
+type Config struct {
+	// Listen is the ip:port of the admin server
+	Listen string
+	// AllowRemote accepts a Listen address that is not a loopback one
+	AllowRemote bool
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+var ErrRemoteListen = errors.New("the admin server listens on a non-loopback address, allowRemote must be set to expose it")
+
+type handler struct {
+	adminUsecase domain.WsProxyAdminUsecase
+	metrics      http.Handler
+	reload       func(ctx context.Context) error
+	log          logrus.FieldLogger
+	server       *http.Server
+	opt          Config
+	listener     net.Listener
+}
+
+// NewHandler serves the metrics and the api to inspect and control the proxy. The reload
+// function applies the config file again and returns why it was rejected. The api has no
+// authentication, so it only listens on a loopback address unless AllowRemote is set.
+func NewHandler(adminUsecase domain.WsProxyAdminUsecase, metrics http.Handler, reload func(ctx context.Context) error, log *logrus.Logger, config ...Config) (*handler, error) {
+	var opt Config
+	for _, cfg := range config {
+		opt = cfg
+	}
+	if !opt.AllowRemote && !isLoopback(opt.Listen) {
+		return nil, ErrRemoteListen
+	}
+
+	h := &handler{
+		adminUsecase: adminUsecase,
+		metrics:      metrics,
+		reload:       reload,
+		log:          log,
+		server:       &http.Server{Addr: opt.Listen},
+		opt:          opt,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", h.metrics)
+	mux.HandleFunc("GET /routes", h.routes)
+	mux.HandleFunc("PUT /routes/{route}/rules/{rule}", h.toggleRule)
+	mux.HandleFunc("GET /sessions", h.sessions)
+	mux.HandleFunc("DELETE /sessions/{id}", h.closeSession)
+	mux.HandleFunc("POST /reload", h.reloadConfig)
+	h.server.Handler = mux
+
+	return h, nil
+}
+
+// isLoopback checks if the ip:port only accepts the connections of the local host. An
+// address without ip listens on every interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listen binds the listen address before the handler runs, so a busy address fails the startup
+func (h *handler) Listen() error {
+	listener, err := net.Listen("tcp", h.server.Addr)
+	if err != nil {
+		return err
+	}
+	h.listener = listener
+
+	return nil
+}
+
+func (h *handler) Run() error {
+	if h.listener == nil {
+		if err := h.Listen(); err != nil {
+			return err
+		}
+	}
+
+	h.log.Info("Start admin server listen on " + h.server.Addr)
+	err := h.server.Serve(h.listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (h *handler) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := h.server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	h.log.Info("Stop admin server listen on " + h.server.Addr)
+
+	return nil
+}
@@ -0,0 +1,268 @@
+//go:build unit
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+type fakeAdminUsecase struct {
+	closed  map[string]uint16
+	toggled map[string]bool
+}
+
+func (f *fakeAdminUsecase) Routes() []domain.RouteInfo {
+	return []domain.RouteInfo{{
+		Name:      "chat",
+		Listener:  "0.0.0.0:8080",
+		Priority:  1,
+		Paths:     []domain.RoutePathInfo{{Type: domain.PrefixMatch, Value: "/chat"}},
+		Scheme:    "ws",
+		Upstreams: []domain.UpstreamInfo{{Addr: "10.0.0.1:3000", Weight: 2, Available: true, Active: 3}},
+		Rules:     []domain.RuleInfo{{Name: "mask", Enabled: true, Mode: domain.ShadowMode}},
+	}}
+}
+
+func (f *fakeAdminUsecase) Sessions() []domain.SessionInfo {
+	return []domain.SessionInfo{{
+		Id:          "1",
+		ClientAddr:  "192.0.2.1:5000",
+		Route:       "chat",
+		Upstream:    "10.0.0.1:3000",
+		ClientBytes: 10,
+		StartedAt:   time.Now().Add(-time.Minute),
+	}}
+}
+
+func (f *fakeAdminUsecase) CloseSession(id string, code uint16) error {
+	if id != "1" {
+		return domain.ErrSessionNotFound
+	}
+	if code < 1000 {
+		return domain.ErrInvalidCloseCode
+	}
+	f.closed[id] = code
+
+	return nil
+}
+
+func (f *fakeAdminUsecase) ToggleRule(route string, rule string, enabled bool) error {
+	if route != "chat" || rule != "mask" {
+		return domain.ErrRuleNotFound
+	}
+	f.toggled[route+"/"+rule] = enabled
+
+	return nil
+}
+
+func newTestHandler(t *testing.T, reload func(ctx context.Context) error) (*handler, *fakeAdminUsecase) {
+	t.Helper()
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	usecase := &fakeAdminUsecase{closed: make(map[string]uint16), toggled: make(map[string]bool)}
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprint(w, "reverse_ws_sessions 1\n")
+	})
+	h, err := NewHandler(usecase, metrics, reload, log, Config{Listen: "127.0.0.1:9100"})
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+
+	return h, usecase
+}
+
+func serve(h *handler, method string, target string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	return rec
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	rec := serve(h, http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "reverse_ws_sessions") {
+		t.Errorf("GET /metrics = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandler_Routes(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	rec := serve(h, http.MethodGet, "/routes", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /routes = %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var routes []routeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+	want := routeResponse{
+		Name:      "chat",
+		Listener:  "0.0.0.0:8080",
+		Priority:  1,
+		Paths:     []pathResponse{{Type: "prefix", Value: "/chat"}},
+		Scheme:    "ws",
+		Upstreams: []upstreamResponse{{Addr: "10.0.0.1:3000", Weight: 2, Available: true, Active: 3}},
+		Rules:     []ruleResponse{{Name: "mask", Enabled: true, Mode: "shadow"}},
+	}
+	if len(routes) != 1 || fmt.Sprint(routes[0]) != fmt.Sprint(want) {
+		t.Errorf("GET /routes = %+v, want %+v", routes, want)
+	}
+}
+
+func TestHandler_ToggleRule(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{name: "disable", target: "/routes/chat/rules/mask", body: `{"enabled": false}`, wantStatus: http.StatusOK},
+		{name: "unknown rule", target: "/routes/chat/rules/other", body: `{"enabled": false}`, wantStatus: http.StatusNotFound},
+		{name: "missing enabled", target: "/routes/chat/rules/mask", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", target: "/routes/chat/rules/mask", body: `enabled`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, usecase := newTestHandler(t, nil)
+			rec := serve(h, http.MethodPut, tt.target, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("PUT %s = %d %s, want %d", tt.target, rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if enabled, ok := usecase.toggled["chat/mask"]; !ok || enabled {
+					t.Errorf("toggled = %v, want the rule disabled", usecase.toggled)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_Sessions(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	rec := serve(h, http.MethodGet, "/sessions", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /sessions = %d", rec.Code)
+	}
+	var sessions []sessionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Id != "1" || sessions[0].ClientBytes != 10 || sessions[0].Age != "1m0s" {
+		t.Errorf("GET /sessions = %+v", sessions)
+	}
+}
+
+func TestHandler_CloseSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantCode   uint16
+	}{
+		{name: "default code", target: "/sessions/1", wantStatus: http.StatusAccepted, wantCode: 1000},
+		{name: "given code", target: "/sessions/1?code=4000", wantStatus: http.StatusAccepted, wantCode: 4000},
+		{name: "unknown session", target: "/sessions/2", wantStatus: http.StatusNotFound},
+		{name: "code out of range", target: "/sessions/1?code=70000", wantStatus: http.StatusBadRequest},
+		{name: "code rejected", target: "/sessions/1?code=999", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, usecase := newTestHandler(t, nil)
+			rec := serve(h, http.MethodDelete, tt.target, "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("DELETE %s = %d %s, want %d", tt.target, rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+			if usecase.closed["1"] != tt.wantCode {
+				t.Errorf("closed = %v, want code %d", usecase.closed, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandler_Reload(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{name: "applied", wantStatus: http.StatusNoContent},
+		{name: "rejected", err: errors.New("invalid config"), wantStatus: http.StatusUnprocessableEntity},
+		{name: "shutting down", err: domain.ErrShuttingDown, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, func(context.Context) error { return tt.err })
+			rec := serve(h, http.MethodPost, "/reload", "")
+			if rec.Code != tt.wantStatus {
+				t.Errorf("POST /reload = %d %s, want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandler_MethodNotAllowed(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	if rec := serve(h, http.MethodGet, "/reload", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reload = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNewHandler_Listen(t *testing.T) {
+	tests := []struct {
+		listen      string
+		allowRemote bool
+		wantErr     bool
+	}{
+		{listen: "127.0.0.1:9100"},
+		{listen: "127.0.0.2:9100"},
+		{listen: "[::1]:9100"},
+		{listen: "localhost:9100"},
+		{listen: ":9100", wantErr: true},
+		{listen: "0.0.0.0:9100", wantErr: true},
+		{listen: "[::]:9100", wantErr: true},
+		{listen: "192.0.2.1:9100", wantErr: true},
+		{listen: "admin.example.com:9100", wantErr: true},
+		{listen: "127.0.0.1", wantErr: true},
+		{listen: "0.0.0.0:9100", allowRemote: true},
+		{listen: ":9100", allowRemote: true},
+	}
+	for _, tt := range tests {
+		_, err := NewHandler(nil, http.NotFoundHandler(), nil, logrus.New(), Config{Listen: tt.listen, AllowRemote: tt.allowRemote})
+		if tt.wantErr != errors.Is(err, ErrRemoteListen) {
+			t.Errorf("NewHandler(%q, allowRemote %v) error = %v, want error %v", tt.listen, tt.allowRemote, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHandler_ListenBusyAddress(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	h, err := NewHandler(nil, http.NotFoundHandler(), nil, log, Config{Listen: busy.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	if err := h.Listen(); err == nil {
+		_ = h.listener.Close()
+		t.Error("Listen() expected an error for an address in use")
+	}
+}
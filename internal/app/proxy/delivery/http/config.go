@@ -3,4 +3,17 @@ package http
 type Config struct {
 	ListenIP   string
 	ListenPort int
+	Tls        []TlsConfig
+	// ProxyProtocol requires the PROXY protocol header on the connections coming from the
+	// trusted sources, which must not be empty
+	ProxyProtocol  bool
+	TrustedSources []string
+}
+
+type TlsConfig struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites []string
+	ClientCaFile string
 }
@@ -3,6 +3,7 @@ package http
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -17,6 +18,9 @@ type handler struct {
 	log       logrus.FieldLogger
 	server    *http.Server
 	opt       Config
+	trusted   []*net.IPNet
+	tls       tlsCandidates
+	listener  net.Listener
 }
 
 func NewHandler(wsUsecase domain.WsProxyTableUsecase, log *logrus.Logger, config ...Config) (*handler, error) {
@@ -29,23 +33,82 @@ func NewHandler(wsUsecase domain.WsProxyTableUsecase, log *logrus.Logger, config
 	server := &http.Server{
 		Addr: listenAddr,
 	}
+	var candidates tlsCandidates
+	if len(opt.Tls) > 0 {
+		tlsConfig, c, err := newTLSConfig(opt.Tls)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig, candidates = tlsConfig, c
+	}
+
+	trusted, err := parseTrustedSources(opt.TrustedSources)
+	if err != nil {
+		return nil, err
+	}
+	if opt.ProxyProtocol && len(trusted) == 0 {
+		return nil, ErrNoTrustedSource
+	}
 
 	h := &handler{
 		wsUsecase: wsUsecase,
 		log:       log,
 		server:    server,
 		opt:       opt,
+		trusted:   trusted,
+		tls:       candidates,
 	}
 
 	return h, nil
 }
 
+// Listen binds the listen address before the handler runs. The socket of the listener it
+// replaces on the same address is taken over, the address would still be in use otherwise.
+// Until that listener is shut down, both accept the new connections.
+func (h *handler) Listen(replaced net.Listener) error {
+	if l, ok := replaced.(*net.TCPListener); ok {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h.listener, err = net.FileListener(f)
+
+		return err
+	}
+
+	listener, err := net.Listen("tcp", h.server.Addr)
+	if err != nil {
+		return err
+	}
+	h.listener = listener
+
+	return nil
+}
+
+// Listener returns the bound listener, nil before Listen
+func (h *handler) Listener() net.Listener {
+	return h.listener
+}
+
 func (h *handler) Run() error {
 	h.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			if err := h.tls.verify(r.TLS, r.Host); err != nil {
+				w.WriteHeader(http.StatusMisdirectedRequest)
+				if _, err := w.Write([]byte(err.Error())); err != nil {
+					h.log.Error(err)
+				}
+				return
+			}
+		}
 		info := domain.WsReqInfo{
-			Host:   r.Host,
-			Header: r.Header,
-			URI:    r.URL.RequestURI(),
+			Listener:   h.server.Addr,
+			RemoteAddr: r.RemoteAddr,
+			Tls:        r.TLS != nil,
+			Host:       r.Host,
+			Header:     r.Header,
+			URI:        r.URL.RequestURI(),
 		}
 		ws, err := h.wsUsecase.Connect(info)
 		if err != nil {
@@ -60,8 +123,26 @@ func (h *handler) Run() error {
 		ws.Proxy(w, r)
 	})
 
-	h.log.Info("Start server listen on " + h.server.Addr)
-	if err := h.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	if h.listener == nil {
+		if err := h.Listen(nil); err != nil {
+			return err
+		}
+	}
+	var err error
+	listener := h.listener
+	if h.opt.ProxyProtocol {
+		// The PROXY header comes before the tls handshake, so the listener is wrapped first
+		listener = &proxyListener{Listener: listener, trusted: h.trusted}
+	}
+
+	if h.server.TLSConfig != nil {
+		h.log.Info("Start server listen with tls on " + h.server.Addr)
+		err = h.server.ServeTLS(listener, "", "")
+	} else {
+		h.log.Info("Start server listen on " + h.server.Addr)
+		err = h.server.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
@@ -75,6 +156,10 @@ func (h *handler) Shutdown() error {
 	if err := h.server.Shutdown(ctx); err != nil {
 		return err
 	}
+	if h.listener != nil {
+		// Closed by the server once it runs, only a listener bound but never run is left
+		_ = h.listener.Close()
+	}
 
 	h.log.Info("Stop server listen on " + h.server.Addr)
 
@@ -0,0 +1,251 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var (
+	ErrProxyHeader        = errors.New("invalid PROXY protocol header")
+	ErrMissingProxyHeader = errors.New("missing PROXY protocol header from a trusted source")
+	ErrNoTrustedSource    = errors.New("PROXY protocol needs at least one trusted source")
+)
+
+// proxyListener recovers the client and destination addresses sent in the PROXY protocol
+// v1 or v2 header by the trusted sources. The connections of the other sources are kept
+// as they are, their header is never read.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func parseTrustedSources(trustedSources []string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, source := range trustedSources {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted source %q is not an ip or CIDR", source)
+			}
+			if ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("trusted source %q is not an ip or CIDR", source)
+		}
+		trusted = append(trusted, ipNet)
+	}
+
+	return trusted, nil
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyConn reads the header lazily, in the connection goroutine of the server, so a slow
+// client never blocks the accept loop. A trusted source must send the header, the
+// connection fails on the first read otherwise.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader parses the header the connection must start with. The addresses are
+// nil for the UNKNOWN and LOCAL commands.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyV1Signature))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, ErrMissingProxyHeader
+		}
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV1Signature) {
+		return readProxyV1(r)
+	}
+	if !bytes.HasPrefix(proxyV2Signature, sig) {
+		return nil, nil, ErrMissingProxyHeader
+	}
+	if sig, err = r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(sig, proxyV2Signature) {
+		return nil, nil, ErrMissingProxyHeader
+	}
+
+	return readProxyV2(r)
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The v1 header is at most 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrProxyHeader
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip string, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyV2 parses the binary header: signature, version and command, family and
+// protocol, the length of the addresses block and the addresses followed by the TLVs
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := head[12], head[13]
+	length := int(binary.BigEndian.Uint16(head[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, nil, ErrProxyHeader
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL command, sent by the proxy for its own health checks
+	if verCmd&0x0f == 0 {
+		return nil, nil, nil
+	}
+	if verCmd&0x0f != 1 {
+		return nil, nil, ErrProxyHeader
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if length < 2*ipLen+4 {
+		return nil, nil, ErrProxyHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(block[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(block[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(block[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(block[2*ipLen+2:])),
+	}
+
+	return src, dst, nil
+}
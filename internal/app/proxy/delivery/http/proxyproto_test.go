@@ -0,0 +1,63 @@
+//go:build unit
+
+package http
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantSrc string
+		wantErr error
+	}{
+		{name: "v1", input: "PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\nGET /", wantSrc: "192.0.2.1:5000"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nGET /"},
+		{name: "v1 malformed", input: "PROXY TCP4 192.0.2.1\r\n", wantErr: ErrProxyHeader},
+		{name: "missing", input: "GET / HTTP/1.1\r\n\r\n", wantErr: ErrMissingProxyHeader},
+		{name: "empty", input: "", wantErr: ErrMissingProxyHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readProxyHeader() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantSrc != "" && (src == nil || src.String() != tt.wantSrc) {
+				t.Errorf("readProxyHeader() src = %v, want %s", src, tt.wantSrc)
+			}
+		})
+	}
+}
+
+func TestProxyListener_IsTrusted(t *testing.T) {
+	trusted, err := parseTrustedSources([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &proxyListener{trusted: trusted}
+	if !l.isTrusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Error("isTrusted(10.1.2.3) = false, want true")
+	}
+	if l.isTrusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("isTrusted(192.0.2.1) = true, want false")
+	}
+	if (&proxyListener{}).isTrusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Error("isTrusted() without trusted sources = true, want false")
+	}
+}
+
+func TestNewHandler_ProxyProtocolWithoutTrustedSource(t *testing.T) {
+	_, err := NewHandler(nil, logrus.New(), Config{ListenIP: "127.0.0.1", ListenPort: 8080, ProxyProtocol: true})
+	if !errors.Is(err, ErrNoTrustedSource) {
+		t.Errorf("NewHandler() error = %v, want %v", err, ErrNoTrustedSource)
+	}
+}
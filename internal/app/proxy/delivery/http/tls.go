@@ -0,0 +1,162 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoCertificate      = errors.New("tls listener has no certificate")
+	ErrMisdirectedRequest = errors.New("the tls connection does not serve the host of the request")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCandidates are the tls configs of the servers sharing a listener, in the config order
+type tlsCandidates []*tls.Config
+
+// newTLSConfig builds the listener tls config. When several servers share the port, the
+// certificate (and its own version, cipher and client CA settings) is chosen by SNI.
+func newTLSConfig(configs []TlsConfig) (*tls.Config, tlsCandidates, error) {
+	var candidates tlsCandidates
+	for _, c := range configs {
+		conf, err := newCertificateConfig(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates = append(candidates, conf)
+	}
+	if len(candidates) == 0 {
+		return nil, nil, ErrNoCertificate
+	}
+	if len(candidates) == 1 {
+		return candidates[0], candidates, nil
+	}
+
+	return &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, conf := range candidates {
+				if hello.SupportsCertificate(&conf.Certificates[0]) == nil {
+					return conf, nil
+				}
+			}
+			return candidates[0], nil
+		},
+	}, candidates, nil
+}
+
+// forName returns the config of the certificate valid for the name, the first one if none is
+func (c tlsCandidates) forName(name string) *tls.Config {
+	for _, conf := range c {
+		if conf.Certificates[0].Leaf.VerifyHostname(name) == nil {
+			return conf
+		}
+	}
+
+	return c[0]
+}
+
+// verify checks the connection was negotiated with the config of the request host. The
+// routes match on the Host header, so a client could otherwise send the SNI of a server
+// without client certificate and the Host of one requiring it.
+func (c tlsCandidates) verify(state *tls.ConnectionState, host string) error {
+	if len(c) < 2 {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	conf := c.forName(host)
+	if conf != c.forName(state.ServerName) {
+		return ErrMisdirectedRequest
+	}
+	if conf.ClientCAs == nil {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return ErrMisdirectedRequest
+	}
+	opts := x509.VerifyOptions{
+		Roots:         conf.ClientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+		return ErrMisdirectedRequest
+	}
+
+	return nil
+}
+
+func newCertificateConfig(c TlsConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// Hijacking the connection for websocket is only possible over HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls min version %q is not supported", c.MinVersion)
+		}
+		conf.MinVersion = version
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("tls cipher suite %q is not supported", name)
+		}
+		conf.CipherSuites = append(conf.CipherSuites, id)
+	}
+
+	if c.ClientCaFile != "" {
+		pem, err := os.ReadFile(c.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA file %s", c.ClientCaFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, true
+		}
+	}
+
+	return 0, false
+}
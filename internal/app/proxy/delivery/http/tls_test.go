@@ -0,0 +1,81 @@
+//go:build unit
+
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a certificate for the name, signed by the parent or self-signed
+func newTestCert(t *testing.T, name string, usage x509.ExtKeyUsage, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestTlsCandidates_Verify(t *testing.T) {
+	public, _ := newTestCert(t, "public.example.com", x509.ExtKeyUsageServerAuth, nil, nil)
+	private, _ := newTestCert(t, "private.example.com", x509.ExtKeyUsageServerAuth, nil, nil)
+	ca, caKey := newTestCert(t, "client-ca", x509.ExtKeyUsageClientAuth, nil, nil)
+	client, _ := newTestCert(t, "client", x509.ExtKeyUsageClientAuth, ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	candidates := tlsCandidates{
+		{Certificates: []tls.Certificate{{Leaf: public}}},
+		{Certificates: []tls.Certificate{{Leaf: private}}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert},
+	}
+
+	tests := []struct {
+		name    string
+		state   tls.ConnectionState
+		host    string
+		wantErr error
+	}{
+		{name: "public", state: tls.ConnectionState{ServerName: "public.example.com"}, host: "public.example.com:443"},
+		{name: "private with client cert", state: tls.ConnectionState{ServerName: "private.example.com", PeerCertificates: []*x509.Certificate{client}}, host: "private.example.com"},
+		{name: "sni of the public server", state: tls.ConnectionState{ServerName: "public.example.com"}, host: "private.example.com", wantErr: ErrMisdirectedRequest},
+		{name: "private without client cert", state: tls.ConnectionState{ServerName: "private.example.com"}, host: "private.example.com", wantErr: ErrMisdirectedRequest},
+		{name: "private with an untrusted cert", state: tls.ConnectionState{ServerName: "private.example.com", PeerCertificates: []*x509.Certificate{public}}, host: "private.example.com", wantErr: ErrMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := candidates.verify(&tt.state, tt.host); !errors.Is(err, tt.wantErr) {
+				t.Errorf("verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
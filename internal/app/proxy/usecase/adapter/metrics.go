@@ -0,0 +1,12 @@
+package adapter
+
+// MetricsAdapter records the routing outcome of the connections and the hits of the
+// payload modifiers, labeled with the route and rule names
+type MetricsAdapter interface {
+	ConnectionAccepted(route string)
+	ConnectionRejected(route string, reason string)
+	ModifierHit(route string, rule string)
+	ModifierError(route string, rule string)
+	// ModifierShadowHit counts the messages a rule in shadow mode would have modified
+	ModifierShadowHit(route string, rule string)
+}
@@ -1,10 +1,57 @@
 package adapter
 
 import (
+	"crypto/tls"
 	"github.com/poyaz/reverse-ws-modifier/internal/domain"
 	"net/http"
+	"regexp"
+	"time"
 )
 
+type WsOption struct {
+	// Route is the name of the route, reported with the session
+	Route          string
+	TLS            *tls.Config
+	MaxMessageSize int
+	Refragment     bool
+	Deflate        bool
+	// ProxyProtocol is the PROXY protocol version sent to the upstream, 0 to send none
+	ProxyProtocol int
+	// Record writes the messages of the session to a file, nil to record nothing
+	Record *RecordOption
+	// HandshakeResult is called with the outcome of dialing and handshaking the upstream
+	HandshakeResult func(err error)
+}
+
+type RecordOption struct {
+	File string
+	// Sample is the fraction of the sessions recorded, from 0 to 1
+	Sample float64
+	// MaxSize is the size in bytes the file is rotated at, keeping MaxBackups old files
+	MaxSize    int64
+	MaxBackups int
+	// MaxPayload truncates the recorded payloads, 0 to keep them whole
+	MaxPayload int
+}
+
+type HealthCheckOption struct {
+	Timeout   time.Duration
+	Handshake bool
+	Send      string
+	Expect    *regexp.Regexp
+}
+
 type WsAdapter interface {
-	New(addr string, rewriteHost string, beforeCallback func(r *http.Request) error, events ...domain.ModifierEvent) (domain.WsProxyUsecase, error)
+	New(addr string, rewriteHost string, opt WsOption, beforeCallback func(r *http.Request) error, afterCallback func(resp *http.Response) error, events ...domain.ModifierEvent) (domain.WsProxyUsecase, error)
+	HealthCheck(addr string, rewriteHost string, opt WsOption, check HealthCheckOption) error
+	Dial(addr string, rewriteHost string, opt WsOption, header http.Header) (WsClient, error)
+	Sessions() []domain.SessionInfo
+	CloseSession(id string, code uint16) error
+}
+
+// WsClient is a websocket connection opened by the proxy to an upstream
+type WsClient interface {
+	Send(opcode domain.OpcodeType, payload []byte) error
+	Receive() (domain.OpcodeType, []byte, error)
+	Close() error
 }
@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+var _ domain.WsProxyAdminUsecase = (*ws)(nil)
+
+// initRuleStates gives every rule its on/off state. The rules with the same route and
+// rule names as in the current snapshot share its state, so a reload does not undo a
+// toggle and a toggle still reaches the sessions started before the reload.
+func (w *ws) initRuleStates(servers []ServersConfig) {
+	previous := make(map[string]*atomic.Bool)
+	if current := w.snapshot.Load(); current != nil {
+		for _, server := range current.opt.Servers {
+			for _, rule := range server.Upstream.Override.WebsocketPayload {
+				previous[server.Name+"/"+rule.Name] = rule.enabled
+			}
+		}
+	}
+
+	for _, server := range servers {
+		rules := server.Upstream.Override.WebsocketPayload
+		for j := range rules {
+			if enabled, ok := previous[server.Name+"/"+rules[j].Name]; ok {
+				rules[j].enabled = enabled
+				continue
+			}
+			rules[j].enabled = &atomic.Bool{}
+			rules[j].enabled.Store(true)
+		}
+	}
+}
+
+// toggleModifiers wraps the handler of every rule to skip it while the rule is disabled.
+// The events are in the order of the rules they come from.
+func toggleModifiers(rules []WebsocketPayloadOverrideConfig, events []domain.ModifierEvent) {
+	for i := range events {
+		handler, enabled := events[i].Handler, rules[i].enabled
+		events[i].Handler = func(frame domain.Frame) (domain.Frame, error) {
+			if !enabled.Load() {
+				return frame, nil
+			}
+
+			return handler(frame)
+		}
+	}
+}
+
+// Routes lists the servers in the config order with their upstreams and rules
+func (w *ws) Routes() []domain.RouteInfo {
+	var routes []domain.RouteInfo
+	for _, server := range w.snapshot.Load().opt.Servers {
+		r := domain.RouteInfo{
+			Name:     server.Name,
+			Priority: server.Priority,
+			Scheme:   server.Upstream.Scheme,
+		}
+		if server.ListenIP != "" {
+			r.Listener = server.ListenIP + ":" + strconv.Itoa(server.ListenPort)
+		}
+		for _, p := range server.MatchPath {
+			r.Paths = append(r.Paths, domain.RoutePathInfo{Type: p.Type, Value: p.Value})
+		}
+		for _, t := range server.Upstream.balancer.targets {
+			r.Upstreams = append(r.Upstreams, domain.UpstreamInfo{
+				Addr:      t.addr,
+				Weight:    t.weight,
+				Available: t.available(),
+				Active:    t.active.Load(),
+			})
+		}
+		for _, rule := range server.Upstream.Override.WebsocketPayload {
+			r.Rules = append(r.Rules, domain.RuleInfo{Name: rule.Name, Enabled: rule.enabled.Load(), Mode: rule.Mode})
+		}
+		routes = append(routes, r)
+	}
+
+	return routes
+}
+
+func (w *ws) Sessions() []domain.SessionInfo {
+	return w.ws.Sessions()
+}
+
+// CloseSession closes the session with the code, which must be one an endpoint may send
+func (w *ws) CloseSession(id string, code uint16) error {
+	if !validCloseCode(code) {
+		return domain.ErrInvalidCloseCode
+	}
+
+	return w.ws.CloseSession(id, code)
+}
+
+// ToggleRule turns a payload rule of a route on or off, for the live sessions too
+func (w *ws) ToggleRule(route string, rule string, enabled bool) error {
+	for _, server := range w.snapshot.Load().opt.Servers {
+		if server.Name != route {
+			continue
+		}
+		for _, r := range server.Upstream.Override.WebsocketPayload {
+			if r.Name == rule {
+				r.enabled.Store(enabled)
+				return nil
+			}
+		}
+	}
+
+	return domain.ErrRuleNotFound
+}
+
+// validCloseCode excludes the codes reserved for the local use of the endpoints (1005,
+// 1006, 1015) and the unassigned ones
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,228 @@
+package ws
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const hashReplicas = 100
+
+var ErrNoUpstreamTarget = errors.New("no upstream target available")
+
+// target is one backend server of an upstream pool
+type target struct {
+	addr   string
+	weight int
+	*targetState
+
+	current int // smooth weighted round-robin state, guarded by balancer.mu
+}
+
+// targetState is the load and the health of a target, shared with the target of the same
+// route and address in the next snapshot so a reload keeps them
+type targetState struct {
+	active atomic.Int64
+
+	healthy      atomic.Bool
+	fails        atomic.Int32
+	ejectedUntil atomic.Int64
+}
+
+// balancer picks the target of every new connection with the configured strategy
+type balancer struct {
+	strategy domain.BalanceStrategy
+	hashOn   domain.HashSource
+	hashKey  string
+	targets  []*target
+
+	mu   sync.Mutex
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint32
+	target *target
+}
+
+func newBalancer(upstream UpstreamConfig) (*balancer, error) {
+	b := &balancer{
+		strategy: upstream.Balance.Strategy,
+		hashOn:   upstream.Balance.HashOn,
+		hashKey:  upstream.Balance.HashKey,
+	}
+	if b.strategy == 0 {
+		b.strategy = domain.RoundRobinBalance
+	}
+
+	targets := upstream.Targets
+	if len(targets) == 0 {
+		targets = []TargetConfig{{Ip: upstream.Ip, Port: upstream.Port}}
+	}
+	for _, t := range targets {
+		if t.Weight < 0 {
+			return nil, errors.New("upstream target " + t.Ip + " has a negative weight")
+		}
+		weight := t.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		bt := &target{addr: net.JoinHostPort(t.Ip, strconv.Itoa(t.Port)), weight: weight, targetState: &targetState{}}
+		bt.healthy.Store(true)
+		b.targets = append(b.targets, bt)
+	}
+
+	if b.strategy == domain.ConsistentHashBalance {
+		if b.hashOn == 0 || b.hashKey == "" {
+			return nil, errors.New("consistent-hash balance needs hashOn and hashKey")
+		}
+		for _, t := range b.targets {
+			for i := 0; i < hashReplicas*t.weight; i++ {
+				b.ring = append(b.ring, ringPoint{hash: hashString(t.addr + "#" + strconv.Itoa(i)), target: t})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+
+	return b, nil
+}
+
+// pick chooses the target of a new connection among the available ones
+func (b *balancer) pick(info domain.WsReqInfo) (*target, error) {
+	var targets []*target
+	for _, t := range b.targets {
+		if t.available() {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, ErrNoUpstreamTarget
+	}
+
+	switch b.strategy {
+	case domain.LeastConnectionsBalance:
+		return b.leastConnections(targets), nil
+	case domain.RandomBalance:
+		return b.random(targets), nil
+	case domain.ConsistentHashBalance:
+		if key, ok := b.key(info); ok {
+			return b.consistentHash(key), nil
+		}
+	}
+
+	return b.roundRobin(targets), nil
+}
+
+// roundRobin is the smooth weighted round-robin of nginx
+func (b *balancer) roundRobin(targets []*target) *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *target
+	total := 0
+	for _, t := range targets {
+		t.current += t.weight
+		total += t.weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	best.current -= total
+
+	return best
+}
+
+func (b *balancer) leastConnections(targets []*target) *target {
+	var best *target
+	var bestLoad float64
+	for _, t := range targets {
+		load := float64(t.active.Load()) / float64(t.weight)
+		if best == nil || load < bestLoad {
+			best, bestLoad = t, load
+		}
+	}
+
+	return best
+}
+
+func (b *balancer) random(targets []*target) *target {
+	total := 0
+	for _, t := range targets {
+		total += t.weight
+	}
+	n := rand.Intn(total)
+	for _, t := range targets {
+		if n < t.weight {
+			return t
+		}
+		n -= t.weight
+	}
+
+	return targets[len(targets)-1]
+}
+
+// consistentHash walks the ring from the key hash to the first available target
+func (b *balancer) consistentHash(key string) *target {
+	h := hashString(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	for i := 0; i < len(b.ring); i++ {
+		point := b.ring[(start+i)%len(b.ring)]
+		if point.target.available() {
+			return point.target
+		}
+	}
+
+	return b.ring[start%len(b.ring)].target
+}
+
+// key extracts the value the consistent hash is computed on
+func (b *balancer) key(info domain.WsReqInfo) (string, bool) {
+	switch b.hashOn {
+	case domain.HeaderHash:
+		v := info.Header.Get(b.hashKey)
+		return v, v != ""
+	case domain.CookieHash:
+		c, err := (&http.Request{Header: info.Header}).Cookie(b.hashKey)
+		if err != nil {
+			return "", false
+		}
+		return c.Value, true
+	case domain.QueryHash:
+		u, err := url.ParseRequestURI(info.URI)
+		if err != nil {
+			return "", false
+		}
+		v := u.Query().Get(b.hashKey)
+		return v, v != ""
+	}
+
+	return "", false
+}
+
+func hashString(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// trackedProxy counts the live connections of a target for the least-connections strategy
+type trackedProxy struct {
+	domain.WsProxyUsecase
+	target *target
+}
+
+func (p *trackedProxy) Proxy(writer http.ResponseWriter, request *http.Request) {
+	p.target.active.Add(1)
+	defer p.target.active.Add(-1)
+
+	p.WsProxyUsecase.Proxy(writer, request)
+}
@@ -0,0 +1,228 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+func newTestBalancer(t *testing.T, balance BalanceConfig, targets ...TargetConfig) *balancer {
+	t.Helper()
+	b, err := newBalancer(UpstreamConfig{Targets: targets, Balance: balance})
+	if err != nil {
+		t.Fatalf("newBalancer() error = %v", err)
+	}
+
+	return b
+}
+
+func pickAddr(t *testing.T, b *balancer, info domain.WsReqInfo) string {
+	t.Helper()
+	target, err := b.pick(info)
+	if err != nil {
+		t.Fatalf("pick() error = %v", err)
+	}
+
+	return target.addr
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := newTestBalancer(t, BalanceConfig{},
+		TargetConfig{Ip: "10.0.0.1", Port: 1, Weight: 5},
+		TargetConfig{Ip: "10.0.0.2", Port: 2},
+		TargetConfig{Ip: "10.0.0.3", Port: 3},
+	)
+	names := map[string]string{"10.0.0.1:1": "a", "10.0.0.2:2": "b", "10.0.0.3:3": "c"}
+
+	// The smooth weighted round-robin interleaves the heavy target with the others
+	var got []string
+	for i := 0; i < 14; i++ {
+		got = append(got, names[pickAddr(t, b, domain.WsReqInfo{})])
+	}
+	if want := "aabacaa" + "aabacaa"; strings.Join(got, "") != want {
+		t.Errorf("round-robin order = %s, want %s", strings.Join(got, ""), want)
+	}
+
+	// An unavailable target is left out of the rotation
+	b.targets[0].healthy.Store(false)
+	got = got[:0]
+	for i := 0; i < 4; i++ {
+		got = append(got, names[pickAddr(t, b, domain.WsReqInfo{})])
+	}
+	if strings.Contains(strings.Join(got, ""), "a") {
+		t.Errorf("round-robin order = %s, want the unhealthy target skipped", strings.Join(got, ""))
+	}
+
+	b.targets[1].healthy.Store(false)
+	b.targets[2].ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	if _, err := b.pick(domain.WsReqInfo{}); !errors.Is(err, ErrNoUpstreamTarget) {
+		t.Errorf("pick() error = %v, want %v", err, ErrNoUpstreamTarget)
+	}
+}
+
+func TestBalancer_LeastConnections(t *testing.T) {
+	b := newTestBalancer(t, BalanceConfig{Strategy: domain.LeastConnectionsBalance},
+		TargetConfig{Ip: "10.0.0.1", Port: 1, Weight: 2},
+		TargetConfig{Ip: "10.0.0.2", Port: 2},
+	)
+	tests := []struct {
+		active [2]int64
+		want   string
+	}{
+		{active: [2]int64{0, 0}, want: "10.0.0.1:1"},
+		{active: [2]int64{1, 0}, want: "10.0.0.2:2"},
+		{active: [2]int64{3, 2}, want: "10.0.0.1:1"},
+		// The load is weighted, 4 connections on a weight of 2 equal 2 on a weight of 1
+		{active: [2]int64{4, 2}, want: "10.0.0.1:1"},
+		{active: [2]int64{5, 2}, want: "10.0.0.2:2"},
+	}
+	for _, tt := range tests {
+		b.targets[0].active.Store(tt.active[0])
+		b.targets[1].active.Store(tt.active[1])
+		if got := pickAddr(t, b, domain.WsReqInfo{}); got != tt.want {
+			t.Errorf("pick() with %v connections = %s, want %s", tt.active, got, tt.want)
+		}
+	}
+}
+
+func TestTrackedProxy_CountsConnections(t *testing.T) {
+	b := newTestBalancer(t, BalanceConfig{}, TargetConfig{Ip: "10.0.0.1", Port: 1})
+	inner := &blockingProxy{started: make(chan struct{}), release: make(chan struct{})}
+	proxy := &trackedProxy{WsProxyUsecase: inner, target: b.targets[0]}
+
+	done := make(chan struct{})
+	go func() {
+		proxy.Proxy(nil, nil)
+		close(done)
+	}()
+	<-inner.started
+	if got := b.targets[0].active.Load(); got != 1 {
+		t.Errorf("active connections = %d, want 1", got)
+	}
+	close(inner.release)
+	<-done
+	if got := b.targets[0].active.Load(); got != 0 {
+		t.Errorf("active connections = %d, want 0 once closed", got)
+	}
+}
+
+// blockingProxy holds the connection open until it is released
+type blockingProxy struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingProxy) Proxy(http.ResponseWriter, *http.Request) {
+	close(p.started)
+	<-p.release
+}
+
+func TestBalancer_ConsistentHash(t *testing.T) {
+	targets := []TargetConfig{
+		{Ip: "10.0.0.1", Port: 1},
+		{Ip: "10.0.0.2", Port: 2},
+		{Ip: "10.0.0.3", Port: 3},
+	}
+	balance := BalanceConfig{Strategy: domain.ConsistentHashBalance, HashOn: domain.HeaderHash, HashKey: "X-User"}
+	info := func(user string) domain.WsReqInfo {
+		return domain.WsReqInfo{Header: http.Header{"X-User": []string{user}}}
+	}
+
+	b := newTestBalancer(t, balance, targets...)
+	before := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		user := "user-" + strconv.Itoa(i)
+		before[user] = pickAddr(t, b, info(user))
+		used[before[user]] = true
+		// The same key always goes to the same target
+		if again := pickAddr(t, b, info(user)); again != before[user] {
+			t.Fatalf("key %s picked %s then %s", user, before[user], again)
+		}
+	}
+	if len(used) != len(targets) {
+		t.Errorf("keys spread on %d targets, want %d", len(used), len(targets))
+	}
+
+	// A new target only takes keys over, the others keep their target
+	grown := newTestBalancer(t, balance, append(targets, TargetConfig{Ip: "10.0.0.4", Port: 4})...)
+	moved := 0
+	for user, addr := range before {
+		got := pickAddr(t, grown, info(user))
+		if got == addr {
+			continue
+		}
+		moved++
+		if got != "10.0.0.4:4" {
+			t.Errorf("key %s moved from %s to %s, want only moves to the new target", user, addr, got)
+		}
+	}
+	if moved == 0 || moved > len(before)/2 {
+		t.Errorf("%d of %d keys moved to the new target", moved, len(before))
+	}
+
+	// The keys of an unavailable target go to the next one on the ring, the others stay
+	b.targets[0].healthy.Store(false)
+	for user, addr := range before {
+		got := pickAddr(t, b, info(user))
+		if addr == "10.0.0.1:1" && got == addr {
+			t.Errorf("key %s kept on the unhealthy target", user)
+		}
+		if addr != "10.0.0.1:1" && got != addr {
+			t.Errorf("key %s moved from %s to %s while its target is available", user, addr, got)
+		}
+	}
+}
+
+func TestBalancer_HashKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		hashOn domain.HashSource
+		info   domain.WsReqInfo
+		want   string
+		wantOk bool
+	}{
+		{name: "header", hashOn: domain.HeaderHash, info: domain.WsReqInfo{Header: http.Header{"Sticky": []string{"a"}}}, want: "a", wantOk: true},
+		{name: "missing header", hashOn: domain.HeaderHash, info: domain.WsReqInfo{Header: http.Header{}}},
+		{name: "cookie", hashOn: domain.CookieHash, info: domain.WsReqInfo{Header: http.Header{"Cookie": []string{"x=1; sticky=b"}}}, want: "b", wantOk: true},
+		{name: "missing cookie", hashOn: domain.CookieHash, info: domain.WsReqInfo{Header: http.Header{"Cookie": []string{"x=1"}}}},
+		{name: "query", hashOn: domain.QueryHash, info: domain.WsReqInfo{URI: "/chat?sticky=c&x=1"}, want: "c", wantOk: true},
+		{name: "missing query", hashOn: domain.QueryHash, info: domain.WsReqInfo{URI: "/chat"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBalancer(t, BalanceConfig{Strategy: domain.ConsistentHashBalance, HashOn: tt.hashOn, HashKey: "sticky"},
+				TargetConfig{Ip: "10.0.0.1", Port: 1})
+			got, ok := b.key(tt.info)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("key() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestNewBalancer_Invalid(t *testing.T) {
+	tests := []UpstreamConfig{
+		{Targets: []TargetConfig{{Ip: "10.0.0.1", Port: 1, Weight: -1}}},
+		{Targets: []TargetConfig{{Ip: "10.0.0.1", Port: 1}}, Balance: BalanceConfig{Strategy: domain.ConsistentHashBalance, HashKey: "x"}},
+		{Targets: []TargetConfig{{Ip: "10.0.0.1", Port: 1}}, Balance: BalanceConfig{Strategy: domain.ConsistentHashBalance, HashOn: domain.HeaderHash}},
+	}
+	for _, upstream := range tests {
+		if _, err := newBalancer(upstream); err == nil {
+			t.Errorf("newBalancer(%+v) expected an error", upstream)
+		}
+	}
+
+	// The upstream address is the single target when no target is listed
+	b, err := newBalancer(UpstreamConfig{Ip: "10.0.0.1", Port: 3000})
+	if err != nil || len(b.targets) != 1 || b.targets[0].addr != "10.0.0.1:3000" || b.targets[0].weight != 1 {
+		t.Errorf("newBalancer() = %+v, %v, want the upstream address", b, err)
+	}
+}
@@ -0,0 +1,147 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// bytePattern is a hex pattern where a nil entry is a "??" wildcard matching any byte
+type bytePattern []*byte
+
+// parseBytePattern parses a hex string like "0a ?? ff" (whitespace is optional)
+func parseBytePattern(s string) (bytePattern, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s)%2 != 0 {
+		return nil, fmt.Errorf("hex pattern %q has an odd number of digits", s)
+	}
+
+	var pattern bytePattern
+	for i := 0; i < len(s); i += 2 {
+		if s[i:i+2] == "??" {
+			pattern = append(pattern, nil)
+			continue
+		}
+		b, err := hex.DecodeString(s[i : i+2])
+		if err != nil {
+			return nil, fmt.Errorf("hex pattern %q: %w", s, err)
+		}
+		pattern = append(pattern, &b[0])
+	}
+
+	return pattern, nil
+}
+
+func (p bytePattern) matchAt(data []byte, i int) bool {
+	if i+len(p) > len(data) {
+		return false
+	}
+	for j, b := range p {
+		if b != nil && data[i+j] != *b {
+			return false
+		}
+	}
+
+	return true
+}
+
+// replace substitutes every non-overlapping match of p in data with value.
+// A wildcard in value copies the byte at the same position of the match.
+func (p bytePattern) replace(data []byte, value bytePattern) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(data); {
+		if !p.matchAt(data, i) {
+			out.WriteByte(data[i])
+			i++
+			continue
+		}
+		for j, b := range value {
+			if b == nil {
+				out.WriteByte(data[i+j])
+			} else {
+				out.WriteByte(*b)
+			}
+		}
+		i += len(p)
+	}
+
+	return out.Bytes()
+}
+
+func newBytesHandler(match, value string) (domain.ModifierFunc, error) {
+	pattern, err := parseBytePattern(match)
+	if err != nil {
+		return nil, err
+	}
+	if len(pattern) == 0 {
+		return nil, errors.New("hex pattern is empty")
+	}
+	replacement, err := parseBytePattern(value)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range replacement {
+		if b == nil && i >= len(pattern) {
+			return nil, fmt.Errorf("wildcard at byte %d of %q is out of the matched pattern", i, value)
+		}
+	}
+
+	return func(frame domain.Frame) (domain.Frame, error) {
+		frame.Payload = pattern.replace(frame.Payload, replacement)
+		frame.Length = uint64(len(frame.Payload))
+
+		return frame, nil
+	}, nil
+}
+
+// newBinaryRegexHandler matches the regex against the payload with every byte mapped to
+// the rune of the same value (Latin-1), so "\x00-\xff" ranges address raw bytes
+func newBinaryRegexHandler(match, value string) (domain.ModifierFunc, error) {
+	rp, err := regexp.Compile(match)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(frame domain.Frame) (domain.Frame, error) {
+		payload, err := latin1Bytes(rp.ReplaceAllString(latin1String(frame.Payload), value))
+		if err != nil {
+			return frame, err
+		}
+		frame.Payload = payload
+		frame.Length = uint64(len(frame.Payload))
+
+		return frame, nil
+	}, nil
+}
+
+func latin1String(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes)
+}
+
+func latin1Bytes(s string) ([]byte, error) {
+	data := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF {
+			return nil, fmt.Errorf("binary replacement contains non-byte character %q", r)
+		}
+		data = append(data, byte(r))
+	}
+
+	return data, nil
+}
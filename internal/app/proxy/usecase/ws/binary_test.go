@@ -0,0 +1,131 @@
+//go:build unit
+
+package ws
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+func TestParseBytePattern(t *testing.T) {
+	b := func(v byte) *byte { return &v }
+	tests := []struct {
+		pattern string
+		want    bytePattern
+		wantErr bool
+	}{
+		{pattern: "", want: nil},
+		{pattern: "0a??FF", want: bytePattern{b(0x0a), nil, b(0xff)}},
+		{pattern: " 0a ?? ff\n", want: bytePattern{b(0x0a), nil, b(0xff)}},
+		{pattern: "0 a", want: bytePattern{b(0x0a)}},
+		{pattern: "0a f", wantErr: true},
+		{pattern: "?", wantErr: true},
+		{pattern: "?a", wantErr: true},
+		{pattern: "a?", wantErr: true},
+		{pattern: "zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBytePattern(tt.pattern)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBytePattern(%q) expected an error", tt.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBytePattern(%q) error = %v", tt.pattern, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseBytePattern(%q) has %d bytes, want %d", tt.pattern, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if (got[i] == nil) != (tt.want[i] == nil) || (got[i] != nil && *got[i] != *tt.want[i]) {
+				t.Errorf("parseBytePattern(%q) byte %d differs", tt.pattern, i)
+			}
+		}
+	}
+}
+
+func TestBytesHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		match   string
+		value   string
+		payload []byte
+		want    []byte
+	}{
+		{name: "exact", match: "0102", value: "ff", payload: []byte{0, 1, 2, 3, 1, 2}, want: []byte{0, 0xff, 3, 0xff}},
+		{name: "wildcard match", match: "01??03", value: "00", payload: []byte{1, 9, 3, 1, 8, 4}, want: []byte{0, 1, 8, 4}},
+		{name: "wildcard copies the matched byte", match: "01??", value: "02??", payload: []byte{1, 7, 1, 8}, want: []byte{2, 7, 2, 8}},
+		{name: "matches do not overlap", match: "0000", value: "01", payload: []byte{0, 0, 0}, want: []byte{1, 0}},
+		{name: "empty value removes", match: "ff", value: "", payload: []byte{1, 0xff, 2}, want: []byte{1, 2}},
+		{name: "no match", match: "ab", value: "cd", payload: []byte{1, 2}, want: []byte{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := newBytesHandler(tt.match, tt.value)
+			if err != nil {
+				t.Fatalf("newBytesHandler() error = %v", err)
+			}
+			out, err := handler(domain.Frame{Opcode: domain.BinaryOpcode, Payload: tt.payload, Length: uint64(len(tt.payload))})
+			if err != nil {
+				t.Fatalf("handler() error = %v", err)
+			}
+			if !bytes.Equal(out.Payload, tt.want) || out.Length != uint64(len(tt.want)) {
+				t.Errorf("handler() = %x (%d), want %x", out.Payload, out.Length, tt.want)
+			}
+		})
+	}
+
+	for _, rule := range [][2]string{{"", "00"}, {"0", "00"}, {"00", "0g"}, {"00", "00??"}} {
+		if _, err := newBytesHandler(rule[0], rule[1]); err == nil {
+			t.Errorf("newBytesHandler(%q, %q) expected an error", rule[0], rule[1])
+		}
+	}
+}
+
+func TestBinaryRegexHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		match   string
+		value   string
+		payload []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "raw byte range", match: `[\x80-\xff]+`, value: "?", payload: []byte{'a', 0x80, 0xfe, 'b'}, want: []byte("a?b")},
+		{name: "byte values are not utf-8", match: `\xe9`, value: ".", payload: []byte{0xc3, 0xa9, 0xe9}, want: []byte{0xc3, 0xa9, 0x2e}},
+		{name: "latin-1 replacement", match: "a", value: "ÿ", payload: []byte("abc"), want: []byte{0xff, 'b', 'c'}},
+		{name: "group expansion", match: `(\x01)(\x02)`, value: "$2$1", payload: []byte{0, 1, 2}, want: []byte{0, 2, 1}},
+		{name: "replacement above a byte", match: "a", value: "Ā", payload: []byte("a"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := newBinaryRegexHandler(tt.match, tt.value)
+			if err != nil {
+				t.Fatalf("newBinaryRegexHandler() error = %v", err)
+			}
+			out, err := handler(domain.Frame{Opcode: domain.BinaryOpcode, Payload: tt.payload, Length: uint64(len(tt.payload))})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("handler() expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handler() error = %v", err)
+			}
+			if !bytes.Equal(out.Payload, tt.want) || out.Length != uint64(len(tt.want)) {
+				t.Errorf("handler() = %x (%d), want %x", out.Payload, out.Length, tt.want)
+			}
+		})
+	}
+
+	if _, err := newBinaryRegexHandler("[", ""); err == nil {
+		t.Errorf("newBinaryRegexHandler() expected an error for an invalid regex")
+	}
+}
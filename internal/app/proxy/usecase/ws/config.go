@@ -1,40 +1,197 @@
 package ws
 
-import "github.com/poyaz/reverse-ws-modifier/internal/domain"
+import (
+	"crypto/tls"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
 
 type Config struct {
 	Servers []ServersConfig
+	// NoHealthCheck leaves the upstreams without their active checks, as in a replay
+	NoHealthCheck bool
 }
 
 type ServersConfig struct {
-	MatchPath []MatchPathConfig
-	Upstream  UpstreamConfig
+	// Name labels the route in the metrics
+	Name string
+	// ListenIP and ListenPort restrict the server to the requests of one listener
+	ListenIP   string
+	ListenPort int
+	// Priority ranks the server before the path specificity, higher first
+	Priority         int
+	MatchPath        []MatchPathConfig
+	MatchHost        []MatchHostConfig
+	MatchHeaders     []MatchKeyConfig
+	MatchQuery       []MatchKeyConfig
+	MatchSubprotocol []string
+	Forwarded        ForwardedConfig
+	Record           RecordConfig
+	Upstream         UpstreamConfig
+}
+
+type RecordConfig struct {
+	// File is the JSON Lines file the messages of the route are written to, empty to
+	// record nothing
+	File string
+	// Sample is the fraction of the sessions recorded, from 0 to 1
+	Sample float64
+	// MaxSize is the size in bytes the file is rotated at, keeping MaxBackups old files
+	MaxSize    int64
+	MaxBackups int
+	// MaxPayload truncates the recorded payloads, 0 to keep them whole
+	MaxPayload int
+}
+
+type ForwardedConfig struct {
+	Enable bool
+	// TrustedProxies are the ips or CIDRs of the proxies whose forwarded headers are kept
+	TrustedProxies []string
+
+	trusted []*net.IPNet
 }
 
 type MatchPathConfig struct {
 	Type  domain.FindMatch
 	Value string
+
+	rp *regexp.Regexp
+}
+
+type MatchHostConfig struct {
+	Type  domain.FindMatch
+	Value string
+
+	rp *regexp.Regexp
+}
+
+type MatchKeyConfig struct {
+	Key   string
+	Type  domain.FindMatch
+	Value string
+
+	rp *regexp.Regexp
 }
 
 type UpstreamConfig struct {
-	Ip       string
-	Port     int
-	Override OverrideConfig
+	Scheme string
+	Ip     string
+	Port   int
+	// ProxyProtocol is the PROXY protocol version sent on connect, 0 to send none
+	ProxyProtocol int
+	Targets       []TargetConfig
+	Balance       BalanceConfig
+	HealthCheck   HealthCheckConfig
+	Tls           TlsConfig
+	Message       MessageConfig
+	Override      OverrideConfig
+
+	tlsConfig *tls.Config
+	balancer  *balancer
+	// payloadRules are the payload rules compiled once per snapshot, modifiers the same
+	// rules wrapped as the connections run them
+	payloadRules []domain.ModifierEvent
+	modifiers    []domain.ModifierEvent
+}
+
+type TargetConfig struct {
+	Ip     string
+	Port   int
+	Weight int
+}
+
+type BalanceConfig struct {
+	Strategy domain.BalanceStrategy
+	HashOn   domain.HashSource
+	HashKey  string
+}
+
+type HealthCheckConfig struct {
+	Type        domain.HealthCheckType
+	Interval    time.Duration
+	Timeout     time.Duration
+	Path        string
+	Send        string
+	Expect      string
+	MaxFails    int
+	FailTimeout time.Duration
+}
+
+type TlsConfig struct {
+	CaFile             string
+	ServerName         string
+	InsecureSkipVerify bool
+	CertFile           string
+	KeyFile            string
+}
+
+type MessageConfig struct {
+	MaxSize    int
+	Refragment bool
+	Deflate    bool
 }
 
 type OverrideConfig struct {
 	Host             string
+	Path             PathOverrideConfig
+	StripHopByHop    bool
+	StripSensitive   bool
 	Header           []HeaderOverrideConfig
+	ResponseHeader   []HeaderOverrideConfig
 	WebsocketPayload []WebsocketPayloadOverrideConfig
 }
 
-type HeaderOverrideConfig struct {
+type PathOverrideConfig struct {
+	StripPrefix string
+	AddPrefix   string
+	// Regex replaces its matches in the path with Replace, where the groups of Regex and
+	// then the capture groups of the match rule are expanded. Without Regex, Replace is
+	// a template of the whole path using the capture groups of the match rule.
+	Regex   string
+	Replace string
+	Query   QueryOverrideConfig
+
+	rp *regexp.Regexp
+}
+
+type QueryOverrideConfig struct {
+	Add    []QueryParamConfig
+	Remove []string
+	Rename []QueryRenameConfig
+}
+
+type QueryParamConfig struct {
 	Key   string
 	Value string
 }
 
+type QueryRenameConfig struct {
+	From string
+	To   string
+}
+
+type HeaderOverrideConfig struct {
+	Key    string
+	Value  string
+	Action domain.HeaderAction
+}
+
 type WebsocketPayloadOverrideConfig struct {
-	Type  domain.FindMatch
-	Match string
-	Value string
+	// Name labels the rule in the metrics
+	Name      string
+	Type      domain.FindMatch
+	Direction domain.Direction
+	Match     string
+	Path      string
+	Operation domain.JsonOperation
+	Value     string
+	// Mode is EnforceMode if unset, a rule in ShadowMode only logs and counts its changes
+	Mode domain.RuleMode
+
+	// enabled is toggled by the admin api, shared by the connections of the snapshot
+	enabled *atomic.Bool
 }
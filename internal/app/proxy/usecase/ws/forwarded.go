@@ -0,0 +1,121 @@
+package ws
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const (
+	forwardedForHeader   = "X-Forwarded-For"
+	forwardedProtoHeader = "X-Forwarded-Proto"
+	forwardedHostHeader  = "X-Forwarded-Host"
+	forwardedHeader      = "Forwarded"
+)
+
+func (f *ForwardedConfig) compile() error {
+	for _, proxy := range f.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("trusted proxy %q is not an ip or CIDR", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			f.trusted = append(f.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("trusted proxy %q is not an ip or CIDR", proxy)
+		}
+		f.trusted = append(f.trusted, ipNet)
+	}
+
+	return nil
+}
+
+func (f ForwardedConfig) isTrusted(ip net.IP) bool {
+	for _, ipNet := range f.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply adds the client to the forwarded headers. The values sent by a trusted proxy are
+// kept and extended, the ones sent by anybody else are overwritten.
+func (f ForwardedConfig) apply(header http.Header, info domain.WsReqInfo) {
+	if !f.Enable {
+		return
+	}
+
+	clientIP := info.RemoteAddr
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	proto := "http"
+	if info.Tls {
+		proto = "https"
+	}
+
+	if !f.isTrusted(net.ParseIP(clientIP)) {
+		for _, name := range []string{forwardedForHeader, forwardedProtoHeader, forwardedHostHeader, forwardedHeader} {
+			header.Del(name)
+		}
+	}
+
+	if prior := strings.Join(header.Values(forwardedForHeader), ", "); prior != "" {
+		header.Set(forwardedForHeader, prior+", "+clientIP)
+	} else {
+		header.Set(forwardedForHeader, clientIP)
+	}
+	if header.Get(forwardedProtoHeader) == "" {
+		header.Set(forwardedProtoHeader, proto)
+	}
+	if header.Get(forwardedHostHeader) == "" {
+		header.Set(forwardedHostHeader, info.Host)
+	}
+
+	element := "for=" + forwardedNode(clientIP) + ";host=" + forwardedValue(info.Host) + ";proto=" + proto
+	if prior := strings.Join(header.Values(forwardedHeader), ", "); prior != "" {
+		header.Set(forwardedHeader, prior+", "+element)
+	} else {
+		header.Set(forwardedHeader, element)
+	}
+}
+
+// forwardedNode formats the node of the Forwarded header, ipv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes the value if it is not a token (RFC 7230 section 3.2.6)
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
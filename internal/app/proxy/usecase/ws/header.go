@@ -0,0 +1,131 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// hopByHopHeaders are meaningful only for a single connection (RFC 7230 section 6.1).
+// Connection and Upgrade are kept since the upstream handshake needs them.
+var hopByHopHeaders = []string{
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+}
+
+// handshakeResponseHeaders are set by the proxy on the response to the client, the
+// response header rules cannot change them
+var handshakeResponseHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Extensions",
+}
+
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+}
+
+// templateVars returns the variables the header values can reference. The capture groups
+// of the match rule take precedence over the request variables.
+func templateVars(info domain.WsReqInfo, captures map[string]string) map[string]string {
+	remoteAddr := info.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	requestID := info.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	vars := map[string]string{
+		"remote_addr": remoteAddr,
+		"host":        info.Host,
+		"request_id":  requestID,
+	}
+	for k, v := range captures {
+		vars[k] = v
+	}
+
+	return vars
+}
+
+// applyHeaders strips the configured header groups and then applies the header rules in order
+func (o OverrideConfig) applyHeaders(header http.Header, vars map[string]string) {
+	if o.StripHopByHop {
+		for _, v := range header.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				name = strings.TrimSpace(name)
+				if !strings.EqualFold(name, "upgrade") {
+					header.Del(name)
+				}
+			}
+		}
+		for _, name := range hopByHopHeaders {
+			header.Del(name)
+		}
+	}
+	if o.StripSensitive {
+		for _, name := range sensitiveHeaders {
+			header.Del(name)
+		}
+	}
+
+	applyHeaderRules(header, o.Header, vars)
+}
+
+// applyResponseHeaders applies the response header rules to the handshake response of the upstream
+func (o OverrideConfig) applyResponseHeaders(header http.Header, vars map[string]string) {
+	applyHeaderRules(header, o.ResponseHeader, vars)
+}
+
+// validateResponseHeaders rejects the response header rules on the handshake headers
+func (o OverrideConfig) validateResponseHeaders() error {
+	for _, oh := range o.ResponseHeader {
+		for _, name := range handshakeResponseHeaders {
+			if http.CanonicalHeaderKey(oh.Key) == name {
+				return fmt.Errorf("response header %s is part of the handshake and cannot be overridden", oh.Key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func applyHeaderRules(header http.Header, rules []HeaderOverrideConfig, vars map[string]string) {
+	for _, oh := range rules {
+		switch oh.Action {
+		case domain.HeaderRemoveAction:
+			header.Del(oh.Key)
+		case domain.HeaderAddAction:
+			header.Add(oh.Key, expandTemplate(oh.Value, vars))
+		case domain.HeaderSetIfAbsentAction:
+			if len(header.Values(oh.Key)) == 0 {
+				header.Set(oh.Key, expandTemplate(oh.Value, vars))
+			}
+		default:
+			header.Set(oh.Key, expandTemplate(oh.Value, vars))
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
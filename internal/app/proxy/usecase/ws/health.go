@@ -0,0 +1,166 @@
+package ws
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultFailTimeout         = 30 * time.Second
+)
+
+// report counts the consecutive dial/handshake failures of the target and ejects it
+// from the balancing for FailTimeout once MaxFails is reached
+func (t *target) report(err error, check HealthCheckConfig, log logrus.FieldLogger) {
+	if err == nil {
+		t.fails.Store(0)
+		return
+	}
+	if check.MaxFails <= 0 || t.fails.Add(1) < int32(check.MaxFails) {
+		return
+	}
+
+	t.fails.Store(0)
+	failTimeout := check.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = defaultFailTimeout
+	}
+	t.ejectedUntil.Store(time.Now().Add(failTimeout).UnixNano())
+	log.WithFields(logrus.Fields{"upstream": t.addr, "error": err}).Warn("Upstream ejected after consecutive failures")
+}
+
+// carryTargetStates gives the targets with the same route name and address as in the
+// current snapshot its state, so a reload neither puts an ejected or unhealthy target back
+// in the pool nor resets the connection counts. A target is healthy again once its
+// upstream has no active check anymore, nothing would mark it back up otherwise.
+func (w *ws) carryTargetStates(servers []ServersConfig) {
+	previous := make(map[string]*targetState)
+	if current := w.snapshot.Load(); current != nil {
+		for _, server := range current.opt.Servers {
+			for _, t := range server.Upstream.balancer.targets {
+				previous[server.Name+"/"+t.addr] = t.targetState
+			}
+		}
+	}
+
+	for _, server := range servers {
+		for _, t := range server.Upstream.balancer.targets {
+			state, ok := previous[server.Name+"/"+t.addr]
+			if !ok {
+				continue
+			}
+			t.targetState = state
+			if server.Upstream.HealthCheck.Type == 0 {
+				t.healthy.Store(true)
+			}
+		}
+	}
+}
+
+// available checks if the target passed its last active check and is not passively ejected
+func (t *target) available() bool {
+	return t.healthy.Load() && time.Now().UnixNano() >= t.ejectedUntil.Load()
+}
+
+// healthChecker periodically probes every target of an upstream pool
+type healthChecker struct {
+	ws       adapter.WsAdapter
+	log      logrus.FieldLogger
+	upstream UpstreamConfig
+	check    adapter.HealthCheckOption
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newHealthChecker(wsInfra adapter.WsAdapter, log logrus.FieldLogger, upstream UpstreamConfig) (*healthChecker, error) {
+	check := upstream.HealthCheck
+	opt := adapter.HealthCheckOption{
+		Timeout:   check.Timeout,
+		Handshake: check.Type == domain.WebsocketHealthCheck,
+		Send:      check.Send,
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultHealthCheckTimeout
+	}
+	if check.Expect != "" {
+		rp, err := regexp.Compile(check.Expect)
+		if err != nil {
+			return nil, err
+		}
+		opt.Expect = rp
+	}
+
+	return &healthChecker{
+		ws:       wsInfra,
+		log:      log,
+		upstream: upstream,
+		check:    opt,
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+func (h *healthChecker) run() {
+	interval := h.upstream.HealthCheck.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	for _, t := range h.upstream.balancer.targets {
+		h.wg.Add(1)
+		go func(t *target) {
+			defer h.wg.Done()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				h.probe(t)
+				select {
+				case <-h.stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}(t)
+	}
+}
+
+func (h *healthChecker) probe(t *target) {
+	path := h.upstream.HealthCheck.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	opt := adapter.WsOption{
+		TLS:            h.upstream.tlsConfig,
+		MaxMessageSize: h.upstream.Message.MaxSize,
+		ProxyProtocol:  h.upstream.ProxyProtocol,
+	}
+
+	err := h.ws.HealthCheck(h.upstream.Scheme+"://"+t.addr+path, h.upstream.Override.Host, opt, h.check)
+	healthy := err == nil
+	if healthy {
+		t.ejectedUntil.Store(0)
+	}
+	if t.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	if healthy {
+		h.log.WithField("upstream", t.addr).Info("Upstream is healthy")
+	} else {
+		h.log.WithFields(logrus.Fields{"upstream": t.addr, "error": err}).Warn("Upstream is unhealthy")
+	}
+}
+
+func (h *healthChecker) shutdown() {
+	close(h.stop)
+	h.wg.Wait()
+}
@@ -0,0 +1,170 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// healthAdapter fails the health checks of the addresses set as down
+type healthAdapter struct {
+	fakeWsAdapter
+	mu     sync.Mutex
+	down   map[string]bool
+	checks map[string]int
+	opt    adapter.HealthCheckOption
+}
+
+func (a *healthAdapter) HealthCheck(addr string, _ string, _ adapter.WsOption, opt adapter.HealthCheckOption) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checks[addr]++
+	a.opt = opt
+	if a.down[addr] {
+		return errors.New("connection refused")
+	}
+
+	return nil
+}
+
+func (a *healthAdapter) setDown(addr string, down bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.down[addr] = down
+}
+
+func newTestHealthChecker(t *testing.T, check HealthCheckConfig) (*healthChecker, *healthAdapter) {
+	t.Helper()
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	upstream := UpstreamConfig{
+		Scheme: "ws",
+		Targets: []TargetConfig{
+			{Ip: "10.0.0.1", Port: 1},
+			{Ip: "10.0.0.2", Port: 2},
+		},
+		HealthCheck: check,
+	}
+	b, err := newBalancer(upstream)
+	if err != nil {
+		t.Fatalf("newBalancer() error = %v", err)
+	}
+	upstream.balancer = b
+
+	wsAdapter := &healthAdapter{down: make(map[string]bool), checks: make(map[string]int)}
+	h, err := newHealthChecker(wsAdapter, log, upstream)
+	if err != nil {
+		t.Fatalf("newHealthChecker() error = %v", err)
+	}
+
+	return h, wsAdapter
+}
+
+func TestHealthChecker_Probe(t *testing.T) {
+	h, wsAdapter := newTestHealthChecker(t, HealthCheckConfig{Type: domain.WebsocketHealthCheck, Path: "health", Expect: "^ok$"})
+	first, second := h.upstream.balancer.targets[0], h.upstream.balancer.targets[1]
+
+	wsAdapter.setDown("ws://10.0.0.1:1/health", true)
+	h.probe(first)
+	h.probe(second)
+	if first.available() || !second.available() {
+		t.Errorf("available = %v, %v after the first target failed its check", first.available(), second.available())
+	}
+	if !wsAdapter.opt.Handshake || wsAdapter.opt.Expect == nil || wsAdapter.opt.Timeout != defaultHealthCheckTimeout {
+		t.Errorf("health check option = %+v, want a websocket check with the default timeout", wsAdapter.opt)
+	}
+
+	// A passing check brings the target back, even if it was passively ejected
+	first.ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	wsAdapter.setDown("ws://10.0.0.1:1/health", false)
+	h.probe(first)
+	if !first.available() {
+		t.Error("target unavailable after a passing check")
+	}
+}
+
+func TestHealthChecker_Run(t *testing.T) {
+	h, wsAdapter := newTestHealthChecker(t, HealthCheckConfig{Type: domain.TcpHealthCheck, Interval: time.Hour})
+	wsAdapter.setDown("ws://10.0.0.2:2/", true)
+
+	// Every target is probed once as soon as the checker starts
+	h.run()
+	h.shutdown()
+	wsAdapter.mu.Lock()
+	defer wsAdapter.mu.Unlock()
+	if wsAdapter.checks["ws://10.0.0.1:1/"] != 1 || wsAdapter.checks["ws://10.0.0.2:2/"] != 1 {
+		t.Errorf("checks = %v, want one per target", wsAdapter.checks)
+	}
+	if wsAdapter.opt.Handshake {
+		t.Error("tcp health check sent a handshake")
+	}
+	if targets := h.upstream.balancer.targets; !targets[0].available() || targets[1].available() {
+		t.Errorf("available = %v, %v, want the second target down", targets[0].available(), targets[1].available())
+	}
+}
+
+func TestNewHealthChecker_InvalidExpect(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	if _, err := newHealthChecker(fakeWsAdapter{}, log, UpstreamConfig{HealthCheck: HealthCheckConfig{Expect: "("}}); err == nil {
+		t.Error("newHealthChecker() expected an error for an invalid expect regex")
+	}
+}
+
+func TestTarget_Report(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	failed := errors.New("connection refused")
+
+	tg := &target{addr: "10.0.0.1:1", weight: 1, targetState: &targetState{}}
+	tg.healthy.Store(true)
+	check := HealthCheckConfig{MaxFails: 3, FailTimeout: 50 * time.Millisecond}
+
+	// A success resets the count of consecutive failures
+	tg.report(failed, check, log)
+	tg.report(failed, check, log)
+	tg.report(nil, check, log)
+	tg.report(failed, check, log)
+	tg.report(failed, check, log)
+	if !tg.available() {
+		t.Fatal("target ejected before maxFails consecutive failures")
+	}
+
+	before := time.Now()
+	tg.report(failed, check, log)
+	after := time.Now()
+	if tg.available() {
+		t.Fatal("target available after maxFails consecutive failures")
+	}
+	until := time.Unix(0, tg.ejectedUntil.Load())
+	if until.Before(before.Add(check.FailTimeout)) || until.After(after.Add(check.FailTimeout)) {
+		t.Errorf("ejected until %v, want failTimeout after the last failure", until)
+	}
+
+	time.Sleep(time.Until(until) + 10*time.Millisecond)
+	if !tg.available() {
+		t.Error("target still ejected after failTimeout")
+	}
+
+	// The default fail timeout applies when none is set, no maxFails disables the ejection
+	tg.report(failed, HealthCheckConfig{MaxFails: 1}, log)
+	if until := time.Until(time.Unix(0, tg.ejectedUntil.Load())); until <= defaultFailTimeout-time.Second || until > defaultFailTimeout {
+		t.Errorf("ejected for %v, want %v", until, defaultFailTimeout)
+	}
+	other := &target{addr: "10.0.0.2:2", weight: 1, targetState: &targetState{}}
+	other.healthy.Store(true)
+	for i := 0; i < 10; i++ {
+		other.report(failed, HealthCheckConfig{}, log)
+	}
+	if !other.available() {
+		t.Error("target ejected without maxFails")
+	}
+}
@@ -0,0 +1,499 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+var ErrJsonPathFormat = errors.New("json path format error")
+
+// jsonSegment is one step of a json path, either an object key or an array index
+type jsonSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+type jsonPath []jsonSegment
+
+// parseJsonPath parses selectors like $.data.items[0]["a.b"] (the leading $ is optional)
+func parseJsonPath(s string) (jsonPath, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "$")
+
+	var path jsonPath
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end == -1 {
+				end = len(s) - 1
+			}
+			key := s[1 : end+1]
+			if key == "" {
+				return nil, ErrJsonPathFormat
+			}
+			path = append(path, jsonSegment{key: key})
+			s = s[end+1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, ErrJsonPathFormat
+			}
+			inner := s[1:end]
+			if key, err := strconv.Unquote(inner); err == nil {
+				path = append(path, jsonSegment{key: key})
+			} else if index, err := strconv.Atoi(inner); err == nil && index >= 0 {
+				path = append(path, jsonSegment{index: index, isIndex: true})
+			} else {
+				return nil, ErrJsonPathFormat
+			}
+			s = s[end+1:]
+		default:
+			return nil, ErrJsonPathFormat
+		}
+	}
+
+	return path, nil
+}
+
+func (p jsonPath) get(node interface{}) (interface{}, bool) {
+	for _, seg := range p {
+		switch v := node.(type) {
+		case *jsonObject:
+			if seg.isIndex {
+				return nil, false
+			}
+			child, ok := v.get(seg.key)
+			if !ok {
+				return nil, false
+			}
+			node = child
+		case []interface{}:
+			if !seg.isIndex || seg.index >= len(v) {
+				return nil, false
+			}
+			node = v[seg.index]
+		default:
+			return nil, false
+		}
+	}
+
+	return node, true
+}
+
+// update calls fn on the parent container of the last segment and returns the new root.
+// Missing objects along the path are created when create is set.
+func (p jsonPath) update(node interface{}, create bool, fn func(parent interface{}, seg jsonSegment) (interface{}, bool)) (interface{}, bool) {
+	if len(p) == 0 {
+		return node, false
+	}
+	if len(p) == 1 {
+		return fn(node, p[0])
+	}
+
+	seg := p[0]
+	switch v := node.(type) {
+	case *jsonObject:
+		if seg.isIndex {
+			return node, false
+		}
+		child, ok := v.get(seg.key)
+		if !ok {
+			if !create {
+				return node, false
+			}
+			child = newJsonObject()
+		}
+		child, changed := p[1:].update(child, create, fn)
+		if changed {
+			v.set(seg.key, child)
+		}
+		return v, changed
+	case []interface{}:
+		if !seg.isIndex || seg.index >= len(v) {
+			return node, false
+		}
+		child, changed := p[1:].update(v[seg.index], create, fn)
+		if changed {
+			v[seg.index] = child
+		}
+		return v, changed
+	}
+
+	return node, false
+}
+
+// jsonPredicate selects the messages a json rule applies to, e.g. $.type == "subscribe"
+type jsonPredicate struct {
+	path    jsonPath
+	negate  bool
+	value   interface{}
+	isExist bool
+}
+
+func parseJsonPredicate(s string) (*jsonPredicate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	pred := &jsonPredicate{}
+	operator := "=="
+	idx := strings.Index(s, operator)
+	if neq := strings.Index(s, "!="); neq != -1 && (idx == -1 || neq < idx) {
+		operator, idx, pred.negate = "!=", neq, true
+	}
+	if idx == -1 {
+		path, err := parseJsonPath(s)
+		if err != nil {
+			return nil, err
+		}
+		pred.path, pred.isExist = path, true
+		return pred, nil
+	}
+
+	path, err := parseJsonPath(s[:idx])
+	if err != nil {
+		return nil, err
+	}
+	value, err := decodeJson([]byte(strings.TrimSpace(s[idx+len(operator):])))
+	if err != nil {
+		return nil, fmt.Errorf("json predicate %q: %w", s, err)
+	}
+	pred.path, pred.value = path, value
+
+	return pred, nil
+}
+
+func (p *jsonPredicate) match(doc interface{}) bool {
+	if p == nil {
+		return true
+	}
+	v, ok := p.path.get(doc)
+	if p.isExist {
+		return ok
+	}
+
+	return (ok && jsonEqual(v, p.value)) != p.negate
+}
+
+// jsonEqual compares json values, the numbers by value and the objects regardless of the
+// order of their keys
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		if aerr == nil && berr == nil {
+			return af == bf
+		}
+		return av == bv
+	case *jsonObject:
+		bv, ok := b.(*jsonObject)
+		if !ok || len(av.keys) != len(bv.keys) {
+			return false
+		}
+		for _, key := range av.keys {
+			bchild, ok := bv.get(key)
+			if !ok || !jsonEqual(av.values[key], bchild) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return a == b
+}
+
+// jsonObject is a json object keeping the order of its keys, so a rewritten message only
+// differs from the original one by the fields the rule changed
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newJsonObject() *jsonObject {
+	return &jsonObject{values: make(map[string]interface{})}
+}
+
+func (o *jsonObject) get(key string) (interface{}, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// set replaces the value of the key in place, a new key is added at the end
+func (o *jsonObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) delete(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// rename moves the value to the new key at the position of the old one, replacing the
+// new key if it was already set
+func (o *jsonObject) rename(from string, to string) {
+	value, ok := o.values[from]
+	if !ok || from == to {
+		return
+	}
+	o.delete(to)
+	delete(o.values, from)
+	o.values[to] = value
+	for i, k := range o.keys {
+		if k == from {
+			o.keys[i] = to
+			break
+		}
+	}
+}
+
+func decodeJson(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJsonValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after json value")
+	}
+
+	return v, nil
+}
+
+// decodeJsonValue reads the next value of the decoder, with the objects as *jsonObject. A
+// duplicated key keeps its first position and its last value.
+func decodeJsonValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		o := newJsonObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJsonValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			o.set(key.(string), value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return o, nil
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := decodeJsonValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	}
+
+	return token, nil
+}
+
+func encodeJson(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := appendJson(&buf, v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func appendJson(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, key := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := appendJson(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := appendJson(buf, v.values[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := appendJson(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	// The encoder ends every value with a newline
+	buf.Truncate(buf.Len() - 1)
+
+	return nil
+}
+
+// newJsonHandler builds a modifier that rewrites the field selected by o.Path in every
+// json text message matching the o.Match predicate. Messages that are not json pass through.
+func newJsonHandler(o WebsocketPayloadOverrideConfig) (domain.ModifierFunc, error) {
+	pred, err := parseJsonPredicate(o.Match)
+	if err != nil {
+		return nil, err
+	}
+	path, err := parseJsonPath(o.Path)
+	if err != nil {
+		return nil, fmt.Errorf("json path %q: %w", o.Path, err)
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("json path %q: %w", o.Path, ErrJsonPathFormat)
+	}
+
+	// value decodes a fresh copy for every use, so documents never share (and mutate) the same node
+	value := func() interface{} {
+		v, err := decodeJson([]byte(o.Value))
+		if err != nil {
+			// Not a json literal, so use it as plain string
+			return o.Value
+		}
+		return v
+	}
+	switch o.Operation {
+	case domain.JsonSetOperation, domain.JsonAppendOperation:
+	case domain.JsonRenameOperation:
+		if o.Value == "" || path[len(path)-1].isIndex {
+			return nil, fmt.Errorf("json rename of %q needs an object key and a new name", o.Path)
+		}
+	case domain.JsonDeleteOperation:
+	default:
+		return nil, fmt.Errorf("json operation for %q is not supported", o.Path)
+	}
+
+	operation := func(parent interface{}, seg jsonSegment) (interface{}, bool) {
+		switch v := parent.(type) {
+		case *jsonObject:
+			if seg.isIndex {
+				return parent, false
+			}
+			current, exist := v.get(seg.key)
+			switch o.Operation {
+			case domain.JsonSetOperation:
+				v.set(seg.key, value())
+			case domain.JsonDeleteOperation:
+				v.delete(seg.key)
+			case domain.JsonRenameOperation:
+				if !exist {
+					return parent, false
+				}
+				v.rename(seg.key, o.Value)
+			case domain.JsonAppendOperation:
+				arr, ok := current.([]interface{})
+				if exist && !ok {
+					return parent, false
+				}
+				v.set(seg.key, append(arr, value()))
+			}
+			return v, exist || o.Operation == domain.JsonSetOperation || o.Operation == domain.JsonAppendOperation
+		case []interface{}:
+			if !seg.isIndex || seg.index >= len(v) {
+				return parent, false
+			}
+			switch o.Operation {
+			case domain.JsonSetOperation:
+				v[seg.index] = value()
+			case domain.JsonDeleteOperation:
+				v = append(v[:seg.index], v[seg.index+1:]...)
+			case domain.JsonAppendOperation:
+				arr, ok := v[seg.index].([]interface{})
+				if !ok {
+					return parent, false
+				}
+				v[seg.index] = append(arr, value())
+			default:
+				return parent, false
+			}
+			return v, true
+		}
+
+		return parent, false
+	}
+	create := o.Operation == domain.JsonSetOperation || o.Operation == domain.JsonAppendOperation
+
+	return func(frame domain.Frame) (domain.Frame, error) {
+		doc, err := decodeJson(frame.Payload)
+		if err != nil || !pred.match(doc) {
+			return frame, nil
+		}
+
+		doc, changed := path.update(doc, create, operation)
+		if !changed {
+			return frame, nil
+		}
+		payload, err := encodeJson(doc)
+		if err != nil {
+			return frame, err
+		}
+		frame.Payload = payload
+		frame.Length = uint64(len(frame.Payload))
+
+		return frame, nil
+	}, nil
+}
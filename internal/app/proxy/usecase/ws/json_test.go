@@ -0,0 +1,248 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+func TestParseJsonPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    jsonPath
+		wantErr bool
+	}{
+		{path: "$", want: nil},
+		{path: "", want: nil},
+		{path: "$.type", want: jsonPath{{key: "type"}}},
+		{path: "data.items", wantErr: true},
+		{path: ".data.items", want: jsonPath{{key: "data"}, {key: "items"}}},
+		{path: "$.data.items[0].id", want: jsonPath{{key: "data"}, {key: "items"}, {index: 0, isIndex: true}, {key: "id"}}},
+		{path: `$["a.b"][2]`, want: jsonPath{{key: "a.b"}, {index: 2, isIndex: true}}},
+		{path: " $.a ", want: jsonPath{{key: "a"}}},
+		{path: "$..a", wantErr: true},
+		{path: "$.a.", wantErr: true},
+		{path: "$.a[0", wantErr: true},
+		{path: "$.a[-1]", wantErr: true},
+		{path: "$.a[b]", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseJsonPath(tt.path)
+		if tt.wantErr {
+			if !errors.Is(err, ErrJsonPathFormat) {
+				t.Errorf("parseJsonPath(%q) error = %v, want %v", tt.path, err, ErrJsonPathFormat)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJsonPath(%q) error = %v", tt.path, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseJsonPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseJsonPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestJsonPredicate(t *testing.T) {
+	doc, err := decodeJson([]byte(`{"type":"subscribe","id":1.0,"tags":["a","b"],"meta":{"x":1,"y":2},"empty":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		predicate string
+		want      bool
+	}{
+		{predicate: "", want: true},
+		{predicate: `$.type == "subscribe"`, want: true},
+		{predicate: `$.type == "publish"`, want: false},
+		{predicate: `$.type != "publish"`, want: true},
+		{predicate: `$.missing != "x"`, want: true},
+		{predicate: `$.missing == "x"`, want: false},
+		{predicate: "$.id == 1", want: true},
+		{predicate: `$.id == "1"`, want: false},
+		{predicate: `$.tags == ["a","b"]`, want: true},
+		{predicate: `$.tags[1] == "b"`, want: true},
+		{predicate: `$.meta == {"y":2,"x":1}`, want: true},
+		{predicate: "$.empty == null", want: true},
+		{predicate: "$.meta.x", want: true},
+		{predicate: "$.meta.z", want: false},
+		{predicate: "$.tags[5]", want: false},
+	}
+	for _, tt := range tests {
+		pred, err := parseJsonPredicate(tt.predicate)
+		if err != nil {
+			t.Errorf("parseJsonPredicate(%q) error = %v", tt.predicate, err)
+			continue
+		}
+		if got := pred.match(doc); got != tt.want {
+			t.Errorf("predicate %q match = %v, want %v", tt.predicate, got, tt.want)
+		}
+	}
+
+	for _, predicate := range []string{`$.type == subscribe`, `$.a[ == 1`, `$.a == 1 2`} {
+		if _, err := parseJsonPredicate(predicate); err == nil {
+			t.Errorf("parseJsonPredicate(%q) expected an error", predicate)
+		}
+	}
+}
+
+func TestJsonHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    WebsocketPayloadOverrideConfig
+		payload string
+		want    string
+	}{
+		{
+			name:    "set keeps the key order",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.channel", Operation: domain.JsonSetOperation, Value: `"public"`},
+			payload: `{"type":"subscribe","channel":"private","id":7}`,
+			want:    `{"type":"subscribe","channel":"public","id":7}`,
+		},
+		{
+			name:    "set adds a missing key at the end",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.meta.source", Operation: domain.JsonSetOperation, Value: `"proxy"`},
+			payload: `{"z":1,"a":2}`,
+			want:    `{"z":1,"a":2,"meta":{"source":"proxy"}}`,
+		},
+		{
+			name:    "set a plain string value",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.name", Operation: domain.JsonSetOperation, Value: "<b>bob</b>"},
+			payload: `{"name":"alice"}`,
+			want:    `{"name":"<b>bob</b>"}`,
+		},
+		{
+			name:    "set an array item",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.items[1]", Operation: domain.JsonSetOperation, Value: "0"},
+			payload: `{"items":[1,2,3]}`,
+			want:    `{"items":[1,0,3]}`,
+		},
+		{
+			name:    "delete",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.token", Operation: domain.JsonDeleteOperation},
+			payload: `{"b":1,"token":"secret","a":2}`,
+			want:    `{"b":1,"a":2}`,
+		},
+		{
+			name:    "delete an array item",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.items[0]", Operation: domain.JsonDeleteOperation},
+			payload: `{"items":[1,2,3]}`,
+			want:    `{"items":[2,3]}`,
+		},
+		{
+			name:    "delete a missing key leaves the message",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.token", Operation: domain.JsonDeleteOperation},
+			payload: `{"b": 1, "a": 2}`,
+			want:    `{"b": 1, "a": 2}`,
+		},
+		{
+			name:    "rename in place",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.uid", Operation: domain.JsonRenameOperation, Value: "user_id"},
+			payload: `{"type":"hello","uid":42,"room":"lobby"}`,
+			want:    `{"type":"hello","user_id":42,"room":"lobby"}`,
+		},
+		{
+			name:    "rename over an existing key",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.uid", Operation: domain.JsonRenameOperation, Value: "user_id"},
+			payload: `{"user_id":1,"uid":42}`,
+			want:    `{"user_id":42}`,
+		},
+		{
+			name:    "append",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.tags", Operation: domain.JsonAppendOperation, Value: `"proxied"`},
+			payload: `{"tags":["a"]}`,
+			want:    `{"tags":["a","proxied"]}`,
+		},
+		{
+			name:    "append creates the array",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.tags", Operation: domain.JsonAppendOperation, Value: `"proxied"`},
+			payload: `{}`,
+			want:    `{"tags":["proxied"]}`,
+		},
+		{
+			name:    "append to a value that is not an array",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.tags", Operation: domain.JsonAppendOperation, Value: `"proxied"`},
+			payload: `{"tags":"a"}`,
+			want:    `{"tags":"a"}`,
+		},
+		{
+			name:    "predicate not matching",
+			rule:    WebsocketPayloadOverrideConfig{Match: `$.type == "subscribe"`, Path: "$.channel", Operation: domain.JsonSetOperation, Value: `"public"`},
+			payload: `{"type":"publish","channel":"private"}`,
+			want:    `{"type":"publish","channel":"private"}`,
+		},
+		{
+			name:    "large numbers are kept",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.a", Operation: domain.JsonSetOperation, Value: "1"},
+			payload: `{"id":12345678901234567890,"a":0}`,
+			want:    `{"id":12345678901234567890,"a":1}`,
+		},
+		{
+			name:    "not json",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.a", Operation: domain.JsonSetOperation, Value: "1"},
+			payload: `hello {"a":0}`,
+			want:    `hello {"a":0}`,
+		},
+		{
+			name:    "several json values",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.a", Operation: domain.JsonSetOperation, Value: "1"},
+			payload: `{"a":0}{"a":0}`,
+			want:    `{"a":0}{"a":0}`,
+		},
+		{
+			name:    "truncated json",
+			rule:    WebsocketPayloadOverrideConfig{Path: "$.a", Operation: domain.JsonSetOperation, Value: "1"},
+			payload: `{"a":0`,
+			want:    `{"a":0`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := newJsonHandler(tt.rule)
+			if err != nil {
+				t.Fatalf("newJsonHandler() error = %v", err)
+			}
+			// The value of a rule is never shared between the messages it changed
+			for i := 0; i < 2; i++ {
+				out, err := handler(domain.Frame{Opcode: domain.TextOpcode, Payload: []byte(tt.payload), Length: uint64(len(tt.payload))})
+				if err != nil {
+					t.Fatalf("handler() error = %v", err)
+				}
+				if string(out.Payload) != tt.want {
+					t.Errorf("handler() = %s, want %s", out.Payload, tt.want)
+				}
+				if out.Length != uint64(len(out.Payload)) {
+					t.Errorf("handler() length = %d, want %d", out.Length, len(out.Payload))
+				}
+			}
+		})
+	}
+}
+
+func TestNewJsonHandler_Invalid(t *testing.T) {
+	tests := []WebsocketPayloadOverrideConfig{
+		{Path: "", Operation: domain.JsonSetOperation},
+		{Path: "$.a[", Operation: domain.JsonSetOperation},
+		{Path: "$.a", Operation: domain.JsonRenameOperation},
+		{Path: "$.a[0]", Operation: domain.JsonRenameOperation, Value: "b"},
+		{Path: "$.a"},
+		{Match: "$.a == nope", Path: "$.a", Operation: domain.JsonSetOperation},
+	}
+	for _, rule := range tests {
+		if _, err := newJsonHandler(rule); err == nil {
+			t.Errorf("newJsonHandler(%+v) expected an error", rule)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package ws
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const subprotocolHeader = "Sec-Websocket-Protocol"
+
+// route is one path rule of a server in the route table. A server without path rules
+// has a single route accepting any path.
+type route struct {
+	server ServersConfig
+	path   *MatchPathConfig
+	order  int
+}
+
+// newRouteTable compiles the matchers of every server and sorts the routes by priority,
+// then exact paths, regex paths, the longest prefix and finally the catch-all routes.
+// Routes of the same rank keep the configuration order.
+func newRouteTable(servers []ServersConfig) ([]route, error) {
+	var routes []route
+	for i := range servers {
+		s := &servers[i]
+		if err := s.compile(); err != nil {
+			return nil, err
+		}
+		if len(s.MatchPath) == 0 {
+			routes = append(routes, route{server: *s, order: len(routes)})
+			continue
+		}
+		for j := range s.MatchPath {
+			routes = append(routes, route{server: *s, path: &s.MatchPath[j], order: len(routes)})
+		}
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.server.Priority != b.server.Priority {
+			return a.server.Priority > b.server.Priority
+		}
+		if a.rank() != b.rank() {
+			return a.rank() < b.rank()
+		}
+		if a.rank() == prefixRank {
+			return len(a.path.Value) > len(b.path.Value)
+		}
+
+		return false
+	})
+
+	return routes, nil
+}
+
+const (
+	exactRank = iota
+	regexRank
+	prefixRank
+	anyRank
+)
+
+func (r route) rank() int {
+	if r.path == nil {
+		return anyRank
+	}
+	switch r.path.Type {
+	case domain.ExactMatch:
+		return exactRank
+	case domain.PrefixMatch:
+		return prefixRank
+	}
+
+	return regexRank
+}
+
+// match checks the request against the route. The listener and every matcher category
+// of the server have to accept it, a category without matchers accepts any request.
+// The capture groups of a regex path are returned by index and by name.
+func (r route) match(info domain.WsReqInfo) (map[string]string, bool) {
+	s := r.server
+	if !s.matchListener(info) {
+		return nil, false
+	}
+	// The path matchers never see the query, which the query matchers check
+	requestPath, _, _ := strings.Cut(info.URI, "?")
+	captures, ok := r.matchPath(requestPath)
+	if !ok {
+		return nil, false
+	}
+	if !s.matchHost(info) || !s.matchHeaders(info) || !s.matchQuery(info) || !s.matchSubprotocol(info) {
+		return nil, false
+	}
+
+	return captures, true
+}
+
+func (r route) matchPath(requestPath string) (map[string]string, bool) {
+	if r.path == nil {
+		return nil, true
+	}
+	if r.path.rp == nil {
+		return nil, matchValue(r.path.Type, r.path.Value, nil, requestPath)
+	}
+
+	m := r.path.rp.FindStringSubmatch(requestPath)
+	if m == nil {
+		return nil, false
+	}
+	captures := make(map[string]string, len(m))
+	for i, name := range r.path.rp.SubexpNames() {
+		captures[strconv.Itoa(i)] = m[i]
+		if name != "" {
+			captures[name] = m[i]
+		}
+	}
+
+	return captures, true
+}
+
+// compile validates and compiles the regex matchers of the server
+func (s *ServersConfig) compile() error {
+	for i := range s.MatchPath {
+		rp, err := compileMatcher(s.MatchPath[i].Type, s.MatchPath[i].Value)
+		if err != nil {
+			return fmt.Errorf("path matcher %q: %w", s.MatchPath[i].Value, err)
+		}
+		s.MatchPath[i].rp = rp
+	}
+	for i := range s.MatchHost {
+		rp, err := compileMatcher(s.MatchHost[i].Type, s.MatchHost[i].Value)
+		if err != nil {
+			return fmt.Errorf("host matcher %q: %w", s.MatchHost[i].Value, err)
+		}
+		s.MatchHost[i].rp = rp
+	}
+	for _, matchers := range [][]MatchKeyConfig{s.MatchHeaders, s.MatchQuery} {
+		for i := range matchers {
+			rp, err := compileMatcher(matchers[i].Type, matchers[i].Value)
+			if err != nil {
+				return fmt.Errorf("%s matcher %q: %w", matchers[i].Key, matchers[i].Value, err)
+			}
+			matchers[i].rp = rp
+		}
+	}
+
+	return nil
+}
+
+func compileMatcher(t domain.FindMatch, pattern string) (*regexp.Regexp, error) {
+	switch t {
+	case domain.RegexMatch:
+		return regexp.Compile(pattern)
+	case domain.WildcardMatch:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// matchListener accepts the request only if it came through the listener of the server
+func (s ServersConfig) matchListener(info domain.WsReqInfo) bool {
+	if s.ListenIP == "" && s.ListenPort == 0 {
+		return true
+	}
+
+	return info.Listener == s.ListenIP+":"+strconv.Itoa(s.ListenPort)
+}
+
+// matchHost accepts the request if any of the host rules matches the host without its port.
+// A wildcard host is matched label by label, "*.example.com" accepts "a.example.com" but
+// neither "example.com" nor "a.b.example.com".
+func (s ServersConfig) matchHost(info domain.WsReqInfo) bool {
+	if len(s.MatchHost) == 0 {
+		return true
+	}
+	host := info.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, mh := range s.MatchHost {
+		pattern := strings.ToLower(mh.Value)
+		if mh.Type == domain.WildcardMatch {
+			if matchHostLabels(pattern, host) {
+				return true
+			}
+			continue
+		}
+		if matchValue(mh.Type, pattern, mh.rp, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchHostLabels(pattern string, host string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if ok, _ := path.Match(patternLabels[i], hostLabels[i]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchHeaders accepts the request if every header rule matches one of the header values
+func (s ServersConfig) matchHeaders(info domain.WsReqInfo) bool {
+	for _, mh := range s.MatchHeaders {
+		if !matchAny(mh, info.Header.Values(mh.Key)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchQuery accepts the request if every query rule matches one of the parameter values
+func (s ServersConfig) matchQuery(info domain.WsReqInfo) bool {
+	if len(s.MatchQuery) == 0 {
+		return true
+	}
+	u, err := url.ParseRequestURI(info.URI)
+	if err != nil {
+		return false
+	}
+	query := u.Query()
+
+	for _, mq := range s.MatchQuery {
+		if !matchAny(mq, query[mq.Key]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchSubprotocol accepts the request if the client offers one of the subprotocols
+func (s ServersConfig) matchSubprotocol(info domain.WsReqInfo) bool {
+	if len(s.MatchSubprotocol) == 0 {
+		return true
+	}
+	for _, v := range info.Header.Values(subprotocolHeader) {
+		for _, offer := range strings.Split(v, ",") {
+			offer = strings.TrimSpace(offer)
+			for _, protocol := range s.MatchSubprotocol {
+				if offer == protocol {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func matchAny(m MatchKeyConfig, values []string) bool {
+	for _, v := range values {
+		if matchValue(m.Type, m.Value, m.rp, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchValue(t domain.FindMatch, pattern string, rp *regexp.Regexp, value string) bool {
+	switch t {
+	case domain.ExactMatch:
+		return value == pattern
+	case domain.PrefixMatch:
+		return strings.HasPrefix(value, pattern)
+	case domain.RegexMatch:
+		return rp.MatchString(value)
+	case domain.WildcardMatch:
+		ok, _ := path.Match(pattern, value)
+		return ok
+	}
+
+	return false
+}
@@ -0,0 +1,182 @@
+//go:build unit
+
+package ws
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+func matchServer(t *testing.T, s ServersConfig, info domain.WsReqInfo) bool {
+	t.Helper()
+	if err := s.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	if info.Header == nil {
+		info.Header = http.Header{}
+	}
+	if info.URI == "" {
+		info.URI = "/"
+	}
+	_, ok := route{server: s}.match(info)
+
+	return ok
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []MatchHostConfig
+		host  string
+		want  bool
+	}{
+		{name: "no host rule", host: "any.example.com", want: true},
+		{name: "exact", hosts: []MatchHostConfig{{Type: domain.ExactMatch, Value: "chat.example.com"}}, host: "chat.example.com", want: true},
+		{name: "exact without the port", hosts: []MatchHostConfig{{Type: domain.ExactMatch, Value: "chat.example.com"}}, host: "chat.example.com:8443", want: true},
+		{name: "exact is case insensitive", hosts: []MatchHostConfig{{Type: domain.ExactMatch, Value: "Chat.Example.com"}}, host: "CHAT.example.COM", want: true},
+		{name: "exact mismatch", hosts: []MatchHostConfig{{Type: domain.ExactMatch, Value: "chat.example.com"}}, host: "api.example.com"},
+		{name: "ipv6 with port", hosts: []MatchHostConfig{{Type: domain.ExactMatch, Value: "::1"}}, host: "[::1]:8080", want: true},
+		{name: "wildcard one label", hosts: []MatchHostConfig{{Type: domain.WildcardMatch, Value: "*.example.com"}}, host: "a.example.com", want: true},
+		{name: "wildcard does not span labels", hosts: []MatchHostConfig{{Type: domain.WildcardMatch, Value: "*.example.com"}}, host: "a.b.example.com"},
+		{name: "wildcard needs a label", hosts: []MatchHostConfig{{Type: domain.WildcardMatch, Value: "*.example.com"}}, host: "example.com"},
+		{name: "wildcard in a label", hosts: []MatchHostConfig{{Type: domain.WildcardMatch, Value: "ws-*.example.com"}}, host: "ws-eu.example.com:443", want: true},
+		{name: "wildcard of a middle label", hosts: []MatchHostConfig{{Type: domain.WildcardMatch, Value: "chat.*.example.com"}}, host: "chat.eu.example.com", want: true},
+		{name: "regex", hosts: []MatchHostConfig{{Type: domain.RegexMatch, Value: `^[a-z]+\.example\.com$`}}, host: "chat.example.com", want: true},
+		{
+			name:  "any of the rules",
+			hosts: []MatchHostConfig{{Type: domain.ExactMatch, Value: "a.test"}, {Type: domain.WildcardMatch, Value: "*.example.com"}},
+			host:  "b.example.com",
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchServer(t, ServersConfig{MatchHost: tt.hosts}, domain.WsReqInfo{Host: tt.host}); got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []MatchKeyConfig
+		header  http.Header
+		want    bool
+	}{
+		{name: "no header rule", header: http.Header{}, want: true},
+		{name: "exact", headers: []MatchKeyConfig{{Key: "X-Tenant", Type: domain.ExactMatch, Value: "acme"}}, header: http.Header{"X-Tenant": {"acme"}}, want: true},
+		{name: "missing header", headers: []MatchKeyConfig{{Key: "X-Tenant", Type: domain.ExactMatch, Value: "acme"}}, header: http.Header{}},
+		{name: "any of the values", headers: []MatchKeyConfig{{Key: "X-Tenant", Type: domain.ExactMatch, Value: "acme"}}, header: http.Header{"X-Tenant": {"other", "acme"}}, want: true},
+		{name: "prefix", headers: []MatchKeyConfig{{Key: "User-Agent", Type: domain.PrefixMatch, Value: "bot/"}}, header: http.Header{"User-Agent": {"bot/1.0"}}, want: true},
+		{name: "regex", headers: []MatchKeyConfig{{Key: "X-Version", Type: domain.RegexMatch, Value: `^2\.`}}, header: http.Header{"X-Version": {"1.9"}}},
+		{name: "wildcard", headers: []MatchKeyConfig{{Key: "X-Region", Type: domain.WildcardMatch, Value: "eu-*"}}, header: http.Header{"X-Region": {"eu-west"}}, want: true},
+		{
+			name: "every rule",
+			headers: []MatchKeyConfig{
+				{Key: "X-Tenant", Type: domain.ExactMatch, Value: "acme"},
+				{Key: "X-Region", Type: domain.ExactMatch, Value: "eu"},
+			},
+			header: http.Header{"X-Tenant": {"acme"}, "X-Region": {"us"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchServer(t, ServersConfig{MatchHeaders: tt.headers}, domain.WsReqInfo{Header: tt.header}); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query []MatchKeyConfig
+		uri   string
+		want  bool
+	}{
+		{name: "no query rule", uri: "/chat?room=1", want: true},
+		{name: "exact", query: []MatchKeyConfig{{Key: "room", Type: domain.ExactMatch, Value: "1"}}, uri: "/chat?room=1", want: true},
+		{name: "missing parameter", query: []MatchKeyConfig{{Key: "room", Type: domain.ExactMatch, Value: "1"}}, uri: "/chat"},
+		{name: "any of the values", query: []MatchKeyConfig{{Key: "room", Type: domain.ExactMatch, Value: "2"}}, uri: "/chat?room=1&room=2", want: true},
+		{name: "escaped value", query: []MatchKeyConfig{{Key: "name", Type: domain.ExactMatch, Value: "a b"}}, uri: "/chat?name=a%20b", want: true},
+		{name: "regex", query: []MatchKeyConfig{{Key: "v", Type: domain.RegexMatch, Value: `^[0-9]+$`}}, uri: "/chat?v=abc"},
+		{
+			name:  "every rule",
+			query: []MatchKeyConfig{{Key: "room", Type: domain.ExactMatch, Value: "1"}, {Key: "v", Type: domain.ExactMatch, Value: "2"}},
+			uri:   "/chat?room=1&v=2",
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchServer(t, ServersConfig{MatchQuery: tt.query}, domain.WsReqInfo{URI: tt.uri}); got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchSubprotocol(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		offers    []string
+		want      bool
+	}{
+		{name: "no subprotocol rule", offers: []string{"chat"}, want: true},
+		{name: "offered", protocols: []string{"graphql-ws"}, offers: []string{"graphql-ws"}, want: true},
+		{name: "one of a list", protocols: []string{"graphql-ws"}, offers: []string{"chat, graphql-ws"}, want: true},
+		{name: "in a second header", protocols: []string{"graphql-ws"}, offers: []string{"chat", "graphql-ws"}, want: true},
+		{name: "any of the rules", protocols: []string{"mqtt", "chat"}, offers: []string{"chat"}, want: true},
+		{name: "not offered", protocols: []string{"graphql-ws"}, offers: []string{"chat"}},
+		{name: "nothing offered", protocols: []string{"graphql-ws"}},
+		{name: "exact name", protocols: []string{"graphql-ws"}, offers: []string{"graphql-ws-v2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, offer := range tt.offers {
+				header.Add(subprotocolHeader, offer)
+			}
+			if got := matchServer(t, ServersConfig{MatchSubprotocol: tt.protocols}, domain.WsReqInfo{Header: header}); got != tt.want {
+				t.Errorf("match(%v) = %v, want %v", tt.offers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch_AllCategories(t *testing.T) {
+	s := ServersConfig{
+		MatchHost:        []MatchHostConfig{{Type: domain.WildcardMatch, Value: "*.example.com"}},
+		MatchHeaders:     []MatchKeyConfig{{Key: "X-Tenant", Type: domain.ExactMatch, Value: "acme"}},
+		MatchQuery:       []MatchKeyConfig{{Key: "room", Type: domain.ExactMatch, Value: "1"}},
+		MatchSubprotocol: []string{"chat"},
+	}
+	info := func(host string) domain.WsReqInfo {
+		return domain.WsReqInfo{
+			Host:   host,
+			URI:    "/ws?room=1",
+			Header: http.Header{"X-Tenant": {"acme"}, "Sec-Websocket-Protocol": {"chat"}},
+		}
+	}
+	if !matchServer(t, s, info("a.example.com")) {
+		t.Error("match() = false, want every category accepted")
+	}
+	if matchServer(t, s, info("example.org")) {
+		t.Error("match() = true, want the request rejected by its host")
+	}
+
+	invalid := ServersConfig{MatchHost: []MatchHostConfig{{Type: domain.RegexMatch, Value: "("}}}
+	if err := invalid.compile(); err == nil {
+		t.Error("compile() expected an error for an invalid host regex")
+	}
+	invalid = ServersConfig{MatchHeaders: []MatchKeyConfig{{Key: "X", Type: domain.WildcardMatch, Value: "["}}}
+	if err := invalid.compile(); err == nil {
+		t.Error("compile() expected an error for an invalid header wildcard")
+	}
+}
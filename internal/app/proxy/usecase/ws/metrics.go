@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// Reasons of the rejected connections
+const (
+	noRouteReason           = "no_route"
+	noUpstreamReason        = "no_upstream"
+	upstreamHandshakeReason = "upstream_handshake"
+	upstreamStatusReason    = "upstream_status"
+)
+
+// noopMetrics is used when no metrics adapter is given
+type noopMetrics struct{}
+
+func (noopMetrics) ConnectionAccepted(string)         {}
+func (noopMetrics) ConnectionRejected(string, string) {}
+func (noopMetrics) ModifierHit(string, string)        {}
+func (noopMetrics) ModifierError(string, string)      {}
+func (noopMetrics) ModifierShadowHit(string, string)  {}
+
+var _ adapter.MetricsAdapter = noopMetrics{}
+
+// nameRules fills the names left empty with the index of the server and of the rule.
+// The names identify the routes and rules in the metrics and the admin api, so they
+// must be unique.
+func nameRules(servers []ServersConfig) error {
+	routes := make(map[string]bool)
+	for i := range servers {
+		if servers[i].Name == "" {
+			servers[i].Name = "server-" + strconv.Itoa(i)
+		}
+		if routes[servers[i].Name] {
+			return fmt.Errorf("route name %q is duplicated", servers[i].Name)
+		}
+		routes[servers[i].Name] = true
+
+		rules := servers[i].Upstream.Override.WebsocketPayload
+		names := make(map[string]bool)
+		for j := range rules {
+			if rules[j].Name == "" {
+				rules[j].Name = "rule-" + strconv.Itoa(j)
+			}
+			if names[rules[j].Name] {
+				return fmt.Errorf("rule name %q of route %q is duplicated", rules[j].Name, servers[i].Name)
+			}
+			names[rules[j].Name] = true
+		}
+	}
+
+	return nil
+}
+
+// countModifiers wraps the handler of every rule to count the frames it modified and
+// the errors it returned. The events are in the order of the rules they come from.
+// The rules in shadow mode are counted by shadowModifiers.
+func countModifiers(metrics adapter.MetricsAdapter, route string, rules []WebsocketPayloadOverrideConfig, events []domain.ModifierEvent) {
+	for i := range events {
+		if rules[i].Mode == domain.ShadowMode {
+			continue
+		}
+		handler, rule := events[i].Handler, rules[i].Name
+		events[i].Handler = func(frame domain.Frame) (domain.Frame, error) {
+			out, err := handler(frame)
+			if err != nil {
+				metrics.ModifierError(route, rule)
+				return out, err
+			}
+			if !bytes.Equal(out.Payload, frame.Payload) {
+				metrics.ModifierHit(route, rule)
+			}
+
+			return out, nil
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ws
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func (p *PathOverrideConfig) compile() error {
+	if p.Regex == "" {
+		return nil
+	}
+	rp, err := regexp.Compile(p.Regex)
+	if err != nil {
+		return err
+	}
+	p.rp = rp
+
+	return nil
+}
+
+// rewrite builds the upstream uri from the request uri: the prefix is stripped, the path
+// replaced and the prefix added, then the query parameters are removed, renamed and added
+func (p PathOverrideConfig) rewrite(uri string, captures map[string]string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return uri
+	}
+	path := u.EscapedPath()
+
+	// The prefix is only stripped on a segment boundary, /api never strips /apiv2
+	if prefix := strings.TrimSuffix(p.StripPrefix, "/"); prefix != "" && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+		path = path[len(prefix):]
+	}
+	if p.rp != nil {
+		path = p.rp.ReplaceAllString(path, p.replaceTemplate(captures))
+	} else if p.Replace != "" {
+		path = expandTemplate(p.Replace, captures)
+	}
+	if p.AddPrefix != "" {
+		path = strings.TrimSuffix(p.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	rawQuery := u.RawQuery
+	if len(p.Query.Remove) > 0 || len(p.Query.Rename) > 0 || len(p.Query.Add) > 0 {
+		query := u.Query()
+		for _, key := range p.Query.Remove {
+			query.Del(key)
+		}
+		for _, r := range p.Query.Rename {
+			if values, ok := query[r.From]; ok {
+				query.Del(r.From)
+				query[r.To] = append(query[r.To], values...)
+			}
+		}
+		for _, a := range p.Query.Add {
+			query.Add(a.Key, expandTemplate(a.Value, captures))
+		}
+		rawQuery = query.Encode()
+	}
+
+	if rawQuery == "" {
+		return path
+	}
+
+	return path + "?" + rawQuery
+}
+
+// replaceTemplate expands the capture groups of the match rule in the replacement of the
+// regex, the groups of the regex keep their names and numbers and are left to the regex
+func (p PathOverrideConfig) replaceTemplate(captures map[string]string) string {
+	vars := make(map[string]string, len(captures))
+	for name, v := range captures {
+		vars[name] = strings.ReplaceAll(v, "$", "$$")
+	}
+	for i, name := range p.rp.SubexpNames() {
+		delete(vars, strconv.Itoa(i))
+		delete(vars, name)
+	}
+
+	return expandTemplate(p.Replace, vars)
+}
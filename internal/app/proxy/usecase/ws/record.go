@@ -0,0 +1,36 @@
+package ws
+
+import (
+	"fmt"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+)
+
+func (r *RecordConfig) validate() error {
+	if r.File == "" {
+		return nil
+	}
+	if r.Sample < 0 || r.Sample > 1 {
+		return fmt.Errorf("record sample %v of %q is not between 0 and 1", r.Sample, r.File)
+	}
+	if r.MaxSize < 0 || r.MaxBackups < 0 || r.MaxPayload < 0 {
+		return fmt.Errorf("record limits of %q must not be negative", r.File)
+	}
+
+	return nil
+}
+
+// option returns the recording of the route for the adapter, nil if it is disabled
+func (r RecordConfig) option() *adapter.RecordOption {
+	if r.File == "" {
+		return nil
+	}
+
+	return &adapter.RecordOption{
+		File:       r.File,
+		Sample:     r.Sample,
+		MaxSize:    r.MaxSize,
+		MaxBackups: r.MaxBackups,
+		MaxPayload: r.MaxPayload,
+	}
+}
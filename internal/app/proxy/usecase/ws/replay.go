@@ -0,0 +1,275 @@
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const defaultReplayPath = "/"
+
+var (
+	ErrReplayEmpty     = errors.New("no message to replay")
+	ErrReplayTruncated = errors.New("the client messages are truncated in the recording and cannot be replayed")
+)
+
+var _ domain.WsProxyReplayUsecase = (*ws)(nil)
+
+// Replay sends the client messages of a recorded session to the upstream of its route,
+// with the recorded handshake request and through the payload rules of the route, and
+// compares both the messages forwarded to the upstream and the upstream replies forwarded
+// to the client with the recorded ones
+func (w *ws) Replay(messages []domain.RecordedMessage, opt domain.ReplayOption) (domain.ReplayReport, error) {
+	if len(messages) == 0 {
+		return domain.ReplayReport{}, ErrReplayEmpty
+	}
+	report := domain.ReplayReport{Session: messages[0].Session, Route: messages[0].Route}
+	var sent, expected []domain.RecordedMessage
+	for _, m := range messages {
+		if m.Opcode != domain.TextOpcode && m.Opcode != domain.BinaryOpcode {
+			continue
+		}
+		if m.Direction == domain.ServerDirection {
+			expected = append(expected, m)
+			continue
+		}
+		if m.Truncated {
+			return report, ErrReplayTruncated
+		}
+		sent = append(sent, m)
+	}
+
+	info := domain.WsReqInfo{URI: defaultReplayPath, Header: http.Header{}}
+	for _, m := range messages {
+		if m.Request != nil {
+			info = domain.WsReqInfo{
+				RemoteAddr: m.Request.RemoteAddr,
+				Host:       m.Request.Host,
+				Header:     m.Request.Header.Clone(),
+				URI:        m.Request.URI,
+			}
+			if info.Header == nil {
+				info.Header = http.Header{}
+			}
+			break
+		}
+	}
+	if opt.Path != "" {
+		info.URI = opt.Path
+	}
+
+	server, captures, ok := w.findRoute(report.Route, info)
+	if !ok {
+		return report, fmt.Errorf("route %q of session %s not found", report.Route, report.Session)
+	}
+	upstream := server.Upstream
+	addr := opt.Upstream
+	if addr == "" {
+		t, err := upstream.balancer.pick(info)
+		if err != nil {
+			return report, err
+		}
+		addr = upstream.Scheme + "://" + t.addr + upstream.Override.Path.rewrite(info.URI, captures)
+	}
+	// The upstream handshake headers are built as the proxy does from the client ones
+	header := info.Header.Clone()
+	server.Forwarded.apply(header, info)
+	upstream.Override.applyHeaders(header, templateVars(info, captures))
+	// The modifier hits of the replay are not counted with the ones of the proxied sessions
+	events := append([]domain.ModifierEvent(nil), upstream.payloadRules...)
+	shadowModifiers(w.log, w.metrics, server.Name, upstream.Override.WebsocketPayload, events)
+	toggleModifiers(upstream.Override.WebsocketPayload, events)
+
+	client, err := w.ws.Dial(
+		addr,
+		upstreamHost(info, upstream),
+		adapter.WsOption{
+			TLS:            upstream.tlsConfig,
+			MaxMessageSize: upstream.Message.MaxSize,
+			Deflate:        upstream.Message.Deflate,
+			ProxyProtocol:  upstream.ProxyProtocol,
+		},
+		header,
+	)
+	if err != nil {
+		return report, err
+	}
+
+	r := &replayReceiver{client: client, events: events, want: len(expected), received: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run()
+	}()
+
+	start, first := time.Now(), messages[0].Time
+	for i, m := range sent {
+		if opt.Speed > 0 {
+			delay := time.Duration(float64(m.Time.Sub(first)) / opt.Speed)
+			time.Sleep(time.Until(start.Add(delay)))
+		}
+		payload, err := applyModifiers(events, domain.ClientDirection, m.Opcode, m.Payload)
+		if err != nil {
+			_ = client.Close()
+			return report, err
+		}
+		if !bytes.Equal(payload, m.Forwarded) {
+			report.Diffs = append(report.Diffs, domain.ReplayDiff{
+				Direction: domain.ClientDirection,
+				Index:     i,
+				Expected:  m.Forwarded,
+				Actual:    payload,
+			})
+		}
+		if err = client.Send(m.Opcode, payload); err != nil {
+			_ = client.Close()
+			return report, err
+		}
+		report.Sent++
+	}
+
+	r.wait(opt.Wait)
+	_ = client.Close()
+	<-done
+
+	replies := r.result()
+	report.Received = len(replies)
+	for i := 0; i < len(expected) || i < len(replies); i++ {
+		switch {
+		case i >= len(replies):
+			report.Diffs = append(report.Diffs, domain.ReplayDiff{
+				Direction: domain.ServerDirection,
+				Index:     i,
+				Expected:  expected[i].Forwarded,
+				Missing:   true,
+			})
+		case i >= len(expected):
+			report.Diffs = append(report.Diffs, domain.ReplayDiff{
+				Direction: domain.ServerDirection,
+				Index:     i,
+				Actual:    replies[i],
+				Extra:     true,
+			})
+		case !replayMatch(expected[i], replies[i]):
+			report.Diffs = append(report.Diffs, domain.ReplayDiff{
+				Direction: domain.ServerDirection,
+				Index:     i,
+				Expected:  expected[i].Forwarded,
+				Actual:    replies[i],
+			})
+		}
+	}
+
+	return report, r.err
+}
+
+// findRoute returns the server with the name in the current config and the capture groups
+// of its path if the route matches the request
+func (w *ws) findRoute(name string, info domain.WsReqInfo) (ServersConfig, map[string]string, bool) {
+	var server ServersConfig
+	found := false
+	for _, r := range w.snapshot.Load().routes {
+		if r.server.Name != name {
+			continue
+		}
+		if captures, ok := r.match(info); ok {
+			return r.server, captures, true
+		}
+		server, found = r.server, true
+	}
+
+	return server, nil, found
+}
+
+// replayMatch compares a reply with the recorded one, only on the recorded start if the
+// recording truncated it
+func replayMatch(expected domain.RecordedMessage, actual []byte) bool {
+	if expected.Truncated && len(actual) > len(expected.Forwarded) {
+		actual = actual[:len(expected.Forwarded)]
+	}
+
+	return bytes.Equal(expected.Forwarded, actual)
+}
+
+// applyModifiers runs the payload rules of the direction on a message, as the proxy does
+func applyModifiers(events []domain.ModifierEvent, direction domain.Direction, opcode domain.OpcodeType, payload []byte) ([]byte, error) {
+	frame := domain.Frame{Opcode: opcode, Payload: payload, Length: uint64(len(payload))}
+	for _, event := range events {
+		if event.On != opcode || !event.Direction.Has(direction) {
+			continue
+		}
+		var err error
+		if frame, err = event.Handler(frame); err != nil {
+			return nil, err
+		}
+	}
+
+	return frame.Payload, nil
+}
+
+// replayReceiver collects the upstream replies, modified as they would be for the client
+type replayReceiver struct {
+	client   adapter.WsClient
+	events   []domain.ModifierEvent
+	want     int
+	received chan struct{}
+
+	mu      sync.Mutex
+	replies [][]byte
+	err     error
+}
+
+func (r *replayReceiver) run() {
+	for {
+		opcode, payload, err := r.client.Receive()
+		if err != nil {
+			return
+		}
+		payload, err = applyModifiers(r.events, domain.ServerDirection, opcode, payload)
+
+		r.mu.Lock()
+		if err != nil && r.err == nil {
+			r.err = err
+		}
+		r.replies = append(r.replies, payload)
+		r.mu.Unlock()
+
+		select {
+		case r.received <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait returns once all the recorded replies are received or after the timeout
+func (r *replayReceiver) wait(timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		n := len(r.replies)
+		r.mu.Unlock()
+		if n >= r.want {
+			return
+		}
+
+		select {
+		case <-r.received:
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+func (r *replayReceiver) result() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.replies
+}
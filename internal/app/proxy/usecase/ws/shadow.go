@@ -0,0 +1,81 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// maxShadowDiff bounds each side of the diff logged for a shadow rule
+const maxShadowDiff = 128
+
+// shadowModifiers wraps the handler of every rule in shadow mode to log and count the
+// change it would have made, and to pass the message on unmodified. An error of the rule
+// is logged and counted instead of closing the session.
+func shadowModifiers(log logrus.FieldLogger, metrics adapter.MetricsAdapter, route string, rules []WebsocketPayloadOverrideConfig, events []domain.ModifierEvent) {
+	for i := range events {
+		if rules[i].Mode != domain.ShadowMode {
+			continue
+		}
+		handler, rule := events[i].Handler, rules[i].Name
+		events[i].Handler = func(frame domain.Frame) (domain.Frame, error) {
+			fields := logrus.Fields{"route": route, "rule": rule, "opcode": opcodeName(frame.Opcode)}
+			// The handler gets its own copy, so it cannot change the payload forwarded
+			in := frame
+			in.Payload = bytes.Clone(frame.Payload)
+			out, err := handler(in)
+			if err != nil {
+				metrics.ModifierError(route, rule)
+				log.WithFields(fields).WithError(err).Warn("Shadow rule failed")
+				return frame, nil
+			}
+			if !bytes.Equal(out.Payload, frame.Payload) {
+				metrics.ModifierShadowHit(route, rule)
+				fields["diff"] = payloadDiff(frame.Payload, out.Payload)
+				log.WithFields(fields).Info("Shadow rule would modify the message")
+			}
+
+			return frame, nil
+		}
+	}
+}
+
+// payloadDiff describes a change as the span replaced between the common prefix and suffix
+// of the payloads, "@12 -\"foo\" +\"bar\"" for foo replaced by bar at the byte 12
+func payloadDiff(before []byte, after []byte) string {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+		before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+
+	return fmt.Sprintf("@%d -%s +%s",
+		prefix,
+		quoteDiff(before[prefix:len(before)-suffix]),
+		quoteDiff(after[prefix:len(after)-suffix]),
+	)
+}
+
+func quoteDiff(span []byte) string {
+	if len(span) > maxShadowDiff {
+		return fmt.Sprintf("%q...(%d bytes)", span[:maxShadowDiff], len(span))
+	}
+
+	return fmt.Sprintf("%q", span)
+}
+
+func opcodeName(opcode domain.OpcodeType) string {
+	if opcode == domain.BinaryOpcode {
+		return "binary"
+	}
+
+	return "text"
+}
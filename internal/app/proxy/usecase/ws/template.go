@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"os"
+	"strings"
+)
+
+const envTemplatePrefix = "env."
+
+// expandTemplate replaces every ${name} of the value with the variable of the same name,
+// ${env.NAME} with the environment variable. Unknown variables are kept as they are.
+func expandTemplate(value string, vars map[string]string) string {
+	if !strings.Contains(value, "${") {
+		return value
+	}
+
+	var sb strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		sb.WriteString(value[:start])
+		if v, ok := lookupTemplate(value[start+2:end], vars); ok {
+			sb.WriteString(v)
+		} else {
+			sb.WriteString(value[start : end+1])
+		}
+		value = value[end+1:]
+	}
+	sb.WriteString(value)
+
+	return sb.String()
+}
+
+func lookupTemplate(name string, vars map[string]string) (string, bool) {
+	if v, ok := vars[name]; ok {
+		return v, true
+	}
+	if strings.HasPrefix(name, envTemplatePrefix) {
+		return os.LookupEnv(strings.TrimPrefix(name, envTemplatePrefix))
+	}
+
+	return "", false
+}
@@ -2,97 +2,247 @@ package ws
 
 import (
 	"errors"
-	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
-	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+	"fmt"
 	"net/http"
 	"regexp"
-	"strconv"
-	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
 )
 
 type ws struct {
-	ws  adapter.WsAdapter
-	opt Config
+	ws       adapter.WsAdapter
+	metrics  adapter.MetricsAdapter
+	log      logrus.FieldLogger
+	snapshot atomic.Pointer[snapshot]
+}
+
+// snapshot is the compiled config new connections are routed with. A reload swaps it as
+// a whole, the established connections keep running on the one they started with.
+type snapshot struct {
+	opt            Config
+	routes         []route
+	healthCheckers []*healthChecker
 }
 
 var _ domain.WsProxyTableUsecase = (*ws)(nil)
 
-func NewWs(wsInfra adapter.WsAdapter, config ...Config) (*ws, error) {
+func NewWs(wsInfra adapter.WsAdapter, metrics adapter.MetricsAdapter, log *logrus.Logger, config ...Config) (*ws, error) {
 	var opt Config
 	for _, cfg := range config {
 		opt = cfg
 	}
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+
+	w := &ws{ws: wsInfra, metrics: metrics, log: log}
+	s, err := w.newSnapshot(opt)
+	if err != nil {
+		return nil, err
+	}
+	s.run()
+	w.snapshot.Store(s)
 
-	return &ws{ws: wsInfra, opt: opt}, nil
+	return w, nil
 }
 
-func (w *ws) Connect(info domain.WsReqInfo) (domain.WsProxyUsecase, error) {
-	var remHost string
-	remOriginHed, ok := info.Header["origin"]
-	if ok && len(remOriginHed) > 0 {
-		remHost = remOriginHed[0]
-	} else {
-		remHost = info.Host
+// Reload validates and compiles the config, then swaps it with the current one
+func (w *ws) Reload(config Config) error {
+	s, err := w.newSnapshot(config)
+	if err != nil {
+		return err
 	}
+	s.run()
+	w.snapshot.Swap(s).shutdown()
+
+	return nil
+}
+
+// Shutdown stops the health checkers of the upstreams
+func (w *ws) Shutdown() error {
+	w.snapshot.Load().shutdown()
+
+	return nil
+}
 
-	err, upstream, isFind := w.findUpstreamByPath(info.URI)
+func (w *ws) newSnapshot(opt Config) (*snapshot, error) {
+	if err := nameRules(opt.Servers); err != nil {
+		return nil, err
+	}
+	w.initRuleStates(opt.Servers)
+	for i := range opt.Servers {
+		if err := opt.Servers[i].Forwarded.compile(); err != nil {
+			return nil, err
+		}
+		if err := opt.Servers[i].Record.validate(); err != nil {
+			return nil, err
+		}
+		upstream := &opt.Servers[i].Upstream
+		if upstream.Scheme == "" {
+			upstream.Scheme = "ws"
+		}
+		if upstream.Scheme != "ws" && upstream.Scheme != "wss" {
+			return nil, fmt.Errorf("upstream scheme %q is not supported", upstream.Scheme)
+		}
+		if upstream.ProxyProtocol < 0 || upstream.ProxyProtocol > 2 {
+			return nil, fmt.Errorf("PROXY protocol version %d is not supported", upstream.ProxyProtocol)
+		}
+		if upstream.Scheme == "wss" {
+			tlsConfig, err := newTLSConfig(upstream.Tls)
+			if err != nil {
+				return nil, err
+			}
+			upstream.tlsConfig = tlsConfig
+		}
+		if err := upstream.Override.Path.compile(); err != nil {
+			return nil, err
+		}
+		if err := upstream.Override.validateResponseHeaders(); err != nil {
+			return nil, err
+		}
+		payloadRules, err := initOverridePayload(upstream.Override.WebsocketPayload)
+		if err != nil {
+			return nil, err
+		}
+		upstream.payloadRules = payloadRules
+		upstream.modifiers = append([]domain.ModifierEvent(nil), payloadRules...)
+		rules := upstream.Override.WebsocketPayload
+		countModifiers(w.metrics, opt.Servers[i].Name, rules, upstream.modifiers)
+		shadowModifiers(w.log, w.metrics, opt.Servers[i].Name, rules, upstream.modifiers)
+		toggleModifiers(rules, upstream.modifiers)
+		b, err := newBalancer(*upstream)
+		if err != nil {
+			return nil, err
+		}
+		upstream.balancer = b
+	}
+
+	routes, err := newRouteTable(opt.Servers)
 	if err != nil {
 		return nil, err
 	}
+
+	s := &snapshot{opt: opt, routes: routes}
+	for _, server := range opt.Servers {
+		if server.Upstream.HealthCheck.Type == 0 || opt.NoHealthCheck {
+			continue
+		}
+		hc, err := newHealthChecker(w.ws, w.log, server.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		s.healthCheckers = append(s.healthCheckers, hc)
+	}
+	w.carryTargetStates(opt.Servers)
+
+	return s, nil
+}
+
+func (s *snapshot) run() {
+	for _, hc := range s.healthCheckers {
+		hc.run()
+	}
+}
+
+func (s *snapshot) shutdown() {
+	for _, hc := range s.healthCheckers {
+		hc.shutdown()
+	}
+}
+
+func (w *ws) Connect(info domain.WsReqInfo) (domain.WsProxyUsecase, error) {
+	server, captures, isFind := w.findServer(info)
 	if !isFind {
+		w.metrics.ConnectionRejected("", noRouteReason)
 		return nil, errors.New("upstream not found")
 	}
+	upstream := server.Upstream
 
-	upstreamAddr := "ws://" + upstream.Ip + ":" + strconv.Itoa(upstream.Port) + info.URI
-	if upstream.Override.Host != "" {
-		remHost = upstream.Override.Host
-	}
-	overridePayload, err := initOverridePayload(upstream.Override.WebsocketPayload)
+	t, err := upstream.balancer.pick(info)
 	if err != nil {
+		w.metrics.ConnectionRejected(server.Name, noUpstreamReason)
 		return nil, err
 	}
+	upstreamAddr := upstream.Scheme + "://" + t.addr + upstream.Override.Path.rewrite(info.URI, captures)
+	remHost := upstreamHost(info, upstream)
+	vars := templateVars(info, captures)
 	wsp, err := w.ws.New(
 		upstreamAddr,
 		remHost,
+		adapter.WsOption{
+			Route:          server.Name,
+			TLS:            upstream.tlsConfig,
+			MaxMessageSize: upstream.Message.MaxSize,
+			Refragment:     upstream.Message.Refragment,
+			Deflate:        upstream.Message.Deflate,
+			ProxyProtocol:  upstream.ProxyProtocol,
+			Record:         server.Record.option(),
+			HandshakeResult: func(err error) {
+				switch {
+				case errors.Is(err, domain.ErrUpstreamRefused):
+					// The upstream answered, it is alive even if it rejected the connection
+					t.report(nil, upstream.HealthCheck, w.log)
+					w.metrics.ConnectionRejected(server.Name, upstreamStatusReason)
+				case err != nil:
+					t.report(err, upstream.HealthCheck, w.log)
+					w.metrics.ConnectionRejected(server.Name, upstreamHandshakeReason)
+				default:
+					t.report(nil, upstream.HealthCheck, w.log)
+					w.metrics.ConnectionAccepted(server.Name)
+				}
+			},
+		},
 		func(r *http.Request) error {
-			for _, oh := range upstream.Override.Header {
-				r.Header.Set(oh.Key, oh.Value)
-			}
+			server.Forwarded.apply(r.Header, info)
+			upstream.Override.applyHeaders(r.Header, vars)
+			return nil
+		},
+		func(resp *http.Response) error {
+			upstream.Override.applyResponseHeaders(resp.Header, vars)
 			return nil
 		},
-		overridePayload...,
+		upstream.modifiers...,
 	)
+	if err != nil {
+		return nil, err
+	}
 
-	return wsp, err
+	return &trackedProxy{WsProxyUsecase: wsp, target: t}, nil
 }
 
-func (w *ws) findUpstreamByPath(url string) (error, UpstreamConfig, bool) {
-	for _, s := range w.opt.Servers {
-		for _, mp := range s.MatchPath {
-			if mp.Type == domain.ExactMatch && mp.Value == url {
-				return nil, s.Upstream, true
-			}
-			if mp.Type == domain.PrefixMatch && strings.HasPrefix(url, mp.Value) {
-				return nil, s.Upstream, true
-			}
-			if mp.Type == domain.RegexMatch {
-				match, err := regexp.MatchString(mp.Value, url)
-				if err != nil {
-					return err, UpstreamConfig{}, false
-				}
+// upstreamHost is the host of the upstream handshake request
+func upstreamHost(info domain.WsReqInfo, upstream UpstreamConfig) string {
+	if upstream.Override.Host != "" {
+		return upstream.Override.Host
+	}
+	if origin, ok := info.Header["origin"]; ok && len(origin) > 0 {
+		return origin[0]
+	}
 
-				return nil, s.Upstream, match
-			}
+	return info.Host
+}
+
+// findServer returns the server of the best ranked route accepting the request and the
+// capture groups of its path
+func (w *ws) findServer(info domain.WsReqInfo) (ServersConfig, map[string]string, bool) {
+	for _, r := range w.snapshot.Load().routes {
+		if captures, ok := r.match(info); ok {
+			return r.server, captures, true
 		}
 	}
 
-	return nil, UpstreamConfig{}, false
+	return ServersConfig{}, nil, false
 }
 
 func initOverridePayload(override []WebsocketPayloadOverrideConfig) ([]domain.ModifierEvent, error) {
 	var overridePayload []domain.ModifierEvent
 
 	for _, o := range override {
+		on := domain.TextOpcode
 		handler := func(frame domain.Frame) (domain.Frame, error) {
 			return frame, nil
 		}
@@ -118,13 +268,31 @@ func initOverridePayload(override []WebsocketPayloadOverrideConfig) ([]domain.Mo
 
 				return frame, nil
 			}
+		} else if o.Type == domain.BytesMatch {
+			var err error
+			on = domain.BinaryOpcode
+			if handler, err = newBytesHandler(o.Match, o.Value); err != nil {
+				return nil, err
+			}
+		} else if o.Type == domain.BinaryRegexMatch {
+			var err error
+			on = domain.BinaryOpcode
+			if handler, err = newBinaryRegexHandler(o.Match, o.Value); err != nil {
+				return nil, err
+			}
+		} else if o.Type == domain.JsonMatch {
+			var err error
+			if handler, err = newJsonHandler(o); err != nil {
+				return nil, err
+			}
 		}
 
 		overridePayload = append(
 			overridePayload,
 			domain.ModifierEvent{
-				On:      domain.TextOpcode,
-				Handler: handler,
+				On:        on,
+				Direction: o.Direction,
+				Handler:   handler,
 			},
 		)
 	}
@@ -0,0 +1,1020 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+type fakeProxy struct {
+	addr   string
+	opt    adapter.WsOption
+	before func(r *http.Request) error
+	after  func(resp *http.Response) error
+	events []domain.ModifierEvent
+}
+
+func (p *fakeProxy) Proxy(http.ResponseWriter, *http.Request) {}
+
+type fakeWsAdapter struct{}
+
+func (fakeWsAdapter) New(addr string, _ string, opt adapter.WsOption, beforeCallback func(r *http.Request) error, afterCallback func(resp *http.Response) error, events ...domain.ModifierEvent) (domain.WsProxyUsecase, error) {
+	return &fakeProxy{addr: addr, opt: opt, before: beforeCallback, after: afterCallback, events: events}, nil
+}
+
+func (fakeWsAdapter) HealthCheck(string, string, adapter.WsOption, adapter.HealthCheckOption) error {
+	return nil
+}
+
+func (fakeWsAdapter) Sessions() []domain.SessionInfo {
+	return nil
+}
+
+func (fakeWsAdapter) CloseSession(string, uint16) error {
+	return nil
+}
+
+func (fakeWsAdapter) Dial(string, string, adapter.WsOption, http.Header) (adapter.WsClient, error) {
+	return &echoClient{messages: make(chan []byte, 16)}, nil
+}
+
+// echoClient is an upstream answering every message with the same payload
+type echoClient struct {
+	messages chan []byte
+}
+
+func (c *echoClient) Send(_ domain.OpcodeType, payload []byte) error {
+	c.messages <- payload
+	return nil
+}
+
+func (c *echoClient) Receive() (domain.OpcodeType, []byte, error) {
+	payload, ok := <-c.messages
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return domain.TextOpcode, payload, nil
+}
+
+func (c *echoClient) Close() error {
+	close(c.messages)
+	return nil
+}
+
+func newTestWs(t *testing.T, servers ...ServersConfig) *ws {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	w, err := NewWs(fakeWsAdapter{}, nil, log, Config{Servers: servers})
+	if err != nil {
+		t.Fatalf("NewWs() error = %v", err)
+	}
+
+	return w
+}
+
+func connectAddr(t *testing.T, w *ws, info domain.WsReqInfo) (string, bool) {
+	t.Helper()
+
+	proxy, err := w.Connect(info)
+	if err != nil {
+		return "", false
+	}
+
+	return proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).addr, true
+}
+
+func TestConnect_ListenerIsolation(t *testing.T) {
+	w := newTestWs(
+		t,
+		ServersConfig{
+			ListenIP:   "0.0.0.0",
+			ListenPort: 8090,
+			MatchPath:  []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/ws"}},
+			Upstream:   UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+		},
+		ServersConfig{
+			ListenIP:   "0.0.0.0",
+			ListenPort: 9000,
+			MatchPath:  []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/ws"}},
+			Upstream:   UpstreamConfig{Ip: "10.0.0.2", Port: 3000},
+		},
+		ServersConfig{
+			ListenIP:   "127.0.0.1",
+			ListenPort: 9100,
+			MatchPath:  []MatchPathConfig{{Type: domain.ExactMatch, Value: "/admin"}},
+			Upstream:   UpstreamConfig{Ip: "10.0.0.3", Port: 3000},
+		},
+	)
+
+	tests := []struct {
+		name     string
+		listener string
+		uri      string
+		want     string
+		wantFind bool
+	}{
+		{name: "route of first listener", listener: "0.0.0.0:8090", uri: "/ws/chat", want: "ws://10.0.0.1:3000/ws/chat", wantFind: true},
+		{name: "same path on second listener", listener: "0.0.0.0:9000", uri: "/ws/chat", want: "ws://10.0.0.2:3000/ws/chat", wantFind: true},
+		{name: "route of third listener", listener: "127.0.0.1:9100", uri: "/admin", want: "ws://10.0.0.3:3000/admin", wantFind: true},
+		{name: "route of other listener is not reachable", listener: "0.0.0.0:8090", uri: "/admin"},
+		{name: "same port on other ip is not reachable", listener: "127.0.0.1:8090", uri: "/ws/chat"},
+		{name: "unknown listener", listener: "0.0.0.0:7000", uri: "/ws/chat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := connectAddr(t, w, domain.WsReqInfo{Listener: tt.listener, Header: http.Header{}, URI: tt.uri})
+			if ok != tt.wantFind {
+				t.Fatalf("Connect() found = %v, want %v", ok, tt.wantFind)
+			}
+			if got != tt.want {
+				t.Errorf("Connect() upstream = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnect_ServerWithoutListenerMatchesAll(t *testing.T) {
+	w := newTestWs(
+		t,
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+		},
+	)
+
+	for _, listener := range []string{"0.0.0.0:8090", "127.0.0.1:9000", ""} {
+		got, ok := connectAddr(t, w, domain.WsReqInfo{Listener: listener, Header: http.Header{}, URI: "/ws"})
+		if !ok || got != "ws://10.0.0.1:3000/ws" {
+			t.Errorf("Connect() on %q = %q, %v, want the shared upstream", listener, got, ok)
+		}
+	}
+}
+
+func TestNewWs_InvalidRegex(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	_, err := NewWs(fakeWsAdapter{}, nil, log, Config{Servers: []ServersConfig{{
+		MatchPath: []MatchPathConfig{{Type: domain.RegexMatch, Value: "^/ws/(.+$"}},
+		Upstream:  UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+	}}})
+	if err == nil {
+		t.Fatal("NewWs() expected an error for an invalid regex")
+	}
+}
+
+func TestConnect_RouteRanking(t *testing.T) {
+	w := newTestWs(
+		t,
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.RegexMatch, Value: "^/nomatch$"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+		},
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.2", Port: 3000},
+		},
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/api/ws"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.3", Port: 3000},
+		},
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.RegexMatch, Value: "^/api/ws/[0-9]+$"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.4", Port: 3000},
+		},
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.ExactMatch, Value: "/api/ws/1"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.5", Port: 3000},
+		},
+		ServersConfig{
+			Priority:  10,
+			MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/api/ws/urgent"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.6", Port: 3000},
+		},
+	)
+
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{name: "non matching regex does not hide later servers", uri: "/chat", want: "ws://10.0.0.2:3000/chat"},
+		{name: "longest prefix wins", uri: "/api/ws/chat", want: "ws://10.0.0.3:3000/api/ws/chat"},
+		{name: "regex before prefix", uri: "/api/ws/2", want: "ws://10.0.0.4:3000/api/ws/2"},
+		{name: "exact before regex", uri: "/api/ws/1", want: "ws://10.0.0.5:3000/api/ws/1"},
+		{name: "priority before exact", uri: "/api/ws/urgent", want: "ws://10.0.0.6:3000/api/ws/urgent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := connectAddr(t, w, domain.WsReqInfo{Header: http.Header{}, URI: tt.uri})
+			if !ok || got != tt.want {
+				t.Errorf("Connect() upstream = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnect_CaptureGroupsInHeaders(t *testing.T) {
+	upstream := UpstreamConfig{Ip: "10.0.0.1", Port: 3000}
+	upstream.Override.Header = []HeaderOverrideConfig{
+		{Key: "X-Room", Value: "${room}"},
+		{Key: "X-User", Value: "user-${2}"},
+		{Key: "X-Unknown", Value: "${missing}"},
+	}
+	w := newTestWs(t, ServersConfig{
+		MatchPath: []MatchPathConfig{{Type: domain.RegexMatch, Value: "^/rooms/(?P<room>[a-z]+)/users/([0-9]+)$"}},
+		Upstream:  upstream,
+	})
+
+	proxy, err := w.Connect(domain.WsReqInfo{Header: http.Header{}, URI: "/rooms/lobby/users/42"})
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "http://10.0.0.1:3000/", nil)
+	if err := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).before(r); err != nil {
+		t.Fatalf("beforeCallback() error = %v", err)
+	}
+
+	want := map[string]string{"X-Room": "lobby", "X-User": "user-42", "X-Unknown": "${missing}"}
+	for k, v := range want {
+		if got := r.Header.Get(k); got != v {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestConnect_PathRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		match MatchPathConfig
+		path  PathOverrideConfig
+		uri   string
+		want  string
+	}{
+		{
+			name:  "verbatim without override",
+			match: MatchPathConfig{Type: domain.PrefixMatch, Value: "/"},
+			uri:   "/api/ws/chat?room=1",
+			want:  "ws://10.0.0.1:3000/api/ws/chat?room=1",
+		},
+		{
+			name:  "strip and add prefix",
+			match: MatchPathConfig{Type: domain.PrefixMatch, Value: "/api/ws"},
+			path:  PathOverrideConfig{StripPrefix: "/api/ws", AddPrefix: "/socket"},
+			uri:   "/api/ws/chat?room=1",
+			want:  "ws://10.0.0.1:3000/socket/chat?room=1",
+		},
+		{
+			name:  "strip the whole path",
+			match: MatchPathConfig{Type: domain.ExactMatch, Value: "/api/ws/chat"},
+			path:  PathOverrideConfig{StripPrefix: "/api/ws/chat"},
+			uri:   "/api/ws/chat",
+			want:  "ws://10.0.0.1:3000/",
+		},
+		{
+			name:  "strip prefix with a trailing slash",
+			match: MatchPathConfig{Type: domain.PrefixMatch, Value: "/api/"},
+			path:  PathOverrideConfig{StripPrefix: "/api/"},
+			uri:   "/api/chat",
+			want:  "ws://10.0.0.1:3000/chat",
+		},
+		{
+			name:  "prefix only stripped on a segment boundary",
+			match: MatchPathConfig{Type: domain.PrefixMatch, Value: "/api"},
+			path:  PathOverrideConfig{StripPrefix: "/api", AddPrefix: "/socket"},
+			uri:   "/apiv2/chat",
+			want:  "ws://10.0.0.1:3000/socket/apiv2/chat",
+		},
+		{
+			name:  "regex replace",
+			match: MatchPathConfig{Type: domain.PrefixMatch, Value: "/api"},
+			path:  PathOverrideConfig{Regex: "^/api/ws/([a-z]+)$", Replace: "/socket/$1"},
+			uri:   "/api/ws/chat",
+			want:  "ws://10.0.0.1:3000/socket/chat",
+		},
+		{
+			name:  "regex replace with match captures",
+			match: MatchPathConfig{Type: domain.RegexMatch, Value: "^/(?P<tenant>[a-z]+)/ws/"},
+			path:  PathOverrideConfig{Regex: "^/[a-z]+/ws/([a-z]+)$", Replace: "/${tenant}/rooms/$1"},
+			uri:   "/acme/ws/chat",
+			want:  "ws://10.0.0.1:3000/acme/rooms/chat",
+		},
+		{
+			name:  "regex groups before match captures",
+			match: MatchPathConfig{Type: domain.RegexMatch, Value: "^/(?P<room>[a-z]+)/(v[0-9])$"},
+			path:  PathOverrideConfig{Regex: "^/(?P<room>[a-z]+)/v[0-9]$", Replace: "/${room}/${1}/${2}"},
+			uri:   "/chat/v2",
+			want:  "ws://10.0.0.1:3000/chat/chat/v2",
+		},
+		{
+			name:  "template from match captures",
+			match: MatchPathConfig{Type: domain.RegexMatch, Value: "^/api/ws/(?P<room>[a-z]+)"},
+			path:  PathOverrideConfig{Replace: "/rooms/${room}/socket"},
+			uri:   "/api/ws/chat?token=secret",
+			want:  "ws://10.0.0.1:3000/rooms/chat/socket?token=secret",
+		},
+		{
+			name:  "query remove, rename and add",
+			match: MatchPathConfig{Type: domain.RegexMatch, Value: "^/api/ws/(?P<room>[a-z]+)"},
+			path: PathOverrideConfig{Query: QueryOverrideConfig{
+				Remove: []string{"token"},
+				Rename: []QueryRenameConfig{{From: "uid", To: "user_id"}},
+				Add:    []QueryParamConfig{{Key: "room", Value: "${room}"}},
+			}},
+			uri:  "/api/ws/chat?token=secret&uid=42",
+			want: "ws://10.0.0.1:3000/api/ws/chat?room=chat&user_id=42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := UpstreamConfig{Ip: "10.0.0.1", Port: 3000}
+			upstream.Override.Path = tt.path
+			w := newTestWs(t, ServersConfig{MatchPath: []MatchPathConfig{tt.match}, Upstream: upstream})
+
+			got, ok := connectAddr(t, w, domain.WsReqInfo{Header: http.Header{}, URI: tt.uri})
+			if !ok || got != tt.want {
+				t.Errorf("Connect() upstream = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnect_HeaderActions(t *testing.T) {
+	t.Setenv("WS_TEST_REGION", "eu-west")
+	upstream := UpstreamConfig{Ip: "10.0.0.1", Port: 3000}
+	upstream.Override.StripHopByHop = true
+	upstream.Override.StripSensitive = true
+	upstream.Override.Header = []HeaderOverrideConfig{
+		{Key: "X-Tag", Value: "proxy", Action: domain.HeaderAddAction},
+		{Key: "X-Tenant", Value: "default", Action: domain.HeaderSetIfAbsentAction},
+		{Key: "X-Region", Value: "default", Action: domain.HeaderSetIfAbsentAction},
+		{Key: "X-Debug", Action: domain.HeaderRemoveAction},
+		{Key: "X-Client", Value: "${remote_addr}|${host}|${request_id}|${env.WS_TEST_REGION}", Action: domain.HeaderSetAction},
+	}
+	w := newTestWs(t, ServersConfig{Upstream: upstream})
+
+	info := domain.WsReqInfo{
+		RemoteAddr: "192.0.2.10:51000",
+		Host:       "chat.example.com",
+		Header:     http.Header{"X-Request-Id": {"req-1"}},
+		URI:        "/ws",
+	}
+	proxy, err := w.Connect(info)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "http://10.0.0.1:3000/ws", nil)
+	r.Header = http.Header{
+		"Connection":    {"Upgrade, X-Hop"},
+		"Upgrade":       {"websocket"},
+		"X-Hop":         {"1"},
+		"Keep-Alive":    {"timeout=5"},
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"session=1"},
+		"X-Tag":         {"client"},
+		"X-Tenant":      {"acme"},
+		"X-Debug":       {"1"},
+	}
+	if err := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).before(r); err != nil {
+		t.Fatalf("beforeCallback() error = %v", err)
+	}
+
+	for _, k := range []string{"X-Hop", "Keep-Alive", "Authorization", "Cookie", "X-Debug"} {
+		if v, ok := r.Header[k]; ok {
+			t.Errorf("header %s = %q, want removed", k, v)
+		}
+	}
+	want := map[string][]string{
+		"Upgrade":  {"websocket"},
+		"X-Tag":    {"client", "proxy"},
+		"X-Tenant": {"acme"},
+		"X-Region": {"default"},
+		"X-Client": {"192.0.2.10|chat.example.com|req-1|eu-west"},
+	}
+	for k, v := range want {
+		if got := r.Header.Values(k); strings.Join(got, ",") != strings.Join(v, ",") {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestConnect_ResponseHeaders(t *testing.T) {
+	upstream := UpstreamConfig{Ip: "10.0.0.1", Port: 3000}
+	upstream.Override.ResponseHeader = []HeaderOverrideConfig{
+		{Key: "Set-Cookie", Action: domain.HeaderRemoveAction},
+		{Key: "X-Served-By", Value: "${host}", Action: domain.HeaderSetAction},
+		{Key: "X-Tag", Value: "proxy", Action: domain.HeaderAddAction},
+	}
+	w := newTestWs(t, ServersConfig{Upstream: upstream})
+
+	proxy, err := w.Connect(domain.WsReqInfo{Host: "chat.example.com", Header: http.Header{}, URI: "/ws"})
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	resp := &http.Response{Header: http.Header{
+		"Upgrade":     {"websocket"},
+		"Set-Cookie":  {"session=1"},
+		"X-Served-By": {"10.0.0.1"},
+		"X-Tag":       {"upstream"},
+	}}
+	if err := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).after(resp); err != nil {
+		t.Fatalf("afterCallback() error = %v", err)
+	}
+
+	want := map[string][]string{
+		"Upgrade":     {"websocket"},
+		"Set-Cookie":  nil,
+		"X-Served-By": {"chat.example.com"},
+		"X-Tag":       {"upstream", "proxy"},
+	}
+	for k, v := range want {
+		if got := resp.Header.Values(k); strings.Join(got, ",") != strings.Join(v, ",") {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	upstream.Override.ResponseHeader = []HeaderOverrideConfig{{Key: "sec-websocket-accept", Value: "x", Action: domain.HeaderSetAction}}
+	if _, err := NewWs(fakeWsAdapter{}, nil, log, Config{Servers: []ServersConfig{{Upstream: upstream}}}); err == nil {
+		t.Error("NewWs() expected an error for a rule on a handshake response header")
+	}
+}
+
+func TestConnect_Forwarded(t *testing.T) {
+	w := newTestWs(t, ServersConfig{
+		Forwarded: ForwardedConfig{Enable: true, TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}},
+		Upstream:  UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+	})
+
+	incoming := http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"public.example.com"},
+		"Forwarded":         {"for=203.0.113.7;host=public.example.com;proto=https"},
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		want       map[string]string
+	}{
+		{
+			name:       "trusted proxy values are extended",
+			remoteAddr: "10.1.2.3:40000",
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 10.1.2.3",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"Forwarded":         `for=203.0.113.7;host=public.example.com;proto=https, for=10.1.2.3;host="internal:8090";proto=http`,
+			},
+		},
+		{
+			name:       "untrusted client values are overwritten",
+			remoteAddr: "198.51.100.4:40000",
+			tls:        true,
+			want: map[string]string{
+				"X-Forwarded-For":   "198.51.100.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "internal:8090",
+				"Forwarded":         `for=198.51.100.4;host="internal:8090";proto=https`,
+			},
+		},
+		{
+			name:       "trusted ipv6 proxy",
+			remoteAddr: "[2001:db8::1]:40000",
+			want: map[string]string{
+				"X-Forwarded-For": "203.0.113.7, 2001:db8::1",
+				"Forwarded":       `for=203.0.113.7;host=public.example.com;proto=https, for="[2001:db8::1]";host="internal:8090";proto=http`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := domain.WsReqInfo{RemoteAddr: tt.remoteAddr, Tls: tt.tls, Host: "internal:8090", Header: incoming.Clone(), URI: "/ws"}
+			proxy, err := w.Connect(info)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			r, _ := http.NewRequest(http.MethodGet, "http://10.0.0.1:3000/ws", nil)
+			r.Header = incoming.Clone()
+			if err := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).before(r); err != nil {
+				t.Fatalf("beforeCallback() error = %v", err)
+			}
+
+			for k, v := range tt.want {
+				if got := strings.Join(r.Header.Values(k), ", "); got != v {
+					t.Errorf("header %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWs_InvalidTrustedProxy(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	_, err := NewWs(fakeWsAdapter{}, nil, log, Config{Servers: []ServersConfig{{
+		Forwarded: ForwardedConfig{Enable: true, TrustedProxies: []string{"10.0.0.0/33"}},
+		Upstream:  UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+	}}})
+	if err == nil {
+		t.Fatal("NewWs() expected an error for an invalid trusted proxy")
+	}
+}
+
+type fakeMetrics struct {
+	counts map[string]int
+}
+
+func (m *fakeMetrics) ConnectionAccepted(route string) {
+	m.counts["accepted/"+route]++
+}
+
+func (m *fakeMetrics) ConnectionRejected(route string, reason string) {
+	m.counts["rejected/"+route+"/"+reason]++
+}
+
+func (m *fakeMetrics) ModifierHit(route string, rule string) {
+	m.counts["hit/"+route+"/"+rule]++
+}
+
+func (m *fakeMetrics) ModifierError(route string, rule string) {
+	m.counts["error/"+route+"/"+rule]++
+}
+
+func (m *fakeMetrics) ModifierShadowHit(route string, rule string) {
+	m.counts["shadow/"+route+"/"+rule]++
+}
+
+func TestConnect_Metrics(t *testing.T) {
+	metrics := &fakeMetrics{counts: make(map[string]int)}
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	w, err := NewWs(fakeWsAdapter{}, metrics, log, Config{Servers: []ServersConfig{{
+		Name:      "chat",
+		MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/chat"}},
+		Upstream: UpstreamConfig{
+			Ip:          "10.0.0.1",
+			Port:        3000,
+			HealthCheck: HealthCheckConfig{MaxFails: 1},
+			Override: OverrideConfig{WebsocketPayload: []WebsocketPayloadOverrideConfig{
+				{Type: domain.ExactMatch, Direction: domain.ClientDirection, Match: "ping", Value: "pong"},
+			}},
+		},
+	}}})
+	if err != nil {
+		t.Fatalf("NewWs() error = %v", err)
+	}
+
+	if _, err := w.Connect(domain.WsReqInfo{URI: "/other"}); err == nil {
+		t.Fatal("Connect() expected an error for an unmatched request")
+	}
+	proxy, err := w.Connect(domain.WsReqInfo{URI: "/chat"})
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	fake := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy)
+	for _, payload := range []string{"ping", "other"} {
+		_, _ = fake.events[0].Handler(domain.Frame{Opcode: domain.TextOpcode, Payload: []byte(payload)})
+	}
+	fake.opt.HandshakeResult(nil)
+	fake.opt.HandshakeResult(fmt.Errorf("%w: 403 Forbidden", domain.ErrUpstreamRefused))
+	if !proxy.(*trackedProxy).target.available() {
+		t.Error("target ejected after the upstream refused a handshake, want it kept as alive")
+	}
+	fake.opt.HandshakeResult(errors.New("upstream handshake error: 502 Bad Gateway"))
+
+	failing := []domain.ModifierEvent{{Handler: func(frame domain.Frame) (domain.Frame, error) {
+		return frame, errors.New("failed")
+	}}}
+	countModifiers(metrics, "chat", []WebsocketPayloadOverrideConfig{{Name: "failing"}}, failing)
+	_, _ = failing[0].Handler(domain.Frame{})
+
+	want := map[string]int{
+		"rejected//no_route":               1,
+		"accepted/chat":                    1,
+		"rejected/chat/upstream_status":    1,
+		"rejected/chat/upstream_handshake": 1,
+		"hit/chat/rule-0":                  1,
+		"error/chat/failing":               1,
+	}
+	for key, count := range want {
+		if metrics.counts[key] != count {
+			t.Errorf("metrics[%q] = %d, want %d (all: %v)", key, metrics.counts[key], count, metrics.counts)
+		}
+	}
+	if len(metrics.counts) != len(want) {
+		t.Errorf("metrics = %v, want %v", metrics.counts, want)
+	}
+}
+
+func TestToggleRule(t *testing.T) {
+	servers := func() []ServersConfig {
+		return []ServersConfig{{
+			Name:      "chat",
+			MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/chat"}},
+			Upstream: UpstreamConfig{
+				Ip:   "10.0.0.1",
+				Port: 3000,
+				Override: OverrideConfig{WebsocketPayload: []WebsocketPayloadOverrideConfig{
+					{Name: "ping", Type: domain.ExactMatch, Direction: domain.ClientDirection, Match: "ping", Value: "pong"},
+				}},
+			},
+		}}
+	}
+	w := newTestWs(t, servers()...)
+	proxy, err := w.Connect(domain.WsReqInfo{URI: "/chat"})
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	handler := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).events[0].Handler
+	apply := func() string {
+		f, _ := handler(domain.Frame{Opcode: domain.TextOpcode, Payload: []byte("ping")})
+		return string(f.Payload)
+	}
+
+	if err := w.ToggleRule("chat", "ping", false); err != nil {
+		t.Fatalf("ToggleRule() error = %v", err)
+	}
+	if got := apply(); got != "ping" {
+		t.Errorf("disabled rule applied on the live connection, payload = %q", got)
+	}
+	if err := w.Reload(Config{Servers: servers()}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if rules := w.Routes()[0].Rules; len(rules) != 1 || rules[0].Enabled {
+		t.Errorf("Routes() rules after reload = %+v, want the rule disabled", rules)
+	}
+	if err := w.ToggleRule("chat", "ping", true); err != nil {
+		t.Fatalf("ToggleRule() error = %v", err)
+	}
+	if got := apply(); got != "pong" {
+		t.Errorf("enabled rule not applied on the connection started before the reload, payload = %q", got)
+	}
+	if err := w.ToggleRule("chat", "missing", true); !errors.Is(err, domain.ErrRuleNotFound) {
+		t.Errorf("ToggleRule() of an unknown rule error = %v, want %v", err, domain.ErrRuleNotFound)
+	}
+}
+
+func TestCloseSession_InvalidCode(t *testing.T) {
+	w := newTestWs(t)
+	for _, code := range []uint16{999, 1005, 1006, 1015, 2000, 5000} {
+		if err := w.CloseSession("1", code); !errors.Is(err, domain.ErrInvalidCloseCode) {
+			t.Errorf("CloseSession(%d) error = %v, want %v", code, err, domain.ErrInvalidCloseCode)
+		}
+	}
+	if err := w.CloseSession("1", 4000); err != nil {
+		t.Errorf("CloseSession(4000) error = %v", err)
+	}
+}
+
+func TestNewWs_InvalidRecordSample(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	_, err := NewWs(fakeWsAdapter{}, nil, log, Config{Servers: []ServersConfig{{
+		Record:   RecordConfig{File: "record.jsonl", Sample: 1.5},
+		Upstream: UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+	}}})
+	if err == nil {
+		t.Fatal("NewWs() expected an error for a record sample above 1")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	w := newTestWs(t, ServersConfig{
+		Name:      "chat",
+		MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/chat"}},
+		Upstream: UpstreamConfig{
+			Ip:   "10.0.0.1",
+			Port: 3000,
+			Override: OverrideConfig{WebsocketPayload: []WebsocketPayloadOverrideConfig{
+				{Name: "ping", Type: domain.ExactMatch, Direction: domain.ClientDirection, Match: "ping", Value: "pong"},
+			}},
+		},
+	})
+	recorded := func(direction domain.Direction, payload, forwarded string) domain.RecordedMessage {
+		return domain.RecordedMessage{
+			Session:   "1",
+			Route:     "chat",
+			Direction: direction,
+			Opcode:    domain.TextOpcode,
+			Payload:   []byte(payload),
+			Forwarded: []byte(forwarded),
+		}
+	}
+	messages := []domain.RecordedMessage{
+		recorded(domain.ClientDirection, "ping", "pong"),
+		recorded(domain.ServerDirection, "pong", "pong"),
+		recorded(domain.ClientDirection, "hello", "hello"),
+		recorded(domain.ServerDirection, "hi", "hi"),
+		recorded(domain.ServerDirection, "bye", "bye"),
+	}
+
+	report, err := w.Replay(messages, domain.ReplayOption{Wait: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if report.Sent != 2 || report.Received != 2 {
+		t.Errorf("Replay() sent %d and received %d, want 2 and 2", report.Sent, report.Received)
+	}
+	if len(report.Diffs) != 2 {
+		t.Fatalf("Replay() diffs = %+v, want 2", report.Diffs)
+	}
+	if d := report.Diffs[0]; d.Direction != domain.ServerDirection || d.Index != 1 || string(d.Expected) != "hi" || string(d.Actual) != "hello" {
+		t.Errorf("Replay() diff = %+v, want hello instead of hi", d)
+	}
+	if d := report.Diffs[1]; !d.Missing || d.Index != 2 || string(d.Expected) != "bye" {
+		t.Errorf("Replay() diff = %+v, want bye missing", d)
+	}
+
+	messages[0].Truncated = true
+	if _, err := w.Replay(messages, domain.ReplayOption{}); !errors.Is(err, ErrReplayTruncated) {
+		t.Errorf("Replay() of a truncated client message error = %v, want %v", err, ErrReplayTruncated)
+	}
+}
+
+func TestConnect_ShadowRule(t *testing.T) {
+	metrics := &fakeMetrics{counts: make(map[string]int)}
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	w, err := NewWs(fakeWsAdapter{}, metrics, log, Config{Servers: []ServersConfig{{
+		Name:      "chat",
+		MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/chat"}},
+		Upstream: UpstreamConfig{
+			Ip:   "10.0.0.1",
+			Port: 3000,
+			Override: OverrideConfig{WebsocketPayload: []WebsocketPayloadOverrideConfig{
+				{Name: "token", Type: domain.RegexMatch, Direction: domain.ClientDirection, Match: `token=\w+`, Value: "token=***", Mode: domain.ShadowMode},
+			}},
+		},
+	}}})
+	if err != nil {
+		t.Fatalf("NewWs() error = %v", err)
+	}
+	proxy, err := w.Connect(domain.WsReqInfo{URI: "/chat"})
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	handler := proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).events[0].Handler
+
+	for _, payload := range []string{"login token=secret", "hello"} {
+		f, err := handler(domain.Frame{Opcode: domain.TextOpcode, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatalf("handler(%q) error = %v", payload, err)
+		}
+		if string(f.Payload) != payload {
+			t.Errorf("shadow rule forwarded %q, want the original %q", f.Payload, payload)
+		}
+	}
+	want := map[string]int{"shadow/chat/token": 1}
+	if len(metrics.counts) != len(want) || metrics.counts["shadow/chat/token"] != 1 {
+		t.Errorf("metrics = %v, want %v", metrics.counts, want)
+	}
+	if rules := w.Routes()[0].Rules; len(rules) != 1 || rules[0].Mode != domain.ShadowMode {
+		t.Errorf("Routes() rules = %+v, want the rule in shadow mode", rules)
+	}
+}
+
+func TestPayloadDiff(t *testing.T) {
+	tests := []struct {
+		before, after, want string
+	}{
+		{"login token=secret", "login token=***", `@12 -"secret" +"***"`},
+		{"abc", "abcd", `@3 -"" +"d"`},
+		{"ping", "pong", `@1 -"i" +"o"`},
+	}
+	for _, tt := range tests {
+		if got := payloadDiff([]byte(tt.before), []byte(tt.after)); got != tt.want {
+			t.Errorf("payloadDiff(%q, %q) = %s, want %s", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestReload_KeepsTargetState(t *testing.T) {
+	servers := func(port int) []ServersConfig {
+		return []ServersConfig{{
+			Name:      "chat",
+			MatchPath: []MatchPathConfig{{Type: domain.PrefixMatch, Value: "/chat"}},
+			Upstream: UpstreamConfig{
+				Ip:          "10.0.0.1",
+				Port:        port,
+				HealthCheck: HealthCheckConfig{MaxFails: 1, FailTimeout: time.Hour},
+			},
+		}}
+	}
+	w := newTestWs(t, servers(3000)...)
+	proxy, err := w.Connect(domain.WsReqInfo{URI: "/chat"})
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).opt.HandshakeResult(errors.New("connection refused"))
+
+	if err := w.Reload(Config{Servers: servers(3000)}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := w.Connect(domain.WsReqInfo{URI: "/chat"}); !errors.Is(err, ErrNoUpstreamTarget) {
+		t.Errorf("Connect() after reload error = %v, want the ejected target kept out (%v)", err, ErrNoUpstreamTarget)
+	}
+
+	if err := w.Reload(Config{Servers: servers(3001)}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := w.Connect(domain.WsReqInfo{URI: "/chat"}); err != nil {
+		t.Errorf("Connect() to a new target error = %v", err)
+	}
+}
+
+// dialAdapter records the upstream handshakes of the replays and counts the health checks
+type dialAdapter struct {
+	fakeWsAdapter
+	mu     sync.Mutex
+	addr   string
+	host   string
+	header http.Header
+	checks int
+}
+
+func (a *dialAdapter) Dial(addr string, host string, opt adapter.WsOption, header http.Header) (adapter.WsClient, error) {
+	a.mu.Lock()
+	a.addr, a.host, a.header = addr, host, header
+	a.mu.Unlock()
+
+	return a.fakeWsAdapter.Dial(addr, host, opt, header)
+}
+
+func (a *dialAdapter) HealthCheck(string, string, adapter.WsOption, adapter.HealthCheckOption) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checks++
+
+	return nil
+}
+
+func TestReplay_RecordedRequest(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	wsAdapter := &dialAdapter{}
+	w, err := NewWs(wsAdapter, nil, log, Config{Servers: []ServersConfig{{
+		Name:      "chat",
+		MatchPath: []MatchPathConfig{{Type: domain.RegexMatch, Value: `^/chat/(\w+)$`}},
+		Upstream: UpstreamConfig{
+			Ip:   "10.0.0.1",
+			Port: 3000,
+			Override: OverrideConfig{
+				Path:   PathOverrideConfig{Replace: "/rooms/${1}"},
+				Header: []HeaderOverrideConfig{{Key: "X-Room", Value: "${1}"}},
+			},
+		},
+	}}})
+	if err != nil {
+		t.Fatalf("NewWs() error = %v", err)
+	}
+	messages := []domain.RecordedMessage{
+		{Session: "1", Route: "chat", Request: &domain.RecordedRequest{
+			RemoteAddr: "192.0.2.1:5000",
+			Host:       "chat.example.com",
+			URI:        "/chat/lobby?token=abc",
+			Header:     http.Header{"X-User-Id": {"42"}},
+		}},
+		{Session: "1", Route: "chat", Direction: domain.ClientDirection, Opcode: domain.TextOpcode, Payload: []byte("hi"), Forwarded: []byte("hi")},
+	}
+
+	if _, err := w.Replay(messages, domain.ReplayOption{Wait: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if want := "ws://10.0.0.1:3000/rooms/lobby?token=abc"; wsAdapter.addr != want {
+		t.Errorf("Replay() dialed %q, want %q", wsAdapter.addr, want)
+	}
+	if wsAdapter.host != "chat.example.com" {
+		t.Errorf("Replay() host = %q, want the recorded one", wsAdapter.host)
+	}
+	if got := wsAdapter.header.Get("X-User-Id"); got != "42" {
+		t.Errorf("Replay() X-User-Id = %q, want the recorded header", got)
+	}
+	if got := wsAdapter.header.Get("X-Room"); got != "lobby" {
+		t.Errorf("Replay() X-Room = %q, want the capture of the recorded uri", got)
+	}
+	if got := messages[0].Request.Header.Get("X-Room"); got != "" {
+		t.Errorf("Replay() changed the recorded header, X-Room = %q", got)
+	}
+
+	if _, err := w.Replay(messages, domain.ReplayOption{Path: "/chat/support", Wait: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if want := "ws://10.0.0.1:3000/rooms/support"; wsAdapter.addr != want {
+		t.Errorf("Replay() with a path dialed %q, want %q", wsAdapter.addr, want)
+	}
+}
+
+func TestNewWs_NoHealthCheck(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	servers := func() []ServersConfig {
+		return []ServersConfig{{
+			Name: "chat",
+			Upstream: UpstreamConfig{
+				Ip:          "10.0.0.1",
+				Port:        3000,
+				HealthCheck: HealthCheckConfig{Type: domain.TcpHealthCheck, Interval: time.Hour},
+			},
+		}}
+	}
+
+	wsAdapter := &dialAdapter{}
+	w, err := NewWs(wsAdapter, nil, log, Config{Servers: servers(), NoHealthCheck: true})
+	if err != nil {
+		t.Fatalf("NewWs() error = %v", err)
+	}
+	_ = w.Shutdown()
+	if wsAdapter.checks != 0 {
+		t.Errorf("health checks = %d, want none", wsAdapter.checks)
+	}
+
+	// The first probe of a started checker runs before Shutdown returns
+	w, err = NewWs(wsAdapter, nil, log, Config{Servers: servers()})
+	if err != nil {
+		t.Fatalf("NewWs() error = %v", err)
+	}
+	_ = w.Shutdown()
+	if wsAdapter.checks != 1 {
+		t.Errorf("health checks = %d, want 1", wsAdapter.checks)
+	}
+}
+
+func TestConnect_PathMatchIgnoresQuery(t *testing.T) {
+	w := newTestWs(
+		t,
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.ExactMatch, Value: "/health"}},
+			Upstream:  UpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+		},
+		ServersConfig{
+			MatchPath: []MatchPathConfig{{Type: domain.RegexMatch, Value: `^/chat/(\w+)$`}},
+			Upstream: UpstreamConfig{
+				Ip:       "10.0.0.2",
+				Port:     3000,
+				Override: OverrideConfig{Path: PathOverrideConfig{Replace: "/rooms/${1}"}},
+			},
+		},
+	)
+
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{uri: "/health?probe=1", want: "ws://10.0.0.1:3000/health?probe=1"},
+		{uri: "/chat/lobby?token=abc", want: "ws://10.0.0.2:3000/rooms/lobby?token=abc"},
+		{uri: "/chat/lobby", want: "ws://10.0.0.2:3000/rooms/lobby"},
+	}
+	for _, tt := range tests {
+		got, ok := connectAddr(t, w, domain.WsReqInfo{Header: http.Header{}, URI: tt.uri})
+		if !ok || got != tt.want {
+			t.Errorf("Connect(%q) = %q, %v, want %q", tt.uri, got, ok, tt.want)
+		}
+	}
+	if _, ok := connectAddr(t, w, domain.WsReqInfo{Header: http.Header{}, URI: "/chat?room=lobby"}); ok {
+		t.Error("Connect() matched the query as part of the path")
+	}
+}
+
+func TestConnect_PayloadRulesCompiledOnce(t *testing.T) {
+	w := newTestWs(t, ServersConfig{
+		Upstream: UpstreamConfig{
+			Ip:   "10.0.0.1",
+			Port: 3000,
+			Override: OverrideConfig{WebsocketPayload: []WebsocketPayloadOverrideConfig{
+				{Type: domain.RegexMatch, Direction: domain.BothDirection, Match: "a+", Value: "b"},
+			}},
+		},
+	})
+
+	var events [][]domain.ModifierEvent
+	for i := 0; i < 2; i++ {
+		proxy, err := w.Connect(domain.WsReqInfo{Header: http.Header{}, URI: "/"})
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		events = append(events, proxy.(*trackedProxy).WsProxyUsecase.(*fakeProxy).events)
+	}
+	if len(events[0]) != 1 || &events[0][0] != &events[1][0] {
+		t.Error("Connect() compiled the payload rules again instead of using the ones of the snapshot")
+	}
+	out, err := events[0][0].Handler(domain.Frame{Opcode: domain.TextOpcode, Payload: []byte("caat")})
+	if err != nil || string(out.Payload) != "cbt" {
+		t.Errorf("Handler() = %q, %v, want %q", out.Payload, err, "cbt")
+	}
+}
@@ -1,34 +1,129 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/poyaz/reverse-ws-modifier/config"
+	httpDeliveryAdmin "github.com/poyaz/reverse-ws-modifier/internal/app/admin/delivery/http"
 	httpDeliveryProxy "github.com/poyaz/reverse-ws-modifier/internal/app/proxy/delivery/http"
 	adapterUsecaseProxy "github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
 	wsUsecaseProxy "github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/ws"
 	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+	infraMetrics "github.com/poyaz/reverse-ws-modifier/internal/infra/metrics"
 	infraWs "github.com/poyaz/reverse-ws-modifier/internal/infra/ws"
 )
 
 var wsInfraProxyImp adapterUsecaseProxy.WsAdapter
+var metricsInfraImp adapterUsecaseProxy.MetricsAdapter
 var wsUsecaseProxyImp domain.WsProxyTableUsecase
+var wsUsecaseProxyReloader ReloadWsProxyBootstrap
+var wsUsecaseProxyAdmin domain.WsProxyAdminUsecase
 var logger *logrus.Logger
 
 var shutdownHandlers []ShutdownBootstrap
 
+// reloadRequests carries the reloads asked by the admin api to the Run loop, which
+// answers on the given channel
+var reloadRequests = make(chan chan error)
+
+// shutdownCtx is canceled once Run starts shutting down and stops serving the reloads
+var shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+var deliveryHandlers = make(map[listener]deliveryHandler)
+
+type listener struct {
+	ip   string
+	port int
+}
+
+type deliveryHandler struct {
+	config  httpDeliveryProxy.Config
+	handler DeliveryBootstrap
+}
+
 func Run(cfg *config.Config) error {
 	var err error
 	gracefulShutdown := make(chan os.Signal, 1)
 	signal.Notify(gracefulShutdown, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	logger = logrus.New()
 	logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-	switch cfg.Data.Global.LogLevel {
+	setLogLevel(cfg.Data.Global.LogLevel)
+
+	drainTimeout, err := parseDuration(cfg.Data.Global.DrainTimeout)
+	if err != nil {
+		return err
+	}
+	metrics, err := infraMetrics.NewMetricsInfra()
+	if err != nil {
+		return err
+	}
+	metricsInfraImp = metrics
+	wsInfra, err := infraWs.NewWsInfra(infraWs.Config{DrainTimeout: drainTimeout, Metrics: metrics})
+	if err != nil {
+		return err
+	}
+	wsInfraProxyImp = wsInfra
+	// Registered before the usecase, the live sessions are drained once the listeners are stopped
+	shutdownHandlers = append(shutdownHandlers, wsInfra)
+
+	if err := runWebsocketProxyUsecase(cfg); err != nil {
+		return err
+	}
+
+	if err := runDelivery(cfg); err != nil {
+		return err
+	}
+
+	if err := runAdmin(cfg, metrics.Handler()); err != nil {
+		return err
+	}
+
+	configChanged, err := watchConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-reload:
+			reloadConfig(cfg)
+		case <-configChanged:
+			reloadConfig(cfg)
+		case done := <-reloadRequests:
+			done <- reloadConfig(cfg)
+		case <-gracefulShutdown:
+			_, _ = os.Stdout.Write([]byte{'\n'})
+			cancelShutdown()
+
+			for _, dh := range deliveryHandlers {
+				if err := dh.handler.Shutdown(); err != nil {
+					logger.Error(err)
+				}
+			}
+			for _, sh := range shutdownHandlers {
+				if err := sh.Shutdown(); err != nil {
+					logger.Error(err)
+				}
+			}
+
+			return nil
+		}
+	}
+}
+
+func setLogLevel(level string) {
+	switch level {
 	case "panic":
 		logger.SetLevel(logrus.PanicLevel)
 	case "fatal":
@@ -44,113 +139,428 @@ func Run(cfg *config.Config) error {
 	case "tracing", "trace":
 		logger.SetLevel(logrus.TraceLevel)
 	}
+}
 
-	wsInfraProxyImp, err = infraWs.NewWsInfra()
+func runDelivery(cfg *config.Config) error {
+	listeners, listenerConfig, err := deliveryConfig(cfg.Data)
 	if err != nil {
 		return err
 	}
 
-	if err := runWebsocketProxyUsecase(cfg); err != nil {
-		return err
+	for _, k := range listeners {
+		httpDelivery, err := httpDeliveryProxy.NewHandler(wsUsecaseProxyImp, logger, listenerConfig[k])
+		if err != nil {
+			return err
+		}
+		if err := httpDelivery.Listen(nil); err != nil {
+			return err
+		}
+		deliveryHandlers[k] = deliveryHandler{config: listenerConfig[k], handler: httpDelivery}
+
+		go func(handler RunBootstrap) {
+			if err := handler.Run(); err != nil {
+				logger.Fatal(err)
+			}
+		}(httpDelivery)
 	}
 
-	if err := runDelivery(cfg); err != nil {
-		return err
+	return nil
+}
+
+// runAdmin starts the admin server if it has a listen address. It is stopped last, so the
+// metrics and the sessions are served while the sessions drain.
+func runAdmin(cfg *config.Config, metrics http.Handler) error {
+	if cfg.Data.Global.Admin.Listen == "" {
+		return nil
 	}
 
-	<-gracefulShutdown
-	_, _ = os.Stdout.Write([]byte{'\n'})
+	adminDelivery, err := httpDeliveryAdmin.NewHandler(
+		wsUsecaseProxyAdmin,
+		metrics,
+		requestReload,
+		logger,
+		httpDeliveryAdmin.Config{Listen: cfg.Data.Global.Admin.Listen, AllowRemote: cfg.Data.Global.Admin.AllowRemote},
+	)
+	if err != nil {
+		return err
+	}
+	if err := adminDelivery.Listen(); err != nil {
+		return err
+	}
+	shutdownHandlers = append(shutdownHandlers, adminDelivery)
 
-	for _, sh := range shutdownHandlers {
-		if err := sh.Shutdown(); err != nil {
-			logger.Error(err)
+	go func() {
+		if err := adminDelivery.Run(); err != nil {
+			logger.Fatal(err)
 		}
-	}
+	}()
 
 	return nil
 }
 
-func runDelivery(cfg *config.Config) error {
-	listenerConfig := make(map[httpDeliveryProxy.Config]bool)
-	for _, server := range cfg.Data.Servers {
-		listenerConfig[httpDeliveryProxy.Config{ListenIP: server.Ip, ListenPort: server.Port}] = true
+// requestReload asks the Run loop to reload the config and waits for the outcome. It
+// gives up once the proxy shuts down, the loop would never take the request.
+func requestReload(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case reloadRequests <- done:
+	case <-shutdownCtx.Done():
+		return domain.ErrShuttingDown
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	for k, _ := range listenerConfig {
-		httpConfig := httpDeliveryProxy.Config{
-			ListenIP:   k.ListenIP,
-			ListenPort: k.ListenPort,
+	return <-done
+}
+
+// deliveryConfig groups the servers by the ip:port they listen on, in the config order
+func deliveryConfig(data config.Data) ([]listener, map[listener]httpDeliveryProxy.Config, error) {
+	var listeners []listener
+	listenerConfig := make(map[listener]httpDeliveryProxy.Config)
+	listenerPlain := make(map[listener]bool)
+	for _, server := range data.Servers {
+		k := listener{ip: server.Ip, port: server.Port}
+		httpConfig, ok := listenerConfig[k]
+		if !ok {
+			listeners = append(listeners, k)
+			httpConfig = httpDeliveryProxy.Config{ListenIP: server.Ip, ListenPort: server.Port}
 		}
-		httpDelivery, err := httpDeliveryProxy.NewHandler(wsUsecaseProxyImp, logger, httpConfig)
-		if err != nil {
-			return err
+		if server.ProxyProtocol.Enable {
+			if len(server.ProxyProtocol.TrustedSources) == 0 {
+				return nil, nil, fmt.Errorf("server %s:%d enables the PROXY protocol without trusted sources", server.Ip, server.Port)
+			}
+			httpConfig.ProxyProtocol = true
+			httpConfig.TrustedSources = append(httpConfig.TrustedSources, server.ProxyProtocol.TrustedSources...)
 		}
-		shutdownHandlers = append(shutdownHandlers, httpDelivery)
+		if server.Tls.CertFile == "" {
+			listenerPlain[k] = true
+		} else {
+			httpConfig.Tls = append(httpConfig.Tls, httpDeliveryProxy.TlsConfig{
+				CertFile:     server.Tls.CertFile,
+				KeyFile:      server.Tls.KeyFile,
+				MinVersion:   server.Tls.MinVersion,
+				CipherSuites: server.Tls.CipherSuites,
+				ClientCaFile: server.Tls.ClientCaFile,
+			})
+		}
+		listenerConfig[k] = httpConfig
+	}
 
-		go func(handler RunBootstrap) {
-			if err := handler.Run(); err != nil {
-				logger.Fatal(err)
-			}
-		}(httpDelivery)
+	for _, k := range listeners {
+		if len(listenerConfig[k].Tls) > 0 && listenerPlain[k] {
+			return nil, nil, fmt.Errorf("listener %s:%d mixes tls and plain servers", k.ip, k.port)
+		}
+	}
+
+	return listeners, listenerConfig, nil
+}
+
+func runWebsocketProxyUsecase(cfg *config.Config) error {
+	wsConfig, err := websocketProxyConfig(cfg.Data)
+	if err != nil {
+		return err
 	}
+	wsUsecase, err := wsUsecaseProxy.NewWs(wsInfraProxyImp, metricsInfraImp, logger, wsConfig)
+	if err != nil {
+		return err
+	}
+	wsUsecaseProxyImp = wsUsecase
+	wsUsecaseProxyReloader = wsUsecase
+	wsUsecaseProxyAdmin = wsUsecase
+	shutdownHandlers = append(shutdownHandlers, wsUsecase)
 
 	return nil
 }
 
-func runWebsocketProxyUsecase(cfg *config.Config) (err error) {
-	wsConfig := wsUsecaseProxy.Config{}
-	for _, server := range cfg.Data.Servers {
+func websocketProxyConfig(data config.Data) (wsConfig wsUsecaseProxy.Config, err error) {
+	for _, server := range data.Servers {
 		var matchPaths []wsUsecaseProxy.MatchPathConfig
 		for _, smp := range server.Match.Path {
 			mp := wsUsecaseProxy.MatchPathConfig{Value: smp.Value}
-			switch smp.Type {
-			case "exact":
-				mp.Type = domain.ExactMatch
-			case "prefix":
-				mp.Type = domain.PrefixMatch
-			case "regex":
-				mp.Type = domain.RegexMatch
+			if mp.Type, err = findMatchType(smp.Type); err != nil {
+				return wsConfig, err
 			}
 			matchPaths = append(matchPaths, mp)
 		}
+		var matchHosts []wsUsecaseProxy.MatchHostConfig
+		for _, smh := range server.Match.Host {
+			mh := wsUsecaseProxy.MatchHostConfig{Value: smh.Value}
+			if mh.Type, err = findMatchType(smh.Type); err != nil {
+				return wsConfig, err
+			}
+			if mh.Type == domain.ExactMatch && strings.Contains(smh.Value, "*") {
+				mh.Type = domain.WildcardMatch
+			}
+			matchHosts = append(matchHosts, mh)
+		}
+		var matchHeaders []wsUsecaseProxy.MatchKeyConfig
+		for _, smh := range server.Match.Headers {
+			mh := wsUsecaseProxy.MatchKeyConfig{Key: smh.Key, Value: smh.Value}
+			if mh.Type, err = findMatchType(smh.Type); err != nil {
+				return wsConfig, err
+			}
+			matchHeaders = append(matchHeaders, mh)
+		}
+		var matchQuery []wsUsecaseProxy.MatchKeyConfig
+		for _, smq := range server.Match.Query {
+			mq := wsUsecaseProxy.MatchKeyConfig{Key: smq.Key, Value: smq.Value}
+			if mq.Type, err = findMatchType(smq.Type); err != nil {
+				return wsConfig, err
+			}
+			matchQuery = append(matchQuery, mq)
+		}
 
 		upstreamConf := wsUsecaseProxy.UpstreamConfig{
-			Ip:   server.Upstream.Ip,
-			Port: server.Upstream.Port,
+			Scheme: strings.ToLower(server.Upstream.Scheme),
+			Ip:     server.Upstream.Ip,
+			Port:   server.Upstream.Port,
+			Balance: wsUsecaseProxy.BalanceConfig{
+				HashKey: server.Upstream.Balance.HashKey,
+			},
+			Tls: wsUsecaseProxy.TlsConfig{
+				CaFile:             server.Upstream.Tls.CaFile,
+				ServerName:         server.Upstream.Tls.ServerName,
+				InsecureSkipVerify: server.Upstream.Tls.InsecureSkipVerify,
+				CertFile:           server.Upstream.Tls.CertFile,
+				KeyFile:            server.Upstream.Tls.KeyFile,
+			},
+			Message: wsUsecaseProxy.MessageConfig{
+				MaxSize:    server.Upstream.Message.MaxSize,
+				Refragment: server.Upstream.Message.Refragment,
+				Deflate:    server.Upstream.Message.Deflate,
+			},
 			Override: wsUsecaseProxy.OverrideConfig{
-				Host: server.Upstream.Override.Host,
+				Host:           server.Upstream.Override.Host,
+				StripHopByHop:  server.Upstream.Override.StripHopByHop,
+				StripSensitive: server.Upstream.Override.StripSensitive,
+				Path: wsUsecaseProxy.PathOverrideConfig{
+					StripPrefix: server.Upstream.Override.Path.StripPrefix,
+					AddPrefix:   server.Upstream.Override.Path.AddPrefix,
+					Regex:       server.Upstream.Override.Path.Regex,
+					Replace:     server.Upstream.Override.Path.Replace,
+					Query: wsUsecaseProxy.QueryOverrideConfig{
+						Remove: server.Upstream.Override.Path.Query.Remove,
+					},
+				},
 			},
 		}
-		for _, header := range server.Upstream.Override.Headers {
-			upstreamConf.Override.Header = append(
-				upstreamConf.Override.Header,
-				wsUsecaseProxy.HeaderOverrideConfig{Key: header.Key, Value: header.Value},
+		for _, param := range server.Upstream.Override.Path.Query.Add {
+			upstreamConf.Override.Path.Query.Add = append(
+				upstreamConf.Override.Path.Query.Add,
+				wsUsecaseProxy.QueryParamConfig{Key: param.Key, Value: param.Value},
 			)
 		}
+		for _, rename := range server.Upstream.Override.Path.Query.Rename {
+			upstreamConf.Override.Path.Query.Rename = append(
+				upstreamConf.Override.Path.Query.Rename,
+				wsUsecaseProxy.QueryRenameConfig{From: rename.From, To: rename.To},
+			)
+		}
+		switch strings.ToLower(server.Upstream.ProxyProtocol) {
+		case "":
+		case "v1", "1":
+			upstreamConf.ProxyProtocol = 1
+		case "v2", "2":
+			upstreamConf.ProxyProtocol = 2
+		default:
+			return wsConfig, fmt.Errorf("upstream PROXY protocol %q is not supported", server.Upstream.ProxyProtocol)
+		}
+		for _, target := range server.Upstream.Upstreams {
+			upstreamConf.Targets = append(
+				upstreamConf.Targets,
+				wsUsecaseProxy.TargetConfig{Ip: target.Ip, Port: target.Port, Weight: target.Weight},
+			)
+		}
+		switch strings.ToLower(server.Upstream.Balance.Strategy) {
+		case "", "round-robin":
+			upstreamConf.Balance.Strategy = domain.RoundRobinBalance
+		case "least-connections", "least-conn":
+			upstreamConf.Balance.Strategy = domain.LeastConnectionsBalance
+		case "random":
+			upstreamConf.Balance.Strategy = domain.RandomBalance
+		case "consistent-hash":
+			upstreamConf.Balance.Strategy = domain.ConsistentHashBalance
+		default:
+			return wsConfig, fmt.Errorf("upstream balance strategy %q is not supported", server.Upstream.Balance.Strategy)
+		}
+		switch strings.ToLower(server.Upstream.Balance.HashOn) {
+		case "":
+		case "header":
+			upstreamConf.Balance.HashOn = domain.HeaderHash
+		case "cookie":
+			upstreamConf.Balance.HashOn = domain.CookieHash
+		case "query":
+			upstreamConf.Balance.HashOn = domain.QueryHash
+		default:
+			return wsConfig, fmt.Errorf("upstream balance hash source %q is not supported", server.Upstream.Balance.HashOn)
+		}
+		if upstreamConf.HealthCheck, err = healthCheckConfig(server.Upstream.HealthCheck); err != nil {
+			return wsConfig, err
+		}
+		for _, header := range server.Upstream.Override.Headers {
+			oh := wsUsecaseProxy.HeaderOverrideConfig{Key: header.Key, Value: header.Value}
+			if oh.Action, err = headerAction(header.Action); err != nil {
+				return wsConfig, err
+			}
+			upstreamConf.Override.Header = append(upstreamConf.Override.Header, oh)
+		}
+		for _, header := range server.Upstream.Override.ResponseHeaders {
+			oh := wsUsecaseProxy.HeaderOverrideConfig{Key: header.Key, Value: header.Value}
+			if oh.Action, err = headerAction(header.Action); err != nil {
+				return wsConfig, err
+			}
+			upstreamConf.Override.ResponseHeader = append(upstreamConf.Override.ResponseHeader, oh)
+		}
 		for _, wsPayload := range server.Upstream.Override.WebsocketPayload {
 			wsPayloadConf := wsUsecaseProxy.WebsocketPayloadOverrideConfig{
+				Name:  wsPayload.Name,
 				Match: wsPayload.Match,
+				Path:  wsPayload.Path,
 				Value: wsPayload.Value,
 			}
-			switch wsPayload.Type {
-			case "exact":
+			switch strings.ToLower(wsPayload.Type) {
+			case "", "exact":
 				wsPayloadConf.Type = domain.ExactMatch
 			case "regex":
 				wsPayloadConf.Type = domain.RegexMatch
+			case "bytes":
+				wsPayloadConf.Type = domain.BytesMatch
+			case "binary-regex":
+				wsPayloadConf.Type = domain.BinaryRegexMatch
+			case "json":
+				wsPayloadConf.Type = domain.JsonMatch
+			default:
+				return wsConfig, fmt.Errorf("websocket payload rule type %q is not supported", wsPayload.Type)
+			}
+			switch strings.ToLower(wsPayload.Operation) {
+			case "", "set":
+				wsPayloadConf.Operation = domain.JsonSetOperation
+			case "delete":
+				wsPayloadConf.Operation = domain.JsonDeleteOperation
+			case "rename":
+				wsPayloadConf.Operation = domain.JsonRenameOperation
+			case "append":
+				wsPayloadConf.Operation = domain.JsonAppendOperation
+			default:
+				return wsConfig, fmt.Errorf("websocket payload rule operation %q is not supported", wsPayload.Operation)
+			}
+			switch strings.ToLower(wsPayload.Direction) {
+			case "", "client":
+				wsPayloadConf.Direction = domain.ClientDirection
+			case "server":
+				wsPayloadConf.Direction = domain.ServerDirection
+			case "both":
+				wsPayloadConf.Direction = domain.BothDirection
+			default:
+				return wsConfig, fmt.Errorf("websocket payload rule direction %q is not supported", wsPayload.Direction)
+			}
+			switch strings.ToLower(wsPayload.Mode) {
+			case "shadow":
+				wsPayloadConf.Mode = domain.ShadowMode
+			case "", "enforce":
+				wsPayloadConf.Mode = domain.EnforceMode
+			default:
+				return wsConfig, fmt.Errorf("websocket payload rule mode %q is not supported", wsPayload.Mode)
 			}
 			upstreamConf.Override.WebsocketPayload = append(upstreamConf.Override.WebsocketPayload, wsPayloadConf)
 		}
 
 		serverConf := wsUsecaseProxy.ServersConfig{
-			MatchPath: matchPaths,
-			Upstream:  upstreamConf,
+			Name:       server.Name,
+			ListenIP:   server.Ip,
+			ListenPort: server.Port,
+			Priority:   server.Match.Priority,
+			Forwarded: wsUsecaseProxy.ForwardedConfig{
+				Enable:         server.Forwarded.Enable,
+				TrustedProxies: server.Forwarded.TrustedProxies,
+			},
+			MatchPath:        matchPaths,
+			MatchHost:        matchHosts,
+			MatchHeaders:     matchHeaders,
+			MatchQuery:       matchQuery,
+			MatchSubprotocol: server.Match.Subprotocol,
+			Record: wsUsecaseProxy.RecordConfig{
+				File:       server.Record.File,
+				Sample:     server.Record.Sample,
+				MaxSize:    server.Record.MaxSize,
+				MaxBackups: server.Record.MaxBackups,
+				MaxPayload: server.Record.MaxPayload,
+			},
+			Upstream: upstreamConf,
+		}
+		if serverConf.Record.Sample == 0 {
+			serverConf.Record.Sample = 1
 		}
 		wsConfig.Servers = append(wsConfig.Servers, serverConf)
 	}
-	wsUsecaseProxyImp, err = wsUsecaseProxy.NewWs(wsInfraProxyImp, wsConfig)
-	if err != nil {
-		return err
+
+	return wsConfig, nil
+}
+
+func findMatchType(t string) (domain.FindMatch, error) {
+	switch strings.ToLower(t) {
+	case "", "exact":
+		return domain.ExactMatch, nil
+	case "prefix":
+		return domain.PrefixMatch, nil
+	case "regex":
+		return domain.RegexMatch, nil
+	case "wildcard":
+		return domain.WildcardMatch, nil
 	}
 
-	return nil
+	return 0, fmt.Errorf("match type %q is not supported", t)
+}
+
+func headerAction(action string) (domain.HeaderAction, error) {
+	switch strings.ToLower(action) {
+	case "", "set":
+		return domain.HeaderSetAction, nil
+	case "add":
+		return domain.HeaderAddAction, nil
+	case "remove":
+		return domain.HeaderRemoveAction, nil
+	case "set-if-absent":
+		return domain.HeaderSetIfAbsentAction, nil
+	}
+
+	return 0, fmt.Errorf("header action %q is not supported", action)
+}
+
+func healthCheckConfig(hc config.ServerUpstreamHealthCheckConfig) (conf wsUsecaseProxy.HealthCheckConfig, err error) {
+	conf = wsUsecaseProxy.HealthCheckConfig{
+		Path:     hc.Path,
+		Send:     hc.Send,
+		Expect:   hc.Expect,
+		MaxFails: hc.MaxFails,
+	}
+	switch strings.ToLower(hc.Type) {
+	case "":
+	case "tcp":
+		conf.Type = domain.TcpHealthCheck
+	case "websocket", "ws":
+		conf.Type = domain.WebsocketHealthCheck
+	default:
+		return conf, fmt.Errorf("upstream health check type %q is not supported", hc.Type)
+	}
+
+	if conf.Interval, err = parseDuration(hc.Interval); err != nil {
+		return conf, err
+	}
+	if conf.Timeout, err = parseDuration(hc.Timeout); err != nil {
+		return conf, err
+	}
+	if conf.FailTimeout, err = parseDuration(hc.FailTimeout); err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
 }
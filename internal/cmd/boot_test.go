@@ -0,0 +1,226 @@
+//go:build unit
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/config"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+func TestWebsocketProxyConfig_PayloadRule(t *testing.T) {
+	tests := []struct {
+		name          string
+		rule          config.ServerUpstreamOverrideWebsocketPayloadConfig
+		wantType      domain.FindMatch
+		wantDirection domain.Direction
+		wantOperation domain.JsonOperation
+		wantErr       bool
+	}{
+		{
+			name:          "defaults",
+			wantType:      domain.ExactMatch,
+			wantDirection: domain.ClientDirection,
+			wantOperation: domain.JsonSetOperation,
+		},
+		{
+			name:          "every field",
+			rule:          config.ServerUpstreamOverrideWebsocketPayloadConfig{Type: "JSON", Direction: "both", Operation: "rename"},
+			wantType:      domain.JsonMatch,
+			wantDirection: domain.BothDirection,
+			wantOperation: domain.JsonRenameOperation,
+		},
+		{
+			name:          "binary regex on the server messages",
+			rule:          config.ServerUpstreamOverrideWebsocketPayloadConfig{Type: "binary-regex", Direction: "server"},
+			wantType:      domain.BinaryRegexMatch,
+			wantDirection: domain.ServerDirection,
+			wantOperation: domain.JsonSetOperation,
+		},
+		{name: "unknown type", rule: config.ServerUpstreamOverrideWebsocketPayloadConfig{Type: "prefix"}, wantErr: true},
+		{name: "unknown direction", rule: config.ServerUpstreamOverrideWebsocketPayloadConfig{Direction: "upstream"}, wantErr: true},
+		{name: "unknown operation", rule: config.ServerUpstreamOverrideWebsocketPayloadConfig{Type: "json", Operation: "replace"}, wantErr: true},
+		{name: "unknown mode", rule: config.ServerUpstreamOverrideWebsocketPayloadConfig{Mode: "dry-run"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := config.Data{Servers: []config.ServerConfig{{
+				Name: "chat",
+				Upstream: config.ServerUpstreamConfig{
+					Ip:       "10.0.0.1",
+					Port:     3000,
+					Override: config.ServerUpstreamOverrideConfig{WebsocketPayload: []config.ServerUpstreamOverrideWebsocketPayloadConfig{tt.rule}},
+				},
+			}}}
+			wsConfig, err := websocketProxyConfig(data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("websocketProxyConfig() expected an error for %+v", tt.rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("websocketProxyConfig() error = %v", err)
+			}
+			got := wsConfig.Servers[0].Upstream.Override.WebsocketPayload[0]
+			if got.Type != tt.wantType || got.Direction != tt.wantDirection || got.Operation != tt.wantOperation {
+				t.Errorf("rule = type %v, direction %v, operation %v, want %v, %v, %v",
+					got.Type, got.Direction, got.Operation, tt.wantType, tt.wantDirection, tt.wantOperation)
+			}
+		})
+	}
+}
+
+func TestWebsocketProxyConfig_Balance(t *testing.T) {
+	tests := []struct {
+		name         string
+		balance      config.ServerUpstreamBalanceConfig
+		wantStrategy domain.BalanceStrategy
+		wantHashOn   domain.HashSource
+		wantErr      bool
+	}{
+		{name: "default", wantStrategy: domain.RoundRobinBalance},
+		{name: "round robin", balance: config.ServerUpstreamBalanceConfig{Strategy: "round-robin"}, wantStrategy: domain.RoundRobinBalance},
+		{
+			name:         "consistent hash on a cookie",
+			balance:      config.ServerUpstreamBalanceConfig{Strategy: "Consistent-Hash", HashOn: "cookie", HashKey: "session"},
+			wantStrategy: domain.ConsistentHashBalance,
+			wantHashOn:   domain.CookieHash,
+		},
+		{name: "unknown strategy", balance: config.ServerUpstreamBalanceConfig{Strategy: "round-robbin"}, wantErr: true},
+		{name: "unknown hash source", balance: config.ServerUpstreamBalanceConfig{Strategy: "consistent-hash", HashOn: "ip"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := config.Data{Servers: []config.ServerConfig{{
+				Name:     "chat",
+				Upstream: config.ServerUpstreamConfig{Ip: "10.0.0.1", Port: 3000, Balance: tt.balance},
+			}}}
+			wsConfig, err := websocketProxyConfig(data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("websocketProxyConfig() expected an error for %+v", tt.balance)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("websocketProxyConfig() error = %v", err)
+			}
+			got := wsConfig.Servers[0].Upstream.Balance
+			if got.Strategy != tt.wantStrategy || got.HashOn != tt.wantHashOn {
+				t.Errorf("balance = strategy %v, hash on %v, want %v, %v", got.Strategy, got.HashOn, tt.wantStrategy, tt.wantHashOn)
+			}
+		})
+	}
+}
+
+func TestHealthCheckConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		hc       config.ServerUpstreamHealthCheckConfig
+		wantType domain.HealthCheckType
+		wantErr  bool
+	}{
+		{name: "disabled"},
+		{name: "tcp", hc: config.ServerUpstreamHealthCheckConfig{Type: "TCP", Interval: "5s"}, wantType: domain.TcpHealthCheck},
+		{name: "websocket", hc: config.ServerUpstreamHealthCheckConfig{Type: "ws"}, wantType: domain.WebsocketHealthCheck},
+		{name: "unknown type", hc: config.ServerUpstreamHealthCheckConfig{Type: "http"}, wantErr: true},
+		{name: "invalid interval", hc: config.ServerUpstreamHealthCheckConfig{Type: "tcp", Interval: "often"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := healthCheckConfig(tt.hc)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("healthCheckConfig() expected an error for %+v", tt.hc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("healthCheckConfig() error = %v", err)
+			}
+			if got.Type != tt.wantType {
+				t.Errorf("healthCheckConfig() type = %v, want %v", got.Type, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestWebsocketProxyConfig_MatchType(t *testing.T) {
+	tests := []struct {
+		name     string
+		match    config.ServerMatchUrlConfig
+		wantHost domain.FindMatch
+		wantErr  bool
+	}{
+		{name: "exact by default", match: config.ServerMatchUrlConfig{Host: []config.ServerMatchConfig{{Value: "chat.example.com"}}}, wantHost: domain.ExactMatch},
+		{name: "wildcard from the value", match: config.ServerMatchUrlConfig{Host: []config.ServerMatchConfig{{Value: "*.example.com"}}}, wantHost: domain.WildcardMatch},
+		{name: "regex", match: config.ServerMatchUrlConfig{Host: []config.ServerMatchConfig{{Type: "Regex", Value: "^chat"}}}, wantHost: domain.RegexMatch},
+		{name: "unknown path type", match: config.ServerMatchUrlConfig{Path: []config.ServerMatchConfig{{Type: "glob", Value: "/chat/*"}}}, wantErr: true},
+		{name: "unknown host type", match: config.ServerMatchUrlConfig{Host: []config.ServerMatchConfig{{Type: "suffix", Value: ".example.com"}}}, wantErr: true},
+		{name: "unknown header type", match: config.ServerMatchUrlConfig{Headers: []config.ServerMatchKeyConfig{{Key: "X-Tenant", Type: "exactly", Value: "acme"}}}, wantErr: true},
+		{name: "unknown query type", match: config.ServerMatchUrlConfig{Query: []config.ServerMatchKeyConfig{{Key: "room", Type: "number", Value: "1"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := config.Data{Servers: []config.ServerConfig{{
+				Name:     "chat",
+				Match:    tt.match,
+				Upstream: config.ServerUpstreamConfig{Ip: "10.0.0.1", Port: 3000},
+			}}}
+			wsConfig, err := websocketProxyConfig(data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("websocketProxyConfig() expected an error for %+v", tt.match)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("websocketProxyConfig() error = %v", err)
+			}
+			if got := wsConfig.Servers[0].MatchHost[0].Type; got != tt.wantHost {
+				t.Errorf("host match type = %v, want %v", got, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestWebsocketProxyConfig_HeaderAction(t *testing.T) {
+	tests := []struct {
+		action  string
+		want    domain.HeaderAction
+		wantErr bool
+	}{
+		{action: "", want: domain.HeaderSetAction},
+		{action: "set", want: domain.HeaderSetAction},
+		{action: "Set-If-Absent", want: domain.HeaderSetIfAbsentAction},
+		{action: "remove", want: domain.HeaderRemoveAction},
+		{action: "delete", wantErr: true},
+		{action: "append", wantErr: true},
+	}
+	for _, tt := range tests {
+		header := []config.ServerUpstreamOverrideHeadersConfig{{Key: "X-Tag", Value: "proxy", Action: tt.action}}
+		for _, override := range []config.ServerUpstreamOverrideConfig{{Headers: header}, {ResponseHeaders: header}} {
+			data := config.Data{Servers: []config.ServerConfig{{
+				Name:     "chat",
+				Upstream: config.ServerUpstreamConfig{Ip: "10.0.0.1", Port: 3000, Override: override},
+			}}}
+			wsConfig, err := websocketProxyConfig(data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("websocketProxyConfig() expected an error for the action %q", tt.action)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("websocketProxyConfig() error = %v", err)
+			}
+			got := wsConfig.Servers[0].Upstream.Override
+			rules := append(got.Header, got.ResponseHeader...)
+			if len(rules) != 1 || rules[0].Action != tt.want {
+				t.Errorf("header rules of the action %q = %+v, want %v", tt.action, rules, tt.want)
+			}
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package cmd
 
+import (
+	"net"
+
+	wsUsecaseProxy "github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/ws"
+)
+
 type RunBootstrap interface {
 	Run() error
 }
@@ -7,3 +13,19 @@ type RunBootstrap interface {
 type ShutdownBootstrap interface {
 	Shutdown() error
 }
+
+type ListenBootstrap interface {
+	// Listen binds the listener before it runs, taking over the socket of the replaced one if any
+	Listen(replaced net.Listener) error
+	Listener() net.Listener
+}
+
+type DeliveryBootstrap interface {
+	ListenBootstrap
+	RunBootstrap
+	ShutdownBootstrap
+}
+
+type ReloadWsProxyBootstrap interface {
+	Reload(config wsUsecaseProxy.Config) error
+}
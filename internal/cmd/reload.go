@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/config"
+	httpDeliveryProxy "github.com/poyaz/reverse-ws-modifier/internal/app/proxy/delivery/http"
+)
+
+const defaultWatchInterval = 2 * time.Second
+
+// reloadConfig applies the config file again. Nothing changes if any part of the new
+// config is rejected, and the established websocket sessions are never interrupted.
+func reloadConfig(cfg *config.Config) error {
+	if err := applyConfig(cfg); err != nil {
+		logger.WithError(err).Error("Reload config failed")
+		return err
+	}
+
+	return nil
+}
+
+func applyConfig(cfg *config.Config) error {
+	data, err := cfg.Reload()
+	if err != nil {
+		return err
+	}
+	wsConfig, err := websocketProxyConfig(data)
+	if err != nil {
+		return err
+	}
+	listeners, listenerConfig, err := deliveryConfig(data)
+	if err != nil {
+		return err
+	}
+
+	// The handlers of the new and changed listeners are built first to validate their tls config
+	pending := make(map[listener]DeliveryBootstrap)
+	for _, k := range listeners {
+		if current, ok := deliveryHandlers[k]; ok && reflect.DeepEqual(current.config, listenerConfig[k]) {
+			continue
+		}
+		httpDelivery, err := httpDeliveryProxy.NewHandler(wsUsecaseProxyImp, logger, listenerConfig[k])
+		if err != nil {
+			return err
+		}
+		pending[k] = httpDelivery
+	}
+
+	// They are bound before anything changes, so a port in use rejects the whole config
+	for k, httpDelivery := range pending {
+		var replaced net.Listener
+		if current, ok := deliveryHandlers[k]; ok {
+			replaced = current.handler.Listener()
+		}
+		if err := httpDelivery.Listen(replaced); err != nil {
+			closePending(pending)
+			return err
+		}
+	}
+
+	if err := wsUsecaseProxyReloader.Reload(wsConfig); err != nil {
+		closePending(pending)
+		return err
+	}
+
+	// Shutting down a listener leaves its hijacked websocket connections running
+	for k, dh := range deliveryHandlers {
+		_, keep := listenerConfig[k]
+		if _, changed := pending[k]; keep && !changed {
+			continue
+		}
+		if err := dh.handler.Shutdown(); err != nil {
+			logger.Error(err)
+		}
+		delete(deliveryHandlers, k)
+	}
+	for _, k := range listeners {
+		httpDelivery, ok := pending[k]
+		if !ok {
+			continue
+		}
+		deliveryHandlers[k] = deliveryHandler{config: listenerConfig[k], handler: httpDelivery}
+
+		go func(handler RunBootstrap) {
+			if err := handler.Run(); err != nil {
+				logger.Error(err)
+			}
+		}(httpDelivery)
+	}
+
+	cfg.Data = data
+	setLogLevel(data.Global.LogLevel)
+	logger.WithFields(logrus.Fields{"config": cfg.Config, "listeners": len(listeners)}).Info("Config reloaded")
+
+	return nil
+}
+
+// closePending releases the listeners bound for a rejected config
+func closePending(pending map[listener]DeliveryBootstrap) {
+	for _, handler := range pending {
+		if err := handler.Shutdown(); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// watchConfig signals when the modification time or the size of the config file changes
+func watchConfig(cfg *config.Config) (<-chan struct{}, error) {
+	changed := make(chan struct{}, 1)
+	interval := defaultWatchInterval
+	if cfg.Data.Global.WatchInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(cfg.Data.Global.WatchInterval); err != nil {
+			return nil, err
+		}
+	}
+	if interval <= 0 {
+		return changed, nil
+	}
+
+	last, _ := os.Stat(cfg.Config)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(cfg.Config)
+			if err != nil {
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changed, nil
+}
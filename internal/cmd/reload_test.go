@@ -0,0 +1,204 @@
+//go:build unit
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/config"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+	infraWs "github.com/poyaz/reverse-ws-modifier/internal/infra/ws"
+)
+
+type testServer struct {
+	name          string
+	port          int
+	proxyProtocol bool
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func writeConfig(t *testing.T, file string, servers ...testServer) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("global:\n  logLevel: panic\n  watchInterval: \"0\"\nservers:\n")
+	for _, s := range servers {
+		fmt.Fprintf(&b, "  - name: %q\n    ip: \"127.0.0.1\"\n    port: %d\n", s.name, s.port)
+		if s.proxyProtocol {
+			b.WriteString("    proxyProtocol:\n      enable: true\n      trustedSources:\n        - \"10.0.0.0/8\"\n")
+		}
+		fmt.Fprintf(&b, "    match:\n      path:\n        - type: \"prefix\"\n          value: \"/%s\"\n", s.name)
+		b.WriteString("    upstream:\n      ip: \"127.0.0.1\"\n      port: 1\n")
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTestProxy boots the usecase and the listeners of the config file like Run does
+func startTestProxy(t *testing.T, file string) *config.Config {
+	t.Helper()
+	logger = logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	cfg := &config.Config{Config: file}
+	data, err := cfg.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Data = data
+
+	wsInfra, err := infraWs.NewWsInfra()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsInfraProxyImp = wsInfra
+	deliveryHandlers = make(map[listener]deliveryHandler)
+	shutdownHandlers = nil
+	if err := runWebsocketProxyUsecase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDelivery(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, dh := range deliveryHandlers {
+			_ = dh.handler.Shutdown()
+		}
+		for _, sh := range shutdownHandlers {
+			_ = sh.Shutdown()
+		}
+	})
+
+	return cfg
+}
+
+func routeNames() []string {
+	var names []string
+	for _, r := range wsUsecaseProxyAdmin.Routes() {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
+// assertServing checks the listener answers http requests
+func assertServing(t *testing.T, port int) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatalf("listener on %d is not serving: %v", port, err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestApplyConfig_Listeners(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	p1, p2 := freePort(t), freePort(t)
+	writeConfig(t, file, testServer{name: "a", port: p1})
+	cfg := startTestProxy(t, file)
+	assertServing(t, p1)
+	first := deliveryHandlers[listener{ip: "127.0.0.1", port: p1}].handler
+
+	writeConfig(t, file, testServer{name: "a", port: p1}, testServer{name: "b", port: p2})
+	if err := applyConfig(cfg); err != nil {
+		t.Fatalf("applyConfig() error = %v", err)
+	}
+	if len(deliveryHandlers) != 2 {
+		t.Fatalf("listeners = %d, want 2", len(deliveryHandlers))
+	}
+	if deliveryHandlers[listener{ip: "127.0.0.1", port: p1}].handler != first {
+		t.Error("unchanged listener was restarted")
+	}
+	assertServing(t, p2)
+
+	// A changed listener takes over the socket of the one it replaces
+	writeConfig(t, file, testServer{name: "a", port: p1, proxyProtocol: true})
+	if err := applyConfig(cfg); err != nil {
+		t.Fatalf("applyConfig() error = %v", err)
+	}
+	if len(deliveryHandlers) != 1 {
+		t.Fatalf("listeners = %d, want 1", len(deliveryHandlers))
+	}
+	if deliveryHandlers[listener{ip: "127.0.0.1", port: p1}].handler == first {
+		t.Error("changed listener was not replaced")
+	}
+	assertServing(t, p1)
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p2)); err == nil {
+		t.Error("removed listener is still accepting connections")
+	}
+}
+
+func TestApplyConfig_PortInUse(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	p1, p2 := freePort(t), freePort(t)
+	writeConfig(t, file, testServer{name: "a", port: p1})
+	cfg := startTestProxy(t, file)
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	writeConfig(t, file,
+		testServer{name: "a", port: p1},
+		testServer{name: "b", port: p2},
+		testServer{name: "c", port: busy.Addr().(*net.TCPAddr).Port},
+	)
+	if err := applyConfig(cfg); err == nil {
+		t.Fatal("applyConfig() expected an error for a port in use")
+	}
+
+	if names := routeNames(); len(names) != 1 || names[0] != "a" {
+		t.Errorf("routes = %v, want the config before the reload", names)
+	}
+	if len(deliveryHandlers) != 1 {
+		t.Errorf("listeners = %d, want 1", len(deliveryHandlers))
+	}
+	assertServing(t, p1)
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p2))
+	if err != nil {
+		t.Errorf("listener bound for the rejected config was not released: %v", err)
+	} else {
+		_ = l.Close()
+	}
+}
+
+func TestRequestReload_ShuttingDown(t *testing.T) {
+	shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+	defer func() {
+		shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+	}()
+	cancelShutdown()
+
+	// Nothing serves the reload requests, as in Run once the shutdown started
+	done := make(chan error, 1)
+	go func() { done <- requestReload(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, domain.ErrShuttingDown) {
+			t.Errorf("requestReload() error = %v, want %v", err, domain.ErrShuttingDown)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("requestReload() blocked while shutting down")
+	}
+}
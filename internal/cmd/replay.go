@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/poyaz/reverse-ws-modifier/config"
+	wsUsecaseProxy "github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/ws"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+	infraWs "github.com/poyaz/reverse-ws-modifier/internal/infra/ws"
+)
+
+// maxPrintedPayload bounds the payloads printed in the differences
+const maxPrintedPayload = 256
+
+var ErrReplayDiff = errors.New("the replay differs from the recording")
+
+// Replay sends the recorded sessions again through the rules of the config and prints the
+// differences with the recording. An error is returned if any session differs, so the
+// command fails in a regression test.
+func Replay(cfg *config.Config) error {
+	logger = logrus.New()
+	logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	setLogLevel(cfg.Data.Global.LogLevel)
+
+	messages, err := infraWs.ReadRecords(cfg.Replay.File)
+	if err != nil {
+		return err
+	}
+	sessions := groupSessions(messages, cfg.Replay.Session)
+	if len(sessions) == 0 {
+		return fmt.Errorf("no recorded session to replay in %s", cfg.Replay.File)
+	}
+
+	wsInfra, err := infraWs.NewWsInfra()
+	if err != nil {
+		return err
+	}
+	wsConfig, err := websocketProxyConfig(cfg.Data)
+	if err != nil {
+		return err
+	}
+	// Only the few replayed sessions connect, the upstreams are not probed
+	wsConfig.NoHealthCheck = true
+	wsUsecase, err := wsUsecaseProxy.NewWs(wsInfra, nil, logger, wsConfig)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = wsUsecase.Shutdown() }()
+
+	opt := domain.ReplayOption{
+		Upstream: cfg.Replay.Upstream,
+		Path:     cfg.Replay.Path,
+		Speed:    cfg.Replay.Speed,
+		Wait:     cfg.Replay.Wait,
+	}
+	failed := 0
+	for _, session := range sessions {
+		report, err := wsUsecase.Replay(session, opt)
+		if err != nil {
+			logger.WithError(err).WithField("session", session[0].Session).Error("Replay failed")
+			failed++
+			continue
+		}
+		printReport(os.Stdout, report)
+		if len(report.Diffs) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d sessions", ErrReplayDiff, failed, len(sessions))
+	}
+
+	return nil
+}
+
+// groupSessions splits the messages by session, in the order the sessions were recorded
+func groupSessions(messages []domain.RecordedMessage, only string) [][]domain.RecordedMessage {
+	var sessions [][]domain.RecordedMessage
+	index := make(map[string]int)
+	for _, m := range messages {
+		if only != "" && m.Session != only {
+			continue
+		}
+		i, ok := index[m.Session]
+		if !ok {
+			i = len(sessions)
+			index[m.Session] = i
+			sessions = append(sessions, nil)
+		}
+		sessions[i] = append(sessions[i], m)
+	}
+
+	return sessions
+}
+
+func printReport(w io.Writer, report domain.ReplayReport) {
+	status := "ok"
+	if len(report.Diffs) > 0 {
+		status = fmt.Sprintf("%d differences", len(report.Diffs))
+	}
+	_, _ = fmt.Fprintf(w, "session %s (route %s): sent %d, received %d, %s\n",
+		report.Session, report.Route, report.Sent, report.Received, status)
+
+	for _, d := range report.Diffs {
+		direction := "client"
+		if d.Direction == domain.ServerDirection {
+			direction = "server"
+		}
+		switch {
+		case d.Missing:
+			_, _ = fmt.Fprintf(w, "  %s #%d missing: %s\n", direction, d.Index, printablePayload(d.Expected))
+		case d.Extra:
+			_, _ = fmt.Fprintf(w, "  %s #%d extra: %s\n", direction, d.Index, printablePayload(d.Actual))
+		default:
+			_, _ = fmt.Fprintf(w, "  %s #%d expected: %s\n", direction, d.Index, printablePayload(d.Expected))
+			_, _ = fmt.Fprintf(w, "  %s #%d actual:   %s\n", direction, d.Index, printablePayload(d.Actual))
+		}
+	}
+}
+
+func printablePayload(payload []byte) string {
+	if len(payload) > maxPrintedPayload {
+		return fmt.Sprintf("%q... (%d bytes)", payload[:maxPrintedPayload], len(payload))
+	}
+
+	return fmt.Sprintf("%q", payload)
+}
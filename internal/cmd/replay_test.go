@@ -0,0 +1,61 @@
+//go:build unit
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/config"
+)
+
+func TestReplay_RecordedUri(t *testing.T) {
+	uris := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uris <- r.URL.RequestURI()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	yaml := fmt.Sprintf("global:\n  logLevel: panic\nservers:\n  - name: \"chat\"\n    ip: \"127.0.0.1\"\n    port: %d\n"+
+		"    match:\n      path:\n        - type: \"prefix\"\n          value: \"/chat\"\n"+
+		"    upstream:\n      scheme: \"ws\"\n      ip: %q\n      port: %s\n", freePort(t), u.Hostname(), u.Port())
+	if err := os.WriteFile(configFile, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	recordFile := filepath.Join(dir, "record.jsonl")
+	recording := `{"time":"2024-01-01T00:00:00Z","session":"1","route":"chat","event":"open","request":{"remoteAddr":"192.0.2.1:5000","host":"chat.example.com","uri":"/chat/lobby?token=abc","header":{}}}` + "\n" +
+		`{"time":"2024-01-01T00:00:01Z","session":"1","route":"chat","direction":"client","opcode":"text","payload":"hi"}` + "\n"
+	if err := os.WriteFile(recordFile, []byte(recording), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without --path the recorded request uri is replayed
+	cfg := config.NewConfig()
+	if err := cfg.ParseFlags([]string{"--config", configFile, config.ReplayCommand, "--file", recordFile, "--wait", "10ms"}); err != nil {
+		t.Fatalf("ParseFlags() error = %v", err)
+	}
+	if err := Replay(cfg); !errors.Is(err, ErrReplayDiff) {
+		t.Fatalf("Replay() error = %v, want the refused session reported (%v)", err, ErrReplayDiff)
+	}
+	select {
+	case got := <-uris:
+		if got != "/chat/lobby?token=abc" {
+			t.Errorf("upstream request uri = %q, want the recorded one", got)
+		}
+	default:
+		t.Fatal("Replay() never dialed the upstream")
+	}
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrRuleNotFound     = errors.New("rule not found")
+	ErrInvalidCloseCode = errors.New("invalid close code")
+	ErrShuttingDown     = errors.New("the proxy is shutting down")
+)
+
+type RouteInfo struct {
+	Name string
+	// Listener is the ip:port the route is restricted to, empty for every listener
+	Listener  string
+	Priority  int
+	Paths     []RoutePathInfo
+	Scheme    string
+	Upstreams []UpstreamInfo
+	Rules     []RuleInfo
+}
+
+type RoutePathInfo struct {
+	Type  FindMatch
+	Value string
+}
+
+type UpstreamInfo struct {
+	Addr      string
+	Weight    int
+	Available bool
+	// Active is the number of sessions proxied to the upstream
+	Active int64
+}
+
+type RuleInfo struct {
+	Name    string
+	Enabled bool
+	Mode    RuleMode
+}
+
+type SessionInfo struct {
+	Id         string
+	ClientAddr string
+	Route      string
+	Upstream   string
+	// ClientBytes and UpstreamBytes are the payload bytes received from each side
+	ClientBytes   uint64
+	UpstreamBytes uint64
+	StartedAt     time.Time
+}
+
+type WsProxyAdminUsecase interface {
+	Routes() []RouteInfo
+	Sessions() []SessionInfo
+	CloseSession(id string, code uint16) error
+	ToggleRule(route string, rule string, enabled bool) error
+}
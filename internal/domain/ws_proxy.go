@@ -10,8 +10,51 @@ const (
 	ExactMatch FindMatch = iota + 1
 	RegexMatch
 	PrefixMatch
+	BytesMatch
+	BinaryRegexMatch
+	JsonMatch
+	WildcardMatch
 )
 
+type JsonOperation int
+
+const (
+	JsonSetOperation JsonOperation = iota + 1
+	JsonDeleteOperation
+	JsonRenameOperation
+	JsonAppendOperation
+)
+
+type HeaderAction int
+
+const (
+	HeaderSetAction HeaderAction = iota + 1
+	HeaderAddAction
+	HeaderRemoveAction
+	HeaderSetIfAbsentAction
+)
+
+// RuleMode tells if a payload rule modifies the messages or only reports what it would change
+type RuleMode int
+
+const (
+	EnforceMode RuleMode = iota + 1
+	ShadowMode
+)
+
+type Direction int
+
+const (
+	ClientDirection Direction = 1 << iota
+	ServerDirection
+	BothDirection = ClientDirection | ServerDirection
+)
+
+// Has checks if the direction includes the given one
+func (d Direction) Has(o Direction) bool {
+	return d&o == o
+}
+
 type WsProxyTable struct {
 	Type FindMatch
 	Host string
@@ -20,6 +63,12 @@ type WsProxyTable struct {
 }
 
 type WsReqInfo struct {
+	// Listener is the ip:port of the listener that accepted the request
+	Listener string
+	// RemoteAddr is the ip:port of the client
+	RemoteAddr string
+	// Tls is set if the client connected over tls
+	Tls    bool
 	Host   string
 	Header http.Header
 	URI    string
@@ -30,8 +79,9 @@ type WsProxyTableUsecase interface {
 }
 
 type ModifierEvent struct {
-	On      OpcodeType
-	Handler ModifierFunc
+	On        OpcodeType
+	Direction Direction
+	Handler   ModifierFunc
 }
 
 type ModifierFunc func(frame Frame) (Frame, error)
@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"net/http"
+	"time"
+)
+
+// RecordedRequest is the client handshake of a recorded session
+type RecordedRequest struct {
+	RemoteAddr string
+	Host       string
+	URI        string
+	Header     http.Header
+}
+
+// RecordedMessage is a message of a recorded session, as received and as forwarded
+type RecordedMessage struct {
+	Time      time.Time
+	Session   string
+	Route     string
+	Direction Direction
+	Opcode    OpcodeType
+	Payload   []byte
+	Forwarded []byte
+	// Truncated is set if the recording kept only the start of the payloads
+	Truncated bool
+	// Request is only set on the record opening the session, which holds no message
+	Request *RecordedRequest
+}
+
+type ReplayOption struct {
+	// Upstream is the ws:// or wss:// url replayed against, the route upstream if empty
+	Upstream string
+	// Path replaces the recorded request uri rewritten by the route into the upstream one
+	Path string
+	// Speed scales the recorded delays between the client messages, 0 sends them at once
+	Speed float64
+	// Wait is how long the upstream replies are awaited after the last client message
+	Wait time.Duration
+}
+
+type ReplayDiff struct {
+	Direction Direction
+	// Index is the position of the message among the ones of its direction
+	Index    int
+	Expected []byte
+	Actual   []byte
+	// Missing and Extra are set if only the recording or only the replay has the message
+	Missing bool
+	Extra   bool
+}
+
+type ReplayReport struct {
+	Session  string
+	Route    string
+	Sent     int
+	Received int
+	Diffs    []ReplayDiff
+}
+
+type WsProxyReplayUsecase interface {
+	Replay(messages []RecordedMessage, opt ReplayOption) (ReplayReport, error)
+}
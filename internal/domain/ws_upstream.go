@@ -0,0 +1,31 @@
+package domain
+
+import "errors"
+
+// ErrUpstreamRefused is reported when the upstream answers the handshake with a status
+// below 500: the upstream is alive but the connection is rejected
+var ErrUpstreamRefused = errors.New("upstream refused the handshake")
+
+type BalanceStrategy int
+
+const (
+	RoundRobinBalance BalanceStrategy = iota + 1
+	LeastConnectionsBalance
+	RandomBalance
+	ConsistentHashBalance
+)
+
+type HashSource int
+
+const (
+	HeaderHash HashSource = iota + 1
+	CookieHash
+	QueryHash
+)
+
+type HealthCheckType int
+
+const (
+	TcpHealthCheck HealthCheckType = iota + 1
+	WebsocketHealthCheck
+)
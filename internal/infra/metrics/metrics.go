@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+	infraWs "github.com/poyaz/reverse-ws-modifier/internal/infra/ws"
+)
+
+const namespace = "reverse_ws"
+
+var _ adapter.MetricsAdapter = (*metricsInfra)(nil)
+var _ infraWs.Metrics = (*metricsInfra)(nil)
+
+type metricsInfra struct {
+	registry *prometheus.Registry
+
+	connectionsAccepted *prometheus.CounterVec
+	connectionsRejected *prometheus.CounterVec
+	sessionsActive      prometheus.Gauge
+	sessionDuration     prometheus.Histogram
+	handshakeDuration   *prometheus.HistogramVec
+	frames              *prometheus.CounterVec
+	frameBytes          *prometheus.CounterVec
+	modifierHits        *prometheus.CounterVec
+	modifierErrors      *prometheus.CounterVec
+	modifierShadowHits  *prometheus.CounterVec
+	closeCodes          *prometheus.CounterVec
+	recordsDropped      *prometheus.CounterVec
+}
+
+func NewMetricsInfra() (*metricsInfra, error) {
+	m := &metricsInfra{
+		registry: prometheus.NewRegistry(),
+		connectionsAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_accepted_total",
+			Help:      "Connections routed and upgraded by the upstream.",
+		}, []string{"route"}),
+		connectionsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_rejected_total",
+			Help:      "Connections refused because no route matched, no upstream was available, the upstream handshake failed or the upstream refused it.",
+		}, []string{"route", "reason"}),
+		sessionsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sessions_active",
+			Help:      "Websocket sessions currently proxied.",
+		}),
+		sessionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_duration_seconds",
+			Help:      "Lifetime of the websocket sessions.",
+			Buckets:   []float64{1, 10, 60, 300, 1800, 3600, 4 * 3600, 24 * 3600},
+		}),
+		handshakeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_handshake_duration_seconds",
+			Help:      "Time to dial the upstream and complete its websocket handshake.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"upstream", "result"}),
+		frames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frames_total",
+			Help:      "Frames received from the clients and the upstreams.",
+		}, []string{"direction", "opcode"}),
+		frameBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frame_bytes_total",
+			Help:      "Payload bytes of the frames received from the clients and the upstreams.",
+		}, []string{"direction", "opcode"}),
+		modifierHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "modifier_hits_total",
+			Help:      "Messages modified by a payload rule.",
+		}, []string{"route", "rule"}),
+		modifierErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "modifier_errors_total",
+			Help:      "Payload rules that failed, closing the session unless the rule is in shadow mode.",
+		}, []string{"route", "rule"}),
+		modifierShadowHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "modifier_shadow_hits_total",
+			Help:      "Messages a payload rule in shadow mode would have modified, forwarded unmodified.",
+		}, []string{"route", "rule"}),
+		closeCodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "close_codes_total",
+			Help:      "Close frames received from the clients and the upstreams by status code.",
+		}, []string{"direction", "code"}),
+		recordsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "record_dropped_total",
+			Help:      "Messages left out of the recording because the writer fell behind or the file could not be opened again.",
+		}, []string{"route"}),
+	}
+
+	err := registerAll(
+		m.registry,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connectionsAccepted,
+		m.connectionsRejected,
+		m.sessionsActive,
+		m.sessionDuration,
+		m.handshakeDuration,
+		m.frames,
+		m.frameBytes,
+		m.modifierHits,
+		m.modifierErrors,
+		m.modifierShadowHits,
+		m.closeCodes,
+		m.recordsDropped,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func registerAll(registry *prometheus.Registry, cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler serves the metrics in the prometheus text format
+func (m *metricsInfra) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metricsInfra) ConnectionAccepted(route string) {
+	m.connectionsAccepted.WithLabelValues(route).Inc()
+}
+
+func (m *metricsInfra) ConnectionRejected(route string, reason string) {
+	m.connectionsRejected.WithLabelValues(route, reason).Inc()
+}
+
+func (m *metricsInfra) ModifierHit(route string, rule string) {
+	m.modifierHits.WithLabelValues(route, rule).Inc()
+}
+
+func (m *metricsInfra) ModifierError(route string, rule string) {
+	m.modifierErrors.WithLabelValues(route, rule).Inc()
+}
+
+func (m *metricsInfra) ModifierShadowHit(route string, rule string) {
+	m.modifierShadowHits.WithLabelValues(route, rule).Inc()
+}
+
+func (m *metricsInfra) SessionOpened() {
+	m.sessionsActive.Inc()
+}
+
+func (m *metricsInfra) SessionClosed(duration time.Duration) {
+	m.sessionsActive.Dec()
+	m.sessionDuration.Observe(duration.Seconds())
+}
+
+func (m *metricsInfra) UpstreamHandshake(upstream string, duration time.Duration, err error) {
+	result := "success"
+	if errors.Is(err, domain.ErrUpstreamRefused) {
+		result = "refused"
+	} else if err != nil {
+		result = "error"
+	}
+	m.handshakeDuration.WithLabelValues(upstream, result).Observe(duration.Seconds())
+}
+
+func (m *metricsInfra) Frame(direction domain.Direction, opcode domain.OpcodeType, size int) {
+	d, o := directionLabel(direction), opcodeLabel(opcode)
+	m.frames.WithLabelValues(d, o).Inc()
+	m.frameBytes.WithLabelValues(d, o).Add(float64(size))
+}
+
+func (m *metricsInfra) Close(direction domain.Direction, code uint16) {
+	m.closeCodes.WithLabelValues(directionLabel(direction), strconv.Itoa(int(code))).Inc()
+}
+
+func (m *metricsInfra) RecordDropped(route string) {
+	m.recordsDropped.WithLabelValues(route).Inc()
+}
+
+func directionLabel(direction domain.Direction) string {
+	if direction == domain.ServerDirection {
+		return "server"
+	}
+
+	return "client"
+}
+
+func opcodeLabel(opcode domain.OpcodeType) string {
+	switch opcode {
+	case domain.ContinuationOpcode:
+		return "continuation"
+	case domain.TextOpcode:
+		return "text"
+	case domain.BinaryOpcode:
+		return "binary"
+	case domain.CloseOpcode:
+		return "close"
+	case domain.PingOpcode:
+		return "ping"
+	case domain.PongOpcode:
+		return "pong"
+	}
+
+	return "reserved"
+}
@@ -0,0 +1,169 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+var _ adapter.WsClient = (*wsClient)(nil)
+
+// wsClient is a websocket connection opened by the proxy itself, as the client of the upstream
+type wsClient struct {
+	ws        *wsConn
+	assembler *messageAssembler
+}
+
+// Dial opens a websocket connection to the upstream with the headers and the options
+// of a proxied connection
+func (w *wsInfra) Dial(addr string, rewriteHost string, opt adapter.WsOption, header http.Header) (adapter.WsClient, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, ErrFormatAddr
+	}
+	if u.Scheme != WsScheme && u.Scheme != WssScheme {
+		return nil, ErrFormatAddr
+	}
+	tlsc := opt.TLS
+	if u.Scheme == WssScheme && tlsc == nil {
+		tlsc = &tls.Config{}
+	}
+
+	var proxyHeaderBytes []byte
+	if opt.ProxyProtocol != 0 {
+		proxyHeaderBytes = proxyHeader(opt.ProxyProtocol, nil, nil)
+	}
+	conn, err := dialUpstream(u.Scheme, u.Host, tlsc, handshakeTimeout, proxyHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ws, err := clientHandshake(conn, u, rewriteHost, header, opt.Deflate)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return &wsClient{ws: ws, assembler: newMessageAssembler(opt.MaxMessageSize)}, nil
+}
+
+// clientHandshake sends the upgrade request on the connection and checks the upstream accepted it
+func clientHandshake(conn net.Conn, u *url.URL, rewriteHost string, header http.Header, deflate bool) (*wsConn, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+u.Host+u.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if rewriteHost != "" {
+		req.Host = rewriteHost
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	if deflate {
+		req.Header.Set(extensionsHeader, deflateExtension)
+	}
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	bufrw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	resp, err := http.ReadResponse(bufrw.Reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("upstream handshake error: " + resp.Status)
+	}
+	if err = checkHandshakeResponse(req, resp); err != nil {
+		return nil, err
+	}
+	params, err := parseDeflateResponse(resp.Header, deflate)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &wsConn{conn: conn, bufrw: bufrw, header: resp.Header, status: 1000, role: clientRole}
+	if params != nil {
+		ws.inflater, ws.deflater = params.newClientCodec()
+	}
+
+	return ws, nil
+}
+
+// Send writes the message as a single frame
+func (c *wsClient) Send(opcode domain.OpcodeType, payload []byte) error {
+	f := domain.Frame{Opcode: opcode, Payload: payload, Length: uint64(len(payload))}
+	if c.ws.deflater != nil && !f.IsControl() {
+		compressed, err := c.ws.deflater.deflate(payload)
+		if err != nil {
+			return err
+		}
+		f.Payload, f.Length, f.Reserved = compressed, uint64(len(compressed)), compressedBit
+	}
+
+	return c.ws.send(f)
+}
+
+// Receive returns the next data message, answering the pings on the way. It returns
+// io.EOF once the upstream closed the connection.
+func (c *wsClient) Receive() (domain.OpcodeType, []byte, error) {
+	for {
+		f, err := c.ws.recv(c.assembler.remaining())
+		if err != nil {
+			return 0, nil, err
+		}
+		switch f.Opcode {
+		case domain.CloseOpcode:
+			_ = c.ws.close()
+			return 0, nil, io.EOF
+		case domain.PingOpcode:
+			if err = c.ws.send(f.Pong()); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case domain.PongOpcode:
+			continue
+		}
+
+		msg, _, err := c.assembler.push(f)
+		if err != nil {
+			return 0, nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.frame.Reserved&compressedBit != 0 {
+			payload, err := c.ws.inflater.inflate(msg.frame.Payload, c.assembler.maxSize)
+			if err != nil {
+				return 0, nil, err
+			}
+			msg.frame.Payload = payload
+		}
+
+		return msg.frame.Opcode, msg.frame.Payload, nil
+	}
+}
+
+// Close sends a normal closure and closes the connection without waiting for the reply
+func (c *wsClient) Close() error {
+	return c.ws.close()
+}
@@ -0,0 +1,10 @@
+package ws
+
+import "time"
+
+type Config struct {
+	// DrainTimeout is how long the shutdown waits for the sessions to close after going away
+	DrainTimeout time.Duration
+	// Metrics records the sessions and the frames, nil to record nothing
+	Metrics Metrics
+}
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"bufio"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"io"
 	"math"
 	"net/http"
+	"sync"
 	"unicode/utf8"
 )
 
@@ -26,15 +28,27 @@ var closeCodes map[int]string = map[int]string{
 	1011: "UnexpectedError",
 }
 
+type connRole int
+
+const (
+	serverRole connRole = iota // the proxy is the server side of the leg, facing the client
+	clientRole                 // the proxy is the client side of the leg, facing the upstream
+)
+
 type closeConn interface {
 	Close() error
 }
 
 type wsConn struct {
-	conn   closeConn
-	bufrw  *bufio.ReadWriter
-	header http.Header
-	status uint16
+	conn     closeConn
+	bufrw    *bufio.ReadWriter
+	header   http.Header
+	status   uint16
+	role     connRole
+	inflater *flateReader
+	deflater *flateWriter
+	// wmu serializes the writes of the pipe and of the shutdown going away close frame
+	wmu sync.Mutex
 }
 
 func (ws *wsConn) read(size int) ([]byte, error) {
@@ -52,6 +66,9 @@ func (ws *wsConn) read(size int) ([]byte, error) {
 		temp := make([]byte, sz)
 
 		n, err := ws.bufrw.Read(temp)
+		if err == io.EOF && n == 0 {
+			return data, err
+		}
 		if err != nil && err != io.EOF {
 			return data, err
 		}
@@ -63,6 +80,9 @@ func (ws *wsConn) read(size int) ([]byte, error) {
 }
 
 func (ws *wsConn) write(data []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
 	if _, err := ws.bufrw.Write(data); err != nil {
 		return err
 	}
@@ -70,10 +90,14 @@ func (ws *wsConn) write(data []byte) error {
 }
 
 func (ws *wsConn) validate(frame *domain.Frame) error {
-	if !frame.IsMasked {
+	if ws.role == serverRole && !frame.IsMasked {
 		ws.status = 1002
 		return errors.New("protocol error: unmasked client Frame")
 	}
+	if ws.role == clientRole && frame.IsMasked {
+		ws.status = 1002
+		return errors.New("protocol error: masked server Frame")
+	}
 	if frame.IsControl() && (frame.Length > 125 || frame.IsFragment) {
 		ws.status = 1002
 		return errors.New("protocol error: all control frames MUST have a payload length of 125 bytes or less and MUST NOT be fragmented")
@@ -82,11 +106,11 @@ func (ws *wsConn) validate(frame *domain.Frame) error {
 		ws.status = 1002
 		return errors.New("protocol error: opcode " + fmt.Sprintf("%x", frame.Opcode) + " is reserved")
 	}
-	if frame.Reserved > 0 {
+	if frame.Reserved > 0 && !ws.isCompressed(frame) {
 		ws.status = 1002
 		return errors.New("protocol error: RSV " + fmt.Sprintf("%x", frame.Reserved) + " is reserved")
 	}
-	if frame.Opcode == 1 && !frame.IsFragment && !utf8.Valid(frame.Payload) {
+	if frame.Opcode == 1 && !frame.IsFragment && frame.Reserved == 0 && !utf8.Valid(frame.Payload) {
 		ws.status = 1007
 		return errors.New("wrong code: invalid UTF-8 text message ")
 	}
@@ -110,8 +134,16 @@ func (ws *wsConn) validate(frame *domain.Frame) error {
 	return nil
 }
 
-// recv receives data and returns a Frame
-func (ws *wsConn) recv() (domain.Frame, error) {
+// isCompressed checks if the Frame starts a message compressed with the negotiated permessage-deflate
+func (ws *wsConn) isCompressed(frame *domain.Frame) bool {
+	return ws.inflater != nil &&
+		frame.Reserved == compressedBit &&
+		(frame.Opcode == domain.TextOpcode || frame.Opcode == domain.BinaryOpcode)
+}
+
+// recv receives data and returns a Frame. A data frame longer than limit is rejected before
+// its payload is read, the caller passes what is left of the max message size.
+func (ws *wsConn) recv(limit int) (domain.Frame, error) {
 	f := domain.Frame{}
 	head, err := ws.read(2)
 	if err != nil {
@@ -138,63 +170,97 @@ func (ws *wsConn) recv() (domain.Frame, error) {
 		if err != nil {
 			return f, err
 		}
-		length = uint64(binary.BigEndian.Uint64(data))
+		length = binary.BigEndian.Uint64(data)
+		if length&(1<<63) != 0 {
+			ws.status = 1002
+			return f, ErrFrameLength
+		}
 	}
-	mask, err := ws.read(4)
-	if err != nil {
-		return f, err
+	if f.IsControl() && length > 125 {
+		ws.status = 1002
+		return f, errors.New("protocol error: all control frames MUST have a payload length of 125 bytes or less and MUST NOT be fragmented")
+	}
+	if !f.IsControl() && length > uint64(limit) {
+		ws.status = 1009
+		return f, ErrFrameTooLarge
+	}
+	var mask []byte
+	if f.IsMasked {
+		mask, err = ws.read(4)
+		if err != nil {
+			return f, err
+		}
 	}
 	f.Length = length
 
-	payload, err := ws.read(int(length)) // possible data loss
+	payload, err := ws.read(int(length))
 	if err != nil {
 		return f, err
 	}
 
-	for i := uint64(0); i < length; i++ {
-		payload[i] ^= mask[i%4]
+	if f.IsMasked {
+		for i := uint64(0); i < length; i++ {
+			payload[i] ^= mask[i%4]
+		}
 	}
 	f.Payload = payload
 	err = ws.validate(&f)
 	return f, err
 }
 
-// send sends a Frame
+// send sends a Frame, masked with a fresh key if the proxy is the client side of the leg
 func (ws *wsConn) send(frame domain.Frame) error {
 	data := make([]byte, 2)
-	data[0] = 0x80 | byte(frame.Opcode)
+	data[0] = 0x80 | frame.Reserved | byte(frame.Opcode)
 	if frame.IsFragment {
 		data[0] &= 0x7F
 	}
 
 	if frame.Length <= 125 {
 		data[1] = byte(frame.Length)
-		data = append(data, frame.Payload...)
 	} else if frame.Length > 125 && float64(frame.Length) < math.Pow(2, 16) {
 		data[1] = byte(126)
 		size := make([]byte, 2)
 		binary.BigEndian.PutUint16(size, uint16(frame.Length))
 		data = append(data, size...)
-		data = append(data, frame.Payload...)
 	} else if float64(frame.Length) >= math.Pow(2, 16) {
 		data[1] = byte(127)
 		size := make([]byte, 8)
 		binary.BigEndian.PutUint64(size, frame.Length)
 		data = append(data, size...)
+	}
+
+	if ws.role != clientRole {
 		data = append(data, frame.Payload...)
+		return ws.write(data)
+	}
+
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	data[1] |= 0x80
+	data = append(data, mask...)
+	for i, b := range frame.Payload {
+		data = append(data, b^mask[i%4])
 	}
 	return ws.write(data)
 }
 
 // close sends close Frame and closes the TCP connection
 func (ws *wsConn) close() error {
+	if err := ws.sendClose(ws.status); err != nil {
+		return err
+	}
+	return ws.conn.Close()
+}
+
+// sendClose sends a close Frame with the status, leaving the TCP connection open for the close reply
+func (ws *wsConn) sendClose(status uint16) error {
 	f := domain.Frame{}
 	f.Opcode = 8
 	f.Length = 2
 	f.Payload = make([]byte, 2)
-	binary.BigEndian.PutUint16(f.Payload, ws.status)
-	if err := ws.send(f); err != nil {
-		return err
-	}
-	return ws.conn.Close()
+	binary.BigEndian.PutUint16(f.Payload, status)
+	return ws.send(f)
 }
@@ -0,0 +1,217 @@
+//go:build unit
+
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// newPipeConns returns the two ends of an in-memory websocket connection, the first one
+// with the role and the peer with the other role
+func newPipeConns(t *testing.T, role connRole) (*wsConn, *wsConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	peerRole := clientRole
+	if role == clientRole {
+		peerRole = serverRole
+	}
+
+	return newTestConn(a, role), newTestConn(b, peerRole)
+}
+
+func newTestConn(conn net.Conn, role connRole) *wsConn {
+	return &wsConn{
+		conn:   conn,
+		bufrw:  bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		status: 1000,
+		role:   role,
+	}
+}
+
+// exchange sends the frame on one end and receives it on the other
+func exchange(t *testing.T, from *wsConn, to *wsConn, f domain.Frame) (domain.Frame, error) {
+	t.Helper()
+	sent := make(chan error, 1)
+	go func() { sent <- from.send(f) }()
+	got, err := to.recv(DefaultMaxMessageSize)
+	if sendErr := <-sent; sendErr != nil {
+		t.Fatalf("send() error = %v", sendErr)
+	}
+
+	return got, err
+}
+
+// writeRaw writes the bytes of a frame on the end as they are, bypassing its masking
+func writeRaw(t *testing.T, from *wsConn, to *wsConn, data []byte) (domain.Frame, error) {
+	t.Helper()
+	sent := make(chan error, 1)
+	go func() { sent <- from.write(data) }()
+	got, err := to.recv(DefaultMaxMessageSize)
+	if writeErr := <-sent; writeErr != nil {
+		t.Fatalf("write() error = %v", writeErr)
+	}
+
+	return got, err
+}
+
+func TestWsConn_MaskingByRole(t *testing.T) {
+	upstream, server := newPipeConns(t, clientRole)
+	frame := domain.Frame{Opcode: domain.TextOpcode, Payload: []byte("hello"), Length: 5}
+
+	// The proxy masks what it sends to the upstream
+	got, err := exchange(t, upstream, server, frame)
+	if err != nil {
+		t.Fatalf("recv() error = %v", err)
+	}
+	if !got.IsMasked || string(got.Payload) != "hello" {
+		t.Errorf("recv() = masked %v %q, want a masked hello", got.IsMasked, got.Payload)
+	}
+
+	// and never masks what it sends to the client
+	downstream, client := newPipeConns(t, serverRole)
+	got, err = exchange(t, downstream, client, frame)
+	if err != nil {
+		t.Fatalf("recv() error = %v", err)
+	}
+	if got.IsMasked || string(got.Payload) != "hello" {
+		t.Errorf("recv() = masked %v %q, want an unmasked hello", got.IsMasked, got.Payload)
+	}
+}
+
+func TestWsConn_RejectsWrongMasking(t *testing.T) {
+	// An unmasked frame from a client
+	downstream, client := newPipeConns(t, serverRole)
+	if _, err := writeRaw(t, client, downstream, []byte{0x81, 0x02, 'h', 'i'}); err == nil || downstream.status != 1002 {
+		t.Errorf("recv() of an unmasked client frame error = %v, status %d, want 1002", err, downstream.status)
+	}
+
+	// A masked frame from an upstream
+	upstream, server := newPipeConns(t, clientRole)
+	if _, err := writeRaw(t, server, upstream, []byte{0x81, 0x82, 0, 0, 0, 0, 'h', 'i'}); err == nil || upstream.status != 1002 {
+		t.Errorf("recv() of a masked upstream frame error = %v, status %d, want 1002", err, upstream.status)
+	}
+}
+
+func TestWsConn_PayloadLengths(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 65535, 65536, 70000} {
+		upstream, server := newPipeConns(t, clientRole)
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		got, err := exchange(t, upstream, server, domain.Frame{Opcode: domain.BinaryOpcode, Payload: payload, Length: uint64(size)})
+		if err != nil {
+			t.Fatalf("recv() of %d bytes error = %v", size, err)
+		}
+		if got.Length != uint64(size) || !bytes.Equal(got.Payload, payload) {
+			t.Errorf("recv() of %d bytes = %d bytes", size, len(got.Payload))
+		}
+	}
+}
+
+func TestWsConn_RejectsLengthBeforeReading(t *testing.T) {
+	length64 := func(first byte, length uint64) []byte {
+		return binary.BigEndian.AppendUint64([]byte{first, 127}, length)
+	}
+	tests := []struct {
+		name       string
+		header     []byte
+		limit      int
+		wantStatus uint16
+		wantErr    error
+	}{
+		{name: "64-bit length with the msb set", header: length64(0x82, 1<<63|5), limit: DefaultMaxMessageSize, wantStatus: 1002, wantErr: ErrFrameLength},
+		{name: "length above the max size", header: length64(0x82, 1<<40), limit: DefaultMaxMessageSize, wantStatus: 1009, wantErr: ErrFrameTooLarge},
+		{name: "length above what is left of the message", header: []byte{0x00, 11}, limit: 10, wantStatus: 1009, wantErr: ErrFrameTooLarge},
+		{name: "long control frame", header: []byte{0x89, 126, 0x01, 0x00}, limit: DefaultMaxMessageSize, wantStatus: 1002},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the header is sent, reading the payload would block
+			upstream, server := newPipeConns(t, clientRole)
+			sent := make(chan error, 1)
+			go func() { sent <- server.write(tt.header) }()
+			_, err := upstream.recv(tt.limit)
+			if writeErr := <-sent; writeErr != nil {
+				t.Fatalf("write() error = %v", writeErr)
+			}
+			if err == nil || upstream.status != tt.wantStatus {
+				t.Fatalf("recv() error = %v, status %d, want %d", err, upstream.status, tt.wantStatus)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("recv() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A frame that exactly fills the message is read
+	upstream, server := newPipeConns(t, clientRole)
+	sent := make(chan error, 1)
+	go func() { sent <- server.write(append([]byte{0x82, 10}, make([]byte, 10)...)) }()
+	if f, err := upstream.recv(10); err != nil || f.Length != 10 {
+		t.Errorf("recv() at the limit = %d bytes, %v", f.Length, err)
+	}
+	<-sent
+}
+
+func TestWsConn_Validate(t *testing.T) {
+	closePayload := func(code uint16, reason string) []byte {
+		p := binary.BigEndian.AppendUint16(nil, code)
+		return append(p, reason...)
+	}
+	tests := []struct {
+		name       string
+		frame      domain.Frame
+		compressed bool
+		wantStatus uint16
+	}{
+		{name: "text", frame: domain.Frame{Opcode: domain.TextOpcode, Payload: []byte("hi")}},
+		{name: "long ping", frame: domain.Frame{Opcode: domain.PingOpcode, Payload: make([]byte, 126)}, wantStatus: 1002},
+		{name: "fragmented ping", frame: domain.Frame{Opcode: domain.PingOpcode, IsFragment: true}, wantStatus: 1002},
+		{name: "reserved opcode", frame: domain.Frame{Opcode: 3}, wantStatus: 1002},
+		{name: "rsv1 without deflate", frame: domain.Frame{Opcode: domain.TextOpcode, Reserved: compressedBit, Payload: []byte("hi")}, wantStatus: 1002},
+		{name: "rsv1 with deflate", frame: domain.Frame{Opcode: domain.TextOpcode, Reserved: compressedBit, Payload: []byte{0xff}}, compressed: true},
+		{name: "rsv2", frame: domain.Frame{Opcode: domain.TextOpcode, Reserved: 0x20}, compressed: true, wantStatus: 1002},
+		{name: "invalid utf-8 text", frame: domain.Frame{Opcode: domain.TextOpcode, Payload: []byte{0xff}}, wantStatus: 1007},
+		{name: "invalid utf-8 fragment", frame: domain.Frame{Opcode: domain.TextOpcode, IsFragment: true, Payload: []byte{0xe2, 0x82}}},
+		{name: "close without code", frame: domain.Frame{Opcode: domain.CloseOpcode}},
+		{name: "close with one byte", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: []byte{3}}, wantStatus: 1002},
+		{name: "close 1000", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: closePayload(1000, "bye")}},
+		{name: "close 4000", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: closePayload(4000, "")}},
+		{name: "close 1005", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: closePayload(1005, "")}, wantStatus: 1002},
+		{name: "close 999", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: closePayload(999, "")}, wantStatus: 1002},
+		{name: "close 5000", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: closePayload(5000, "")}, wantStatus: 1002},
+		{name: "close invalid utf-8 reason", frame: domain.Frame{Opcode: domain.CloseOpcode, Payload: closePayload(1000, "\xff")}, wantStatus: 1007},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &wsConn{status: 1000, role: clientRole}
+			if tt.compressed {
+				ws.inflater = &flateReader{}
+			}
+			f := tt.frame
+			f.Length = uint64(len(f.Payload))
+			err := ws.validate(&f)
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || ws.status != tt.wantStatus {
+				t.Errorf("validate() error = %v, status %d, want %d", err, ws.status, tt.wantStatus)
+			}
+		})
+	}
+}
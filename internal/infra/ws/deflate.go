@@ -0,0 +1,225 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	deflateExtension  = "permessage-deflate"
+	extensionsHeader  = "Sec-Websocket-Extensions"
+	compressedBit     = 0x40
+	maxWindowBits     = 15
+	maxWindowSize     = 1 << maxWindowBits
+	deflateSyncMarker = "\x00\x00\xff\xff"
+)
+
+var (
+	ErrDeflateNegotiation = errors.New("extension error: invalid permessage-deflate response from upstream")
+	ErrMessageTooLarge    = errors.New(closeCodes[1009] + ": inflated message exceeds the max message size")
+)
+
+// deflateParams are the negotiated permessage-deflate parameters of one connection (RFC 7692)
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+	clientMaxWindowBitsSet  bool
+}
+
+// parseDeflate parses one extension element, returns false if it is not a valid permessage-deflate
+func parseDeflate(element string) (deflateParams, bool) {
+	var p deflateParams
+	parts := strings.Split(element, ";")
+	if strings.TrimSpace(parts[0]) != deflateExtension {
+		return p, false
+	}
+
+	seen := make(map[string]bool)
+	for _, part := range parts[1:] {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(part), "=")
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[key] {
+			return p, false
+		}
+		seen[key] = true
+
+		switch key {
+		case "server_no_context_takeover":
+			if hasValue {
+				return p, false
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if hasValue {
+				return p, false
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, err := strconv.Atoi(value)
+			if !hasValue || err != nil || bits < 8 || bits > maxWindowBits {
+				return p, false
+			}
+			p.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			p.clientMaxWindowBitsSet = true
+			if !hasValue {
+				continue
+			}
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < 8 || bits > maxWindowBits {
+				return p, false
+			}
+			p.clientMaxWindowBits = bits
+		default:
+			return p, false
+		}
+	}
+
+	return p, true
+}
+
+// extensionElements splits all the Sec-WebSocket-Extensions header values into extension elements
+func extensionElements(header http.Header) []string {
+	var elements []string
+	for _, value := range header.Values(extensionsHeader) {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+
+	return elements
+}
+
+// acceptDeflateOffer picks the first acceptable permessage-deflate offer of the client.
+// The proxy is the server side of this leg.
+func acceptDeflateOffer(header http.Header) (*deflateParams, string) {
+	for _, element := range extensionElements(header) {
+		p, ok := parseDeflate(element)
+		if !ok {
+			continue
+		}
+
+		response := deflateExtension
+		if p.serverNoContextTakeover {
+			response += "; server_no_context_takeover"
+		}
+		if p.clientNoContextTakeover {
+			response += "; client_no_context_takeover"
+		}
+		if p.serverMaxWindowBits > 0 {
+			response += "; server_max_window_bits=" + strconv.Itoa(p.serverMaxWindowBits)
+		}
+		p.clientMaxWindowBits, p.clientMaxWindowBitsSet = 0, false
+
+		return &p, response
+	}
+
+	return nil, ""
+}
+
+// parseDeflateResponse checks the upstream answer to the offer of the proxy, which is
+// the client side of this leg. A nil result means the upstream declined the extension.
+func parseDeflateResponse(header http.Header, offered bool) (*deflateParams, error) {
+	elements := extensionElements(header)
+	if len(elements) == 0 {
+		return nil, nil
+	}
+	if !offered || len(elements) > 1 {
+		return nil, ErrDeflateNegotiation
+	}
+	p, ok := parseDeflate(elements[0])
+	if !ok || p.clientMaxWindowBitsSet {
+		return nil, ErrDeflateNegotiation
+	}
+
+	return &p, nil
+}
+
+// newServerCodec returns the codecs of the leg where the proxy plays the server
+func (p *deflateParams) newServerCodec() (*flateReader, *flateWriter) {
+	return &flateReader{}, newFlateWriter(p.serverMaxWindowBits, p.serverNoContextTakeover)
+}
+
+// newClientCodec returns the codecs of the leg where the proxy plays the client
+func (p *deflateParams) newClientCodec() (*flateReader, *flateWriter) {
+	return &flateReader{}, newFlateWriter(p.clientMaxWindowBits, p.clientNoContextTakeover)
+}
+
+// flateReader inflates messages, keeping the last window of plain text as dictionary
+// so messages compressed with context takeover can be resolved
+type flateReader struct {
+	dict []byte
+}
+
+func (r *flateReader) inflate(data []byte, limit int) ([]byte, error) {
+	// The sync marker stripped by the sender followed by an empty final block to end the stream
+	tail := []byte(deflateSyncMarker + "\x01\x00\x00\xff\xff")
+	fr := flate.NewReaderDict(io.MultiReader(bytes.NewReader(data), bytes.NewReader(tail)), r.dict)
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrMessageTooLarge
+	}
+
+	dict := append(append(make([]byte, 0, len(r.dict)+len(out)), r.dict...), out...)
+	if len(dict) > maxWindowSize {
+		dict = dict[len(dict)-maxWindowSize:]
+	}
+	r.dict = dict
+
+	return out, nil
+}
+
+// flateWriter deflates messages. A nil flateWriter sends messages uncompressed, which is
+// used when the peer asked for a window smaller than compress/flate can produce.
+type flateWriter struct {
+	buf               bytes.Buffer
+	fw                *flate.Writer
+	noContextTakeover bool
+}
+
+func newFlateWriter(windowBits int, noContextTakeover bool) *flateWriter {
+	if windowBits > 0 && windowBits < maxWindowBits {
+		return nil
+	}
+
+	return &flateWriter{noContextTakeover: noContextTakeover}
+}
+
+func (w *flateWriter) deflate(data []byte) ([]byte, error) {
+	w.buf.Reset()
+	if w.fw == nil {
+		fw, err := flate.NewWriter(&w.buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w.fw = fw
+	} else if w.noContextTakeover {
+		w.fw.Reset(&w.buf)
+	}
+
+	if _, err := w.fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	out := bytes.TrimSuffix(w.buf.Bytes(), []byte(deflateSyncMarker))
+
+	return append([]byte(nil), out...), nil
+}
@@ -0,0 +1,194 @@
+//go:build unit
+
+package ws
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseDeflate(t *testing.T) {
+	tests := []struct {
+		element string
+		want    deflateParams
+		wantOk  bool
+	}{
+		{element: "permessage-deflate", wantOk: true},
+		{element: "permessage-deflate; client_max_window_bits", want: deflateParams{clientMaxWindowBitsSet: true}, wantOk: true},
+		{
+			element: `permessage-deflate; server_no_context_takeover; client_no_context_takeover; server_max_window_bits=10; client_max_window_bits="12"`,
+			want: deflateParams{
+				serverNoContextTakeover: true,
+				clientNoContextTakeover: true,
+				serverMaxWindowBits:     10,
+				clientMaxWindowBits:     12,
+				clientMaxWindowBitsSet:  true,
+			},
+			wantOk: true,
+		},
+		{element: "x-webkit-deflate-frame"},
+		{element: "permessage-deflate; server_max_window_bits"},
+		{element: "permessage-deflate; server_max_window_bits=7"},
+		{element: "permessage-deflate; server_max_window_bits=16"},
+		{element: "permessage-deflate; client_max_window_bits=abc"},
+		{element: "permessage-deflate; server_no_context_takeover=1"},
+		{element: "permessage-deflate; server_no_context_takeover; server_no_context_takeover"},
+		{element: "permessage-deflate; unknown"},
+	}
+	for _, tt := range tests {
+		got, ok := parseDeflate(tt.element)
+		if ok != tt.wantOk || (ok && got != tt.want) {
+			t.Errorf("parseDeflate(%q) = %+v, %v, want %+v, %v", tt.element, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestAcceptDeflateOffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		offers []string
+		want   string
+	}{
+		{name: "no offer"},
+		{name: "other extension", offers: []string{"x-webkit-deflate-frame"}},
+		{name: "plain offer", offers: []string{"permessage-deflate"}, want: "permessage-deflate"},
+		{
+			name:   "client window bits hint is not answered",
+			offers: []string{"permessage-deflate; client_max_window_bits"},
+			want:   "permessage-deflate",
+		},
+		{
+			name:   "parameters answered",
+			offers: []string{"permessage-deflate; server_no_context_takeover; client_no_context_takeover; server_max_window_bits=12"},
+			want:   "permessage-deflate; server_no_context_takeover; client_no_context_takeover; server_max_window_bits=12",
+		},
+		{
+			name:   "first valid offer",
+			offers: []string{"permessage-deflate; server_max_window_bits=20, permessage-deflate; client_no_context_takeover", "permessage-deflate"},
+			want:   "permessage-deflate; client_no_context_takeover",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, offer := range tt.offers {
+				header.Add(extensionsHeader, offer)
+			}
+			p, got := acceptDeflateOffer(header)
+			if got != tt.want || (p != nil) != (tt.want != "") {
+				t.Errorf("acceptDeflateOffer() = %+v, %q, want %q", p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDeflateResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []string
+		offered  bool
+		want     *deflateParams
+		wantErr  bool
+	}{
+		{name: "declined", offered: true},
+		{name: "accepted", response: []string{"permessage-deflate; server_no_context_takeover"}, offered: true, want: &deflateParams{serverNoContextTakeover: true}},
+		{name: "not offered", response: []string{"permessage-deflate"}, wantErr: true},
+		{name: "several extensions", response: []string{"permessage-deflate, permessage-deflate"}, offered: true, wantErr: true},
+		{name: "client window bits not offered", response: []string{"permessage-deflate; client_max_window_bits=10"}, offered: true, wantErr: true},
+		{name: "invalid parameter", response: []string{"permessage-deflate; unknown"}, offered: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, r := range tt.response {
+				header.Add(extensionsHeader, r)
+			}
+			got, err := parseDeflateResponse(header, tt.offered)
+			if tt.wantErr {
+				if !errors.Is(err, ErrDeflateNegotiation) {
+					t.Errorf("parseDeflateResponse() error = %v, want %v", err, ErrDeflateNegotiation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDeflateResponse() error = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseDeflateResponse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeflate_ContextTakeover(t *testing.T) {
+	messages := []string{
+		strings.Repeat(`{"type":"update","channel":"prices","value":1}`, 4),
+		strings.Repeat(`{"type":"update","channel":"prices","value":2}`, 4),
+		strings.Repeat(`{"type":"update","channel":"prices","value":3}`, 4),
+		"",
+		strings.Repeat(`{"type":"update","channel":"prices","value":4}`, 4),
+	}
+	for _, noContextTakeover := range []bool{false, true} {
+		w := newFlateWriter(0, noContextTakeover)
+		r := &flateReader{}
+		var sizes []int
+		for i, m := range messages {
+			compressed, err := w.deflate([]byte(m))
+			if err != nil {
+				t.Fatalf("deflate() error = %v", err)
+			}
+			if bytes.HasSuffix(compressed, []byte(deflateSyncMarker)) {
+				t.Errorf("deflate() kept the sync marker")
+			}
+			sizes = append(sizes, len(compressed))
+
+			got, err := r.inflate(compressed, DefaultMaxMessageSize)
+			if err != nil {
+				t.Fatalf("no_context_takeover %v message %d: inflate() error = %v", noContextTakeover, i, err)
+			}
+			if string(got) != m {
+				t.Errorf("no_context_takeover %v message %d: inflate() = %q, want %q", noContextTakeover, i, got, m)
+			}
+
+			// Without context takeover every message is inflated on its own
+			fresh, err := (&flateReader{}).inflate(compressed, DefaultMaxMessageSize)
+			if noContextTakeover && (err != nil || string(fresh) != m) {
+				t.Errorf("message %d: inflate() without the previous messages = %q, %v", i, fresh, err)
+			}
+		}
+		// The repeated messages reuse the window of the previous ones
+		if !noContextTakeover && sizes[1] >= sizes[0] {
+			t.Errorf("compressed sizes %v, want the second message smaller with context takeover", sizes)
+		}
+		if noContextTakeover && sizes[1] != sizes[0] {
+			t.Errorf("compressed sizes %v, want the same sizes without context takeover", sizes)
+		}
+	}
+}
+
+func TestDeflate_Codecs(t *testing.T) {
+	p := &deflateParams{serverNoContextTakeover: true, clientMaxWindowBits: 10}
+	if _, w := p.newServerCodec(); w == nil || !w.noContextTakeover {
+		t.Errorf("server codec writer = %+v, want one without context takeover", w)
+	}
+	// compress/flate cannot write in a window smaller than 32KB, the messages are sent uncompressed
+	if _, w := p.newClientCodec(); w != nil {
+		t.Errorf("client codec writer = %+v, want none for a 10 bits window", w)
+	}
+}
+
+func TestFlateReader_Limit(t *testing.T) {
+	compressed, err := newFlateWriter(0, false).deflate(bytes.Repeat([]byte("a"), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&flateReader{}).inflate(compressed, 999); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("inflate() error = %v, want %v", err, ErrMessageTooLarge)
+	}
+	if out, err := (&flateReader{}).inflate(compressed, 1000); err != nil || len(out) != 1000 {
+		t.Errorf("inflate() at the limit = %d bytes, %v", len(out), err)
+	}
+}
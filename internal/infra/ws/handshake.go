@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	websocketGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	handshakeTimeout  = 10 * time.Second
+	maxErrorBodyBytes = 64 * 1024
+)
+
+var (
+	ErrHandshakeUpgrade  = errors.New("upstream handshake error: response is not a websocket upgrade")
+	ErrHandshakeAccept   = errors.New("upstream handshake error: invalid Sec-WebSocket-Accept")
+	ErrHandshakeProtocol = errors.New("upstream handshake error: selected subprotocol was not requested")
+)
+
+// hopHeaders are not relayed when an upstream error response is written to the client
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+// computeAcceptKey returns the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken checks if the comma separated header values contain the token (case-insensitive)
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isUpgradeRequest checks if the client asks for a websocket upgrade
+func isUpgradeRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// checkHandshakeResponse verifies the upstream accepted the upgrade asked by req
+func checkHandshakeResponse(req *http.Request, resp *http.Response) error {
+	if !headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return ErrHandshakeUpgrade
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")) {
+		return ErrHandshakeAccept
+	}
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "" &&
+		!headerContainsToken(req.Header, "Sec-WebSocket-Protocol", protocol) {
+		return ErrHandshakeProtocol
+	}
+
+	return nil
+}
+
+// writeUpstreamError relays an upstream response that refused the upgrade to the client.
+// Error statuses are passed through, anything else becomes a 502 Bad Gateway.
+func writeUpstreamError(writer http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode < http.StatusMultipleChoices {
+		http.Error(writer, "upstream refused the websocket upgrade with status "+strconv.Itoa(resp.StatusCode), http.StatusBadGateway)
+		return
+	}
+
+	for k, v := range resp.Header {
+		writer.Header()[k] = v
+	}
+	for _, h := range hopHeaders {
+		writer.Header().Del(h)
+	}
+	writer.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(writer, io.LimitReader(resp.Body, maxErrorBodyBytes))
+}
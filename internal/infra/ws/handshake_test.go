@@ -0,0 +1,90 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestComputeAcceptKey(t *testing.T) {
+	// The example of RFC 6455 section 1.3
+	if got := computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("computeAcceptKey() = %q, want %q", got, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{connection: "Upgrade", upgrade: "websocket", want: true},
+		{connection: "keep-alive, upgrade", upgrade: "WebSocket", want: true},
+		{connection: "keep-alive", upgrade: "websocket"},
+		{connection: "Upgrade", upgrade: "h2c"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Header: http.Header{}}
+		r.Header.Set("Connection", tt.connection)
+		r.Header.Set("Upgrade", tt.upgrade)
+		if got := isUpgradeRequest(r); got != tt.want {
+			t.Errorf("isUpgradeRequest(%q, %q) = %v, want %v", tt.connection, tt.upgrade, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHandshakeResponse(t *testing.T) {
+	request := func(protocols ...string) *http.Request {
+		r := &http.Request{Header: http.Header{}}
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		for _, p := range protocols {
+			r.Header.Add("Sec-WebSocket-Protocol", p)
+		}
+		return r
+	}
+	response := func(accept string, protocol string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", "websocket")
+		resp.Header.Set("Sec-WebSocket-Accept", accept)
+		if protocol != "" {
+			resp.Header.Set("Sec-WebSocket-Protocol", protocol)
+		}
+		return resp
+	}
+	const accept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+
+	tests := []struct {
+		name    string
+		req     *http.Request
+		resp    *http.Response
+		wantErr error
+	}{
+		{name: "accepted", req: request(), resp: response(accept, "")},
+		{name: "requested subprotocol", req: request("graphql-ws, chat"), resp: response(accept, "chat")},
+		{name: "subprotocol of a second header", req: request("graphql-ws", "chat"), resp: response(accept, "chat")},
+		{name: "subprotocol not requested", req: request("graphql-ws"), resp: response(accept, "chat"), wantErr: ErrHandshakeProtocol},
+		{name: "subprotocol without request", req: request(), resp: response(accept, "chat"), wantErr: ErrHandshakeProtocol},
+		{name: "wrong accept key", req: request(), resp: response("x3JJHMbDL1EzLkh9GBhXDw==", ""), wantErr: ErrHandshakeAccept},
+		{
+			name: "not an upgrade",
+			req:  request(),
+			resp: func() *http.Response {
+				resp := response(accept, "")
+				resp.Header.Del("Upgrade")
+				return resp
+			}(),
+			wantErr: ErrHandshakeUpgrade,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkHandshakeResponse(tt.req, tt.resp); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkHandshakeResponse() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+var (
+	ErrHealthCheckClosed = errors.New("health check: upstream closed the connection before replying")
+	ErrHealthCheckReply  = errors.New("health check: upstream reply does not match the expected pattern")
+)
+
+// HealthCheck dials the upstream and, if asked, performs a full websocket handshake
+// and sends a probe message expecting a reply matching the pattern
+func (w *wsInfra) HealthCheck(addr string, rewriteHost string, opt adapter.WsOption, check adapter.HealthCheckOption) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return ErrFormatAddr
+	}
+	if u.Scheme != WsScheme && u.Scheme != WssScheme {
+		return ErrFormatAddr
+	}
+	tlsc := opt.TLS
+	if u.Scheme == WssScheme && tlsc == nil {
+		tlsc = &tls.Config{}
+	}
+
+	var header []byte
+	if opt.ProxyProtocol != 0 {
+		header = proxyHeader(opt.ProxyProtocol, nil, nil)
+	}
+	conn, err := dialUpstream(u.Scheme, u.Host, tlsc, check.Timeout, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !check.Handshake {
+		return nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(check.Timeout))
+
+	ws, err := clientHandshake(conn, u, rewriteHost, nil, false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ws.close() }()
+	if check.Send == "" {
+		return nil
+	}
+	probe := domain.Frame{Opcode: domain.TextOpcode, Payload: []byte(check.Send), Length: uint64(len(check.Send))}
+	if err = ws.send(probe); err != nil {
+		return err
+	}
+	if check.Expect == nil {
+		return nil
+	}
+
+	assembler := newMessageAssembler(opt.MaxMessageSize)
+	for {
+		f, err := ws.recv(assembler.remaining())
+		if err != nil {
+			return err
+		}
+		switch f.Opcode {
+		case domain.CloseOpcode:
+			return ErrHealthCheckClosed
+		case domain.PingOpcode:
+			if err = ws.send(f.Pong()); err != nil {
+				return err
+			}
+			continue
+		case domain.PongOpcode:
+			continue
+		}
+
+		msg, _, err := assembler.push(f)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if !check.Expect.Match(msg.frame.Payload) {
+			return ErrHealthCheckReply
+		}
+
+		return nil
+	}
+}
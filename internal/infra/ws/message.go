@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"errors"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const DefaultMaxMessageSize = 1024 * 1024
+
+var (
+	ErrUnexpectedContinuation = errors.New("protocol error: continuation frame without a message to continue")
+	ErrUnfinishedMessage      = errors.New("protocol error: new message started before the previous one is finished")
+	ErrInvalidUTF8            = errors.New("wrong code: invalid UTF-8 text message ")
+	ErrFrameLength            = errors.New("protocol error: the most significant bit of a 64-bit payload length MUST be 0")
+	ErrFrameTooLarge          = errors.New(closeCodes[1009] + ": frame exceeds the max message size")
+)
+
+// message is a complete websocket message reassembled from its fragments
+type message struct {
+	frame     domain.Frame
+	fragments []int
+}
+
+// frames splits the message into frames again, either as one frame or along the original fragment boundaries
+func (m *message) frames(refragment bool) []domain.Frame {
+	payload := m.frame.Payload
+	if !refragment || len(m.fragments) < 2 {
+		f := m.frame
+		f.IsFragment = false
+		f.Length = uint64(len(payload))
+		return []domain.Frame{f}
+	}
+
+	var out []domain.Frame
+	for i, size := range m.fragments {
+		if size > len(payload) || i == len(m.fragments)-1 {
+			size = len(payload)
+		}
+		f := domain.Frame{Opcode: domain.ContinuationOpcode, IsFragment: true, Payload: payload[:size], Length: uint64(size)}
+		if i == 0 {
+			f.Opcode = m.frame.Opcode
+			f.Reserved = m.frame.Reserved
+		}
+		payload = payload[size:]
+		out = append(out, f)
+		if len(payload) == 0 {
+			break
+		}
+	}
+	out[len(out)-1].IsFragment = false
+
+	return out
+}
+
+// messageAssembler buffers the fragments of a data message until the final one arrives
+type messageAssembler struct {
+	maxSize int
+	pending *message
+}
+
+func newMessageAssembler(maxSize int) *messageAssembler {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+
+	return &messageAssembler{maxSize: maxSize}
+}
+
+// remaining is the payload size the next frame can have without exceeding the max size
+func (a *messageAssembler) remaining() int {
+	if a.pending == nil {
+		return a.maxSize
+	}
+
+	return a.maxSize - len(a.pending.frame.Payload)
+}
+
+// push adds a data frame to the pending message and returns the message once it is complete.
+// The returned status is the close code to send back if the frame is rejected.
+func (a *messageAssembler) push(f domain.Frame) (*message, uint16, error) {
+	if f.Opcode == domain.ContinuationOpcode {
+		if a.pending == nil {
+			return nil, 1002, ErrUnexpectedContinuation
+		}
+	} else {
+		if a.pending != nil {
+			return nil, 1002, ErrUnfinishedMessage
+		}
+		a.pending = &message{frame: domain.Frame{Opcode: f.Opcode, Reserved: f.Reserved}}
+	}
+
+	msg := a.pending
+	if len(msg.frame.Payload)+len(f.Payload) > a.maxSize {
+		a.pending = nil
+		return nil, 1009, errors.New(closeCodes[1009] + ": message exceeds " + strconv.Itoa(a.maxSize) + " bytes")
+	}
+	msg.frame.Payload = append(msg.frame.Payload, f.Payload...)
+	msg.fragments = append(msg.fragments, len(f.Payload))
+	if f.IsFragment {
+		return nil, 0, nil
+	}
+
+	a.pending = nil
+	msg.frame.Length = uint64(len(msg.frame.Payload))
+	if msg.frame.Opcode == domain.TextOpcode && msg.frame.Reserved&compressedBit == 0 && !utf8.Valid(msg.frame.Payload) {
+		return nil, 1007, ErrInvalidUTF8
+	}
+
+	return msg, 0, nil
+}
@@ -0,0 +1,178 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+func fragment(opcode domain.OpcodeType, payload string, final bool) domain.Frame {
+	return domain.Frame{Opcode: opcode, IsFragment: !final, Payload: []byte(payload), Length: uint64(len(payload))}
+}
+
+func TestMessageAssembler_Reassembles(t *testing.T) {
+	a := newMessageAssembler(0)
+	for _, f := range []domain.Frame{
+		fragment(domain.TextOpcode, "hel", false),
+		fragment(domain.ContinuationOpcode, "lo ", false),
+	} {
+		if msg, _, err := a.push(f); msg != nil || err != nil {
+			t.Fatalf("push() = %v, %v, want the message pending", msg, err)
+		}
+	}
+	msg, _, err := a.push(fragment(domain.ContinuationOpcode, "world", true))
+	if err != nil || msg == nil {
+		t.Fatalf("push() = %v, %v, want the message", msg, err)
+	}
+	if msg.frame.Opcode != domain.TextOpcode || string(msg.frame.Payload) != "hello world" || msg.frame.Length != 11 {
+		t.Errorf("message = %v %q (%d), want text hello world", msg.frame.Opcode, msg.frame.Payload, msg.frame.Length)
+	}
+	if len(msg.fragments) != 3 || msg.fragments[0] != 3 || msg.fragments[2] != 5 {
+		t.Errorf("fragments = %v, want [3 3 5]", msg.fragments)
+	}
+
+	// A new message starts once the previous one is complete
+	if msg, _, err := a.push(fragment(domain.BinaryOpcode, "\x00", true)); err != nil || msg == nil {
+		t.Errorf("push() of the next message = %v, %v", msg, err)
+	}
+}
+
+func TestMessageAssembler_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int
+		frames     []domain.Frame
+		wantStatus uint16
+		wantErr    error
+	}{
+		{
+			name:       "continuation without message",
+			frames:     []domain.Frame{fragment(domain.ContinuationOpcode, "a", true)},
+			wantStatus: 1002,
+			wantErr:    ErrUnexpectedContinuation,
+		},
+		{
+			name:       "message before the previous one is finished",
+			frames:     []domain.Frame{fragment(domain.TextOpcode, "a", false), fragment(domain.TextOpcode, "b", true)},
+			wantStatus: 1002,
+			wantErr:    ErrUnfinishedMessage,
+		},
+		{
+			name:       "invalid utf-8 split across fragments",
+			frames:     []domain.Frame{fragment(domain.TextOpcode, "\xe2\x82", false), fragment(domain.ContinuationOpcode, "\x28", true)},
+			wantStatus: 1007,
+			wantErr:    ErrInvalidUTF8,
+		},
+		{
+			name:       "single frame above the max size",
+			maxSize:    4,
+			frames:     []domain.Frame{fragment(domain.BinaryOpcode, "12345", true)},
+			wantStatus: 1009,
+		},
+		{
+			name:       "fragments above the max size",
+			maxSize:    4,
+			frames:     []domain.Frame{fragment(domain.BinaryOpcode, "123", false), fragment(domain.ContinuationOpcode, "45", true)},
+			wantStatus: 1009,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newMessageAssembler(tt.maxSize)
+			var (
+				status uint16
+				err    error
+			)
+			for _, f := range tt.frames {
+				if _, status, err = a.push(f); err != nil {
+					break
+				}
+			}
+			if err == nil || status != tt.wantStatus {
+				t.Fatalf("push() status = %d, error = %v, want %d", status, err, tt.wantStatus)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("push() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMessageAssembler_MaxSize(t *testing.T) {
+	a := newMessageAssembler(4)
+	if msg, _, err := a.push(fragment(domain.BinaryOpcode, "1234", true)); err != nil || msg == nil {
+		t.Fatalf("push() of the max size = %v, %v", msg, err)
+	}
+	// The rejected message is dropped, the next one is assembled from scratch
+	_, _, _ = a.push(fragment(domain.BinaryOpcode, "12345", true))
+	if msg, _, err := a.push(fragment(domain.BinaryOpcode, "1", true)); err != nil || msg == nil {
+		t.Errorf("push() after a rejected message = %v, %v", msg, err)
+	}
+	// The frames of a pending message are limited to what is left of the max size
+	if _, _, err := a.push(fragment(domain.BinaryOpcode, "123", false)); err != nil || a.remaining() != 1 {
+		t.Errorf("remaining() = %d, %v, want 1", a.remaining(), err)
+	}
+	if newMessageAssembler(0).maxSize != DefaultMaxMessageSize {
+		t.Errorf("default max size = %d, want %d", newMessageAssembler(0).maxSize, DefaultMaxMessageSize)
+	}
+}
+
+func TestMessageAssembler_CompressedTextSkipsUTF8(t *testing.T) {
+	a := newMessageAssembler(0)
+	f := fragment(domain.TextOpcode, "\xff\x00", true)
+	f.Reserved = compressedBit
+	if msg, _, err := a.push(f); err != nil || msg == nil || msg.frame.Reserved != compressedBit {
+		t.Errorf("push() of a compressed text = %v, %v, want it kept compressed", msg, err)
+	}
+}
+
+func TestMessage_Frames(t *testing.T) {
+	newMessage := func(payload string, fragments ...int) *message {
+		return &message{
+			frame:     domain.Frame{Opcode: domain.TextOpcode, Reserved: compressedBit, Payload: []byte(payload), Length: uint64(len(payload))},
+			fragments: fragments,
+		}
+	}
+	tests := []struct {
+		name       string
+		msg        *message
+		refragment bool
+		want       []string
+	}{
+		{name: "one frame without refragment", msg: newMessage("hello world", 3, 3, 5), want: []string{"hello world"}},
+		{name: "original boundaries", msg: newMessage("hello world", 3, 3, 5), refragment: true, want: []string{"hel", "lo ", "world"}},
+		{name: "grown payload in the last frame", msg: newMessage("hello world!!", 3, 3, 5), refragment: true, want: []string{"hel", "lo ", "world!!"}},
+		{name: "shrunk payload in fewer frames", msg: newMessage("hi", 3, 3, 5), refragment: true, want: []string{"hi"}},
+		{name: "shrunk payload cut in a fragment", msg: newMessage("hello", 3, 3, 5), refragment: true, want: []string{"hel", "lo"}},
+		{name: "single fragment", msg: newMessage("hello", 5), refragment: true, want: []string{"hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := tt.msg.frames(tt.refragment)
+			var got []string
+			for i, f := range frames {
+				got = append(got, string(f.Payload))
+				if f.Length != uint64(len(f.Payload)) {
+					t.Errorf("frame %d length = %d, want %d", i, f.Length, len(f.Payload))
+				}
+				if final := i == len(frames)-1; f.IsFragment == final {
+					t.Errorf("frame %d fragment = %v, want only the last one final", i, f.IsFragment)
+				}
+				wantOpcode, wantReserved := domain.ContinuationOpcode, byte(0)
+				if i == 0 {
+					wantOpcode, wantReserved = domain.TextOpcode, compressedBit
+				}
+				if f.Opcode != wantOpcode || f.Reserved != wantReserved {
+					t.Errorf("frame %d opcode %v rsv %x, want %v rsv %x", i, f.Opcode, f.Reserved, wantOpcode, wantReserved)
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("frames() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
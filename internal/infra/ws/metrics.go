@@ -0,0 +1,37 @@
+package ws
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// Metrics records the sessions, the upstream handshakes and the frames going through the proxy
+type Metrics interface {
+	SessionOpened()
+	SessionClosed(duration time.Duration)
+	UpstreamHandshake(upstream string, duration time.Duration, err error)
+	Frame(direction domain.Direction, opcode domain.OpcodeType, size int)
+	Close(direction domain.Direction, code uint16)
+	RecordDropped(route string)
+}
+
+// noopMetrics is used when no metrics are configured
+type noopMetrics struct{}
+
+func (noopMetrics) SessionOpened()                                 {}
+func (noopMetrics) SessionClosed(time.Duration)                    {}
+func (noopMetrics) UpstreamHandshake(string, time.Duration, error) {}
+func (noopMetrics) Frame(domain.Direction, domain.OpcodeType, int) {}
+func (noopMetrics) Close(domain.Direction, uint16)                 {}
+func (noopMetrics) RecordDropped(string)                           {}
+
+// closeCode returns the status of a close frame, 1005 if it has none
+func closeCode(f domain.Frame) uint16 {
+	if len(f.Payload) < 2 {
+		return 1005
+	}
+
+	return binary.BigEndian.Uint16(f.Payload)
+}
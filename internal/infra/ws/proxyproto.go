@@ -0,0 +1,62 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader builds the PROXY protocol header announcing the client connection. If the
+// addresses are unknown, as for health checks, the header tells the upstream so.
+func proxyHeader(version int, src net.Addr, dst net.Addr) []byte {
+	srcTcp, srcOk := src.(*net.TCPAddr)
+	dstTcp, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && (srcTcp.IP.To4() == nil) == (dstTcp.IP.To4() == nil)
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if srcTcp.IP.To4() != nil {
+			family = "TCP4"
+		}
+		return []byte("PROXY " + family + " " + srcTcp.IP.String() + " " + dstTcp.IP.String() + " " +
+			strconv.Itoa(srcTcp.Port) + " " + strconv.Itoa(dstTcp.Port) + "\r\n")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	if !known {
+		// LOCAL command without addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	srcIP, dstIP, family := srcTcp.IP.To4(), dstTcp.IP.To4(), byte(0x11)
+	if srcIP == nil {
+		srcIP, dstIP, family = srcTcp.IP.To16(), dstTcp.IP.To16(), 0x21
+	}
+	buf.Write([]byte{0x21, family})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(srcTcp.Port))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(dstTcp.Port))
+
+	return buf.Bytes()
+}
+
+// requestProxyHeader announces the client and the listener address of the request
+func requestProxyHeader(version int, request *http.Request) []byte {
+	var src net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr); err == nil {
+		src = addr
+	}
+	dst, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	return proxyHeader(version, src, dst)
+}
@@ -0,0 +1,422 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const (
+	defaultRecordMaxSize    = 100 << 20
+	defaultRecordMaxBackups = 3
+	// recordQueueSize is the number of lines waiting for the writer before they are dropped
+	recordQueueSize = 4096
+)
+
+// openEvent is the event of the first record of a session, holding its handshake request
+const openEvent = "open"
+
+// handshakeHeaders are negotiated again by the replay, they are left out of the recording
+var handshakeHeaders = []string{"Connection", "Upgrade", "Sec-WebSocket-Key", "Sec-WebSocket-Version", extensionsHeader}
+
+// sensitiveHeaders hold the credentials of the client, they are never written to the recording
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// record is one line of the recording file
+type record struct {
+	Time      time.Time      `json:"time"`
+	Session   string         `json:"session"`
+	Route     string         `json:"route,omitempty"`
+	Event     string         `json:"event,omitempty"`
+	Request   *recordRequest `json:"request,omitempty"`
+	Direction string         `json:"direction,omitempty"`
+	Opcode    string         `json:"opcode,omitempty"`
+	// Encoding is base64 for the binary payloads, the text ones are kept as they are
+	Encoding string `json:"encoding,omitempty"`
+	Payload  string `json:"payload,omitempty"`
+	// Modified is the payload forwarded, only set if the modifiers changed it
+	Modified  *string `json:"modified,omitempty"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+type recordRequest struct {
+	RemoteAddr string      `json:"remoteAddr"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	Header     http.Header `json:"header"`
+}
+
+// recorder appends the messages of the sampled sessions to a JSON Lines file, rotated to
+// file.1 .. file.N once it reaches the max size. The lines are queued to a writer goroutine
+// so a slow disk never stalls the pipes, and dropped once the queue is full.
+type recorder struct {
+	mu      sync.RWMutex
+	opt     adapter.RecordOption
+	closed  bool
+	lines   chan []byte
+	done    chan struct{}
+	metrics Metrics
+	logger  *log.Logger
+	// disabled is set once the file could not be opened again after a rotation
+	disabled atomic.Bool
+	// file and size are only used by the writer goroutine
+	file *os.File
+	size int64
+}
+
+// recorderRegistry shares one recorder per file between the routes and the reloads
+type recorderRegistry struct {
+	mu        sync.Mutex
+	metrics   Metrics
+	recorders map[string]*recorder
+}
+
+func newRecorderRegistry(metrics Metrics) *recorderRegistry {
+	return &recorderRegistry{metrics: metrics, recorders: make(map[string]*recorder)}
+}
+
+// get returns the recorder of the file, the limits of the last route config win
+func (r *recorderRegistry) get(opt adapter.RecordOption) (*recorder, error) {
+	if opt.MaxSize <= 0 {
+		opt.MaxSize = defaultRecordMaxSize
+	}
+	if opt.MaxBackups <= 0 {
+		opt.MaxBackups = defaultRecordMaxBackups
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rec, ok := r.recorders[opt.File]; ok {
+		rec.mu.Lock()
+		rec.opt = opt
+		rec.mu.Unlock()
+		return rec, nil
+	}
+	rec := &recorder{
+		opt:     opt,
+		lines:   make(chan []byte, recordQueueSize),
+		done:    make(chan struct{}),
+		metrics: r.metrics,
+		logger:  log.New(os.Stderr, "", log.LstdFlags),
+	}
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	go rec.run()
+	r.recorders[opt.File] = rec
+
+	return rec, nil
+}
+
+// close writes the queued lines and closes the files
+func (r *recorderRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for file, rec := range r.recorders {
+		rec.mu.Lock()
+		rec.closed = true
+		close(rec.lines)
+		rec.mu.Unlock()
+		<-rec.done
+		delete(r.recorders, file)
+	}
+}
+
+func (rec *recorder) options() adapter.RecordOption {
+	rec.mu.RLock()
+	defer rec.mu.RUnlock()
+
+	return rec.opt
+}
+
+func (rec *recorder) open() error {
+	file, err := os.OpenFile(rec.options().File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rec.file, rec.size = file, info.Size()
+
+	return nil
+}
+
+// run writes the queued lines until the recorder is closed
+func (rec *recorder) run() {
+	defer close(rec.done)
+
+	for line := range rec.lines {
+		if err := rec.write(line); err != nil {
+			rec.logger.Println(err)
+		}
+	}
+	if rec.file != nil {
+		_ = rec.file.Close()
+	}
+}
+
+func (rec *recorder) write(line []byte) error {
+	if rec.file == nil {
+		return nil
+	}
+	if rec.size > 0 && rec.size+int64(len(line)) > rec.options().MaxSize {
+		if err := rec.rotate(); err != nil {
+			if rec.file == nil {
+				return err
+			}
+			// The line goes to the current file, the rotation is tried again after another max size
+			rec.logger.Println(err)
+			rec.size = 0
+		}
+	}
+	n, err := rec.file.Write(line)
+	rec.size += int64(n)
+
+	return err
+}
+
+// rotate shifts file.N-1 to file.N down to file to file.1, dropping the oldest one. The
+// file is opened again even if the close or the rename failed, and the recording is
+// disabled if it cannot be.
+func (rec *recorder) rotate() error {
+	opt := rec.options()
+	err := rec.file.Close()
+	if err == nil {
+		for i := opt.MaxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", opt.File, i), fmt.Sprintf("%s.%d", opt.File, i+1))
+		}
+		err = os.Rename(opt.File, opt.File+".1")
+	}
+	if openErr := rec.open(); openErr != nil {
+		rec.file = nil
+		rec.disabled.Store(true)
+		return fmt.Errorf("recording to %s disabled: %w", opt.File, openErr)
+	}
+	if err != nil {
+		return fmt.Errorf("rotate %s: %w", opt.File, err)
+	}
+
+	return nil
+}
+
+// recordOpen queues the client handshake request of the session, replayed with its messages
+func (rec *recorder) recordOpen(s *session, request *http.Request) error {
+	header := request.Header.Clone()
+	for _, name := range handshakeHeaders {
+		header.Del(name)
+	}
+	for _, name := range sensitiveHeaders {
+		header.Del(name)
+	}
+
+	return rec.queue(s, record{
+		Time:    time.Now(),
+		Session: s.id,
+		Route:   s.route,
+		Event:   openEvent,
+		Request: &recordRequest{
+			RemoteAddr: request.RemoteAddr,
+			Host:       request.Host,
+			URI:        request.URL.RequestURI(),
+			Header:     header,
+		},
+	})
+}
+
+// record queues the message as it was received and, if the modifiers changed it, as it
+// was forwarded
+func (rec *recorder) record(s *session, direction domain.Direction, opcode domain.OpcodeType, original []byte, modified []byte) error {
+	r := record{
+		Time:      time.Now(),
+		Session:   s.id,
+		Route:     s.route,
+		Direction: directionName(direction),
+		Opcode:    opcodeName(opcode),
+	}
+	maxPayload := rec.options().MaxPayload
+	changed := string(original) != string(modified)
+	original, r.Truncated = truncatePayload(original, maxPayload)
+	r.Payload = r.encode(opcode, original)
+	if changed {
+		var truncated bool
+		modified, truncated = truncatePayload(modified, maxPayload)
+		m := r.encode(opcode, modified)
+		r.Modified, r.Truncated = &m, r.Truncated || truncated
+	}
+
+	return rec.queue(s, r)
+}
+
+// queue hands the record to the writer, it is dropped and counted if the queue is full
+func (rec *recorder) queue(s *session, r record) error {
+	if rec.disabled.Load() {
+		rec.metrics.RecordDropped(s.route)
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	rec.mu.RLock()
+	defer rec.mu.RUnlock()
+
+	if rec.closed {
+		return nil
+	}
+	select {
+	case rec.lines <- line:
+	default:
+		rec.metrics.RecordDropped(s.route)
+	}
+
+	return nil
+}
+
+func truncatePayload(payload []byte, maxPayload int) ([]byte, bool) {
+	if maxPayload > 0 && len(payload) > maxPayload {
+		return payload[:maxPayload], true
+	}
+
+	return payload, false
+}
+
+func (r *record) encode(opcode domain.OpcodeType, payload []byte) string {
+	if opcode == domain.TextOpcode {
+		return string(payload)
+	}
+	r.Encoding = "base64"
+
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+func directionName(direction domain.Direction) string {
+	if direction == domain.ServerDirection {
+		return "server"
+	}
+
+	return "client"
+}
+
+func opcodeName(opcode domain.OpcodeType) string {
+	switch opcode {
+	case domain.ContinuationOpcode:
+		return "continuation"
+	case domain.TextOpcode:
+		return "text"
+	case domain.BinaryOpcode:
+		return "binary"
+	case domain.CloseOpcode:
+		return "close"
+	case domain.PingOpcode:
+		return "ping"
+	case domain.PongOpcode:
+		return "pong"
+	}
+
+	return fmt.Sprintf("0x%x", byte(opcode))
+}
+
+// ReadRecords parses a recording file, in the order the messages were written
+func ReadRecords(file string) ([]domain.RecordedMessage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The lines are read whole, a record holds two payloads of a message of any max size
+	var messages []domain.RecordedMessage
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(data) == 0 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		var r record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		m := domain.RecordedMessage{
+			Time:      r.Time,
+			Session:   r.Session,
+			Route:     r.Route,
+			Direction: domain.ClientDirection,
+			Opcode:    parseOpcodeName(r.Opcode),
+			Truncated: r.Truncated,
+		}
+		if r.Event == openEvent && r.Request != nil {
+			m.Request = &domain.RecordedRequest{
+				RemoteAddr: r.Request.RemoteAddr,
+				Host:       r.Request.Host,
+				URI:        r.Request.URI,
+				Header:     r.Request.Header,
+			}
+			messages = append(messages, m)
+			continue
+		}
+		if r.Direction == "server" {
+			m.Direction = domain.ServerDirection
+		}
+		if m.Payload, err = r.decode(r.Payload); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		m.Forwarded = m.Payload
+		if r.Modified != nil {
+			if m.Forwarded, err = r.decode(*r.Modified); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+func (r *record) decode(payload string) ([]byte, error) {
+	if r.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(payload)
+	}
+
+	return []byte(payload), nil
+}
+
+func parseOpcodeName(name string) domain.OpcodeType {
+	for _, opcode := range []domain.OpcodeType{
+		domain.ContinuationOpcode,
+		domain.TextOpcode,
+		domain.BinaryOpcode,
+		domain.CloseOpcode,
+		domain.PingOpcode,
+		domain.PongOpcode,
+	} {
+		if opcodeName(opcode) == name {
+			return opcode
+		}
+	}
+	var opcode byte
+	_, _ = fmt.Sscanf(name, "0x%x", &opcode)
+
+	return domain.OpcodeType(opcode)
+}
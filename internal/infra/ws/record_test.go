@@ -0,0 +1,234 @@
+//go:build unit
+
+package ws
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+// newTestRecorder returns a recorder of the file without its writer goroutine
+func newTestRecorder(t *testing.T, file string, queue int, metrics Metrics) *recorder {
+	t.Helper()
+	rec := &recorder{
+		opt:     adapter.RecordOption{File: file, MaxSize: defaultRecordMaxSize, MaxBackups: 2},
+		lines:   make(chan []byte, queue),
+		done:    make(chan struct{}),
+		metrics: metrics,
+		logger:  log.New(io.Discard, "", 0),
+	}
+	if err := rec.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if rec.file != nil {
+			_ = rec.file.Close()
+		}
+	})
+
+	return rec
+}
+
+func TestRecorderRegistry_WritesOnClose(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.jsonl")
+	r := newRecorderRegistry(noopMetrics{})
+	rec, err := r.get(adapter.RecordOption{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &session{id: "1", route: "chat"}
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := rec.record(s, domain.ClientDirection, domain.TextOpcode, []byte(payload), []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.close()
+
+	messages, err := ReadRecords(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || string(messages[2].Payload) != "c" {
+		t.Errorf("ReadRecords() = %d messages, want the 3 queued before the close", len(messages))
+	}
+	// Nothing is queued once closed
+	if err := rec.record(s, domain.ClientDirection, domain.TextOpcode, []byte("d"), []byte("d")); err != nil {
+		t.Errorf("record() after close error = %v", err)
+	}
+}
+
+func TestRecorder_DropsWhenQueueFull(t *testing.T) {
+	metrics := &fakeMetrics{}
+	rec := newTestRecorder(t, filepath.Join(t.TempDir(), "record.jsonl"), 1, metrics)
+	s := &session{id: "1", route: "chat"}
+
+	for i := 0; i < 3; i++ {
+		if err := rec.record(s, domain.ClientDirection, domain.TextOpcode, []byte("a"), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if metrics.dropped != 2 {
+		t.Errorf("dropped = %d, want 2", metrics.dropped)
+	}
+	if len(rec.lines) != 1 {
+		t.Errorf("queued = %d, want 1", len(rec.lines))
+	}
+}
+
+func TestRecorder_Rotate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.jsonl")
+	rec := newTestRecorder(t, file, 16, noopMetrics{})
+	rec.opt.MaxSize = 10
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if err := rec.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{file: "third\n", file + ".1": "second\n", file + ".2": "first\n"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, want)
+		}
+	}
+}
+
+func TestRecorder_RotateRenameFailure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.jsonl")
+	// A directory in place of the first backup fails the rename
+	if err := os.MkdirAll(filepath.Join(file+".1", "keep"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	rec := newTestRecorder(t, file, 16, noopMetrics{})
+	rec.opt.MaxSize = 10
+	rec.opt.MaxBackups = 1
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if err := rec.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\nsecond\n" {
+		t.Errorf("record.jsonl = %q, want the lines appended to the reopened file", data)
+	}
+	if rec.disabled.Load() {
+		t.Error("recording disabled though the file could be opened again")
+	}
+}
+
+func TestRecorder_RotateReopenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "records")
+	if err := os.Mkdir(dir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	metrics := &fakeMetrics{}
+	rec := newTestRecorder(t, filepath.Join(dir, "record.jsonl"), 16, metrics)
+	rec.opt.MaxSize = 10
+	if err := rec.write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Without its directory the file can neither be renamed nor created again
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rec.write([]byte("second\n")); err == nil {
+		t.Fatal("write() expected the recording to be disabled")
+	}
+	if !rec.disabled.Load() || rec.file != nil {
+		t.Fatal("recording not disabled after the reopen failure")
+	}
+	if err := rec.write([]byte("third\n")); err != nil {
+		t.Errorf("write() once disabled error = %v", err)
+	}
+	s := &session{id: "1", route: "chat"}
+	if err := rec.record(s, domain.ClientDirection, domain.TextOpcode, []byte("a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.dropped != 1 || len(rec.lines) != 0 {
+		t.Errorf("dropped = %d, queued = %d, want the message dropped", metrics.dropped, len(rec.lines))
+	}
+}
+
+func TestRecorder_OpenRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.jsonl")
+	r := newRecorderRegistry(noopMetrics{})
+	rec, err := r.get(adapter.RecordOption{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := upgradeRequest(t, "http://chat.example.com/chat/lobby?token=abc")
+	request.RemoteAddr = "192.0.2.1:5000"
+	request.Header.Set("X-User-Id", "42")
+	request.Header.Set(extensionsHeader, deflateExtension)
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("Proxy-Authorization", "Basic secret")
+	request.Header.Set("Cookie", "session=secret")
+	s := &session{id: "1", route: "chat"}
+	if err := rec.recordOpen(s, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.record(s, domain.ClientDirection, domain.TextOpcode, []byte("hi"), []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	messages, err := ReadRecords(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Request == nil || messages[1].Request != nil {
+		t.Fatalf("ReadRecords() = %+v, want the open record then the message", messages)
+	}
+	got := messages[0].Request
+	if got.URI != "/chat/lobby?token=abc" || got.Host != "chat.example.com" || got.RemoteAddr != "192.0.2.1:5000" {
+		t.Errorf("Request = %+v, want the client handshake", got)
+	}
+	if got.Header.Get("X-User-Id") != "42" {
+		t.Errorf("Request header X-User-Id = %q, want 42", got.Header.Get("X-User-Id"))
+	}
+	for _, name := range append(handshakeHeaders, sensitiveHeaders...) {
+		if v := got.Header.Get(name); v != "" {
+			t.Errorf("Request header %s = %q, want it left out", name, v)
+		}
+	}
+}
+
+func TestReadRecords_MessageAboveDefaultMaxSize(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.jsonl")
+	r := newRecorderRegistry(noopMetrics{})
+	rec, err := r.get(adapter.RecordOption{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A route with a larger message.maxSize records lines far above the default one
+	original := strings.Repeat("a", 5*DefaultMaxMessageSize)
+	modified := strings.Repeat("b", 5*DefaultMaxMessageSize)
+	s := &session{id: "1", route: "chat"}
+	if err := rec.record(s, domain.ClientDirection, domain.TextOpcode, []byte(original), []byte(modified)); err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	messages, err := ReadRecords(file)
+	if err != nil {
+		t.Fatalf("ReadRecords() error = %v", err)
+	}
+	if len(messages) != 1 || string(messages[0].Payload) != original || string(messages[0].Forwarded) != modified {
+		t.Errorf("ReadRecords() = %d messages, want the recorded message whole", len(messages))
+	}
+}
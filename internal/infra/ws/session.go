@@ -0,0 +1,184 @@
+package ws
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Second
+	closeTimeout        = 5 * time.Second
+	goingAwayStatus     = 1001
+)
+
+// session is a proxied websocket connection, from the hijack of the client connection
+// until both legs are closed
+type session struct {
+	id           string
+	route        string
+	clientAddr   string
+	upstreamAddr string
+	started      time.Time
+
+	downstream *wsConn
+	upstream   *wsConn
+	// recorder is set if the session is sampled for the recording
+	recorder *recorder
+	// clientBytes and upstreamBytes count the payload received from each leg
+	clientBytes   atomic.Uint64
+	upstreamBytes atomic.Uint64
+	// closing is set once the proxy sent a close frame to both legs, the frames still
+	// received are only waited for the close reply and not forwarded anymore
+	closing atomic.Bool
+	done    chan struct{}
+}
+
+// sessionRegistry tracks the live sessions, which are invisible to the http server once hijacked
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	lastId   uint64
+	draining bool
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastId++
+	s.id = strconv.FormatUint(r.lastId, 10)
+	r.sessions[s.id] = s
+	if r.draining {
+		// The session was hijacked while the registry drains
+		go s.initiateClose(goingAwayStatus)
+	}
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, s.id)
+}
+
+func (r *sessionRegistry) get(id string) (*session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+
+	return s, ok
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+// info returns the sessions from the oldest to the newest
+func (r *sessionRegistry) info() []domain.SessionInfo {
+	sessions := r.list()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].started.Before(sessions[j].started)
+	})
+
+	infos := make([]domain.SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, domain.SessionInfo{
+			Id:            s.id,
+			ClientAddr:    s.clientAddr,
+			Route:         s.route,
+			Upstream:      s.upstreamAddr,
+			ClientBytes:   s.clientBytes.Load(),
+			UpstreamBytes: s.upstreamBytes.Load(),
+			StartedAt:     s.started,
+		})
+	}
+
+	return infos
+}
+
+// close sends the close frame with the status to both legs of the session, which is
+// force-closed if the close handshake is not done within the timeout
+func (r *sessionRegistry) close(id string, status uint16, timeout time.Duration) error {
+	s, ok := r.get(id)
+	if !ok {
+		return domain.ErrSessionNotFound
+	}
+
+	go func() {
+		s.initiateClose(status)
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-s.done:
+		case <-timer.C:
+			s.forceClose()
+		}
+	}()
+
+	return nil
+}
+
+// initiateClose sends the close frame with the status to both legs
+func (s *session) initiateClose(status uint16) {
+	if s.closing.Swap(true) {
+		return
+	}
+	_ = s.downstream.sendClose(status)
+	_ = s.upstream.sendClose(status)
+}
+
+// forceClose closes both tcp connections without waiting for the close handshake
+func (s *session) forceClose() {
+	_ = s.downstream.conn.Close()
+	_ = s.upstream.conn.Close()
+}
+
+// drain sends going away to every session and waits up to the timeout for the close
+// handshakes, then force-closes the sessions still open
+func (r *sessionRegistry) drain(timeout time.Duration) int {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	// A slow peer blocks the close frame write until the sessions are force-closed
+	sessions := r.list()
+	for _, s := range sessions {
+		go s.initiateClose(goingAwayStatus)
+	}
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		case <-deadline.C:
+			forced := 0
+			for _, s := range r.list() {
+				s.forceClose()
+				forced++
+			}
+			return forced
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,145 @@
+//go:build unit
+
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSession returns a session and the peers of its legs: the client of the
+// downstream one and the upstream server of the upstream one
+func newTestSession(t *testing.T) (*session, *wsConn, *wsConn) {
+	t.Helper()
+	downstream, client := newPipeConns(t, serverRole)
+	upstream, server := newPipeConns(t, clientRole)
+	s := &session{
+		started:    time.Now(),
+		downstream: downstream,
+		upstream:   upstream,
+		done:       make(chan struct{}),
+	}
+
+	return s, client, server
+}
+
+// readCloseCodes reads the close frame each peer receives
+func readCloseCodes(peers ...*wsConn) <-chan uint16 {
+	codes := make(chan uint16, len(peers))
+	for _, peer := range peers {
+		go func(peer *wsConn) {
+			f, err := peer.recv(DefaultMaxMessageSize)
+			if err != nil {
+				codes <- 0
+				return
+			}
+			codes <- closeCode(f)
+		}(peer)
+	}
+
+	return codes
+}
+
+func TestSessionRegistry_Drain(t *testing.T) {
+	r := newSessionRegistry()
+	s, client, server := newTestSession(t)
+	r.add(s)
+
+	codes := readCloseCodes(client, server)
+	go func() {
+		// The session ends once both legs got the going away, as the pipes do on the close replies
+		<-codes
+		<-codes
+		r.remove(s)
+		close(s.done)
+	}()
+
+	if forced := r.drain(time.Second); forced != 0 {
+		t.Errorf("drain() forced = %d, want 0", forced)
+	}
+}
+
+func TestSessionRegistry_DrainSendsGoingAway(t *testing.T) {
+	r := newSessionRegistry()
+	s, client, server := newTestSession(t)
+	r.add(s)
+
+	codes := readCloseCodes(client, server)
+	go r.drain(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-codes:
+			if code != goingAwayStatus {
+				t.Errorf("close code = %d, want %d", code, goingAwayStatus)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no close frame received")
+		}
+	}
+	close(s.done)
+}
+
+func TestSessionRegistry_DrainTimeout(t *testing.T) {
+	r := newSessionRegistry()
+	s, client, server := newTestSession(t)
+	r.add(s)
+	codes := readCloseCodes(client, server)
+
+	started := time.Now()
+	if forced := r.drain(50 * time.Millisecond); forced != 1 {
+		t.Errorf("drain() forced = %d, want 1", forced)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("drain() took %v, want about the timeout", elapsed)
+	}
+	<-codes
+	<-codes
+	// The force-closed legs are closed without the close handshake
+	if _, err := client.recv(DefaultMaxMessageSize); err == nil {
+		t.Error("client leg still open after the force-close")
+	}
+	if _, err := server.recv(DefaultMaxMessageSize); err == nil {
+		t.Error("upstream leg still open after the force-close")
+	}
+}
+
+func TestSessionRegistry_AddWhileDraining(t *testing.T) {
+	r := newSessionRegistry()
+	r.drain(time.Second)
+
+	s, client, server := newTestSession(t)
+	codes := readCloseCodes(client, server)
+	r.add(s)
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-codes:
+			if code != goingAwayStatus {
+				t.Errorf("close code = %d, want %d", code, goingAwayStatus)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("session hijacked while draining was not sent going away")
+		}
+	}
+}
+
+func TestSessionRegistry_CloseForcesAfterTimeout(t *testing.T) {
+	r := newSessionRegistry()
+	s, client, server := newTestSession(t)
+	r.add(s)
+	codes := readCloseCodes(client, server)
+
+	if err := r.close(s.id, 4000, 50*time.Millisecond); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != 4000 {
+			t.Errorf("close code = %d, want 4000", code)
+		}
+	}
+	if _, err := client.recv(DefaultMaxMessageSize); err == nil {
+		t.Error("client leg still open after the close timeout")
+	}
+	if err := r.close("missing", 1000, time.Second); err == nil {
+		t.Error("close() of an unknown session expected an error")
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"github.com/poyaz/reverse-ws-modifier/internal/domain"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -28,24 +30,71 @@ var _ domain.WsProxyUsecase = (*WebsocketProxy)(nil)
 
 type WebsocketProxy struct {
 	scheme          string
+	route           string
 	remoteAddr      string
 	rewriteHost     string
 	defaultPath     string
 	tlsc            *tls.Config
 	logger          *log.Logger
+	maxMessageSize  int
+	refragment      bool
+	deflate         bool
+	proxyProtocol   int
 	beforeHandshake func(r *http.Request) error
+	afterHandshake  func(resp *http.Response) error
+	handshakeResult func(err error)
 	events          []domain.ModifierEvent
+	sessions        *sessionRegistry
+	metrics         Metrics
+	recorder        *recorder
+	recordSample    float64
 }
 
 var _ adapter.WsAdapter = (*wsInfra)(nil)
 
-type wsInfra struct{}
+type wsInfra struct {
+	opt       Config
+	sessions  *sessionRegistry
+	recorders *recorderRegistry
+}
+
+func NewWsInfra(config ...Config) (*wsInfra, error) {
+	var opt Config
+	for _, cfg := range config {
+		opt = cfg
+	}
+	if opt.DrainTimeout <= 0 {
+		opt.DrainTimeout = defaultDrainTimeout
+	}
+	if opt.Metrics == nil {
+		opt.Metrics = noopMetrics{}
+	}
+
+	return &wsInfra{opt: opt, sessions: newSessionRegistry(), recorders: newRecorderRegistry(opt.Metrics)}, nil
+}
+
+// Shutdown sends going away to the live sessions and waits for them to close up to the drain timeout
+func (w *wsInfra) Shutdown() error {
+	forced := w.sessions.drain(w.opt.DrainTimeout)
+	w.recorders.close()
+	if forced > 0 {
+		return fmt.Errorf("%d websocket sessions force-closed after the drain timeout", forced)
+	}
+
+	return nil
+}
+
+// Sessions lists the live websocket sessions
+func (w *wsInfra) Sessions() []domain.SessionInfo {
+	return w.sessions.info()
+}
 
-func NewWsInfra() (*wsInfra, error) {
-	return &wsInfra{}, nil
+// CloseSession sends a close frame with the code to both legs of the session
+func (w *wsInfra) CloseSession(id string, code uint16) error {
+	return w.sessions.close(id, code, closeTimeout)
 }
 
-func (w *wsInfra) New(addr string, rewriteHost string, beforeCallback func(r *http.Request) error, events ...domain.ModifierEvent) (domain.WsProxyUsecase, error) {
+func (w *wsInfra) New(addr string, rewriteHost string, opt adapter.WsOption, beforeCallback func(r *http.Request) error, afterCallback func(resp *http.Response) error, events ...domain.ModifierEvent) (domain.WsProxyUsecase, error) {
 	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, ErrFormatAddr
@@ -59,116 +108,372 @@ func (w *wsInfra) New(addr string, rewriteHost string, beforeCallback func(r *ht
 	}
 	wp := &WebsocketProxy{
 		scheme:          u.Scheme,
+		route:           opt.Route,
 		remoteAddr:      fmt.Sprintf("%s:%s", host, port),
 		rewriteHost:     rewriteHost,
+		defaultPath:     u.RequestURI(),
+		maxMessageSize:  opt.MaxMessageSize,
+		refragment:      opt.Refragment,
+		deflate:         opt.Deflate,
+		proxyProtocol:   opt.ProxyProtocol,
 		beforeHandshake: beforeCallback,
+		afterHandshake:  afterCallback,
+		handshakeResult: opt.HandshakeResult,
 		logger:          log.New(os.Stderr, "", log.LstdFlags),
 		events:          events,
+		sessions:        w.sessions,
+		metrics:         w.opt.Metrics,
+	}
+	if opt.Record != nil {
+		// A recording failure never fails the connection, it is only left unrecorded
+		if wp.recorder, err = w.recorders.get(*opt.Record); err != nil {
+			wp.logger.Println(err)
+		}
+		wp.recordSample = opt.Record.Sample
 	}
 	if u.Scheme == WssScheme {
-		wp.tlsc = &tls.Config{InsecureSkipVerify: true}
+		wp.tlsc = &tls.Config{}
+		if opt.TLS != nil {
+			wp.tlsc = opt.TLS.Clone()
+		}
 	}
 
 	return wp, nil
 }
 
 func (wp *WebsocketProxy) Proxy(writer http.ResponseWriter, request *http.Request) {
-	if strings.ToLower(request.Header.Get("Connection")) != "upgrade" ||
-		strings.ToLower(request.Header.Get("Upgrade")) != "websocket" {
-		_, _ = writer.Write([]byte(`Must be a websocket request`))
+	if !isUpgradeRequest(request) {
+		http.Error(writer, "Must be a websocket request", http.StatusBadRequest)
 		return
 	}
 	hijacker, ok := writer.(http.Hijacker)
 	if !ok {
+		http.Error(writer, "websocket upgrade is not supported by the listener", http.StatusInternalServerError)
 		return
 	}
-	downstreamConn, bufrw, err := hijacker.Hijack()
-	if err != nil {
-		return
-	}
-	defer downstreamConn.Close()
 	req := request.Clone(request.Context())
 	req.Host = wp.rewriteHost
+	// The upstream uri comes from the upstream addr, which may rewrite the client one
+	if upstreamURI, err := url.ParseRequestURI(wp.defaultPath); err == nil {
+		req.URL.Path = upstreamURI.Path
+		req.URL.RawPath = upstreamURI.RawPath
+		req.URL.RawQuery = upstreamURI.RawQuery
+	}
 	if wp.beforeHandshake != nil {
 		// Add headers, permission authentication + masquerade sources
-		err = wp.beforeHandshake(req)
+		err := wp.beforeHandshake(req)
 		if err != nil {
-			_, _ = writer.Write([]byte(err.Error()))
+			http.Error(writer, err.Error(), http.StatusForbidden)
 			return
 		}
 	}
-	var upstreamConn net.Conn
-	switch wp.scheme {
-	case WsScheme:
-		upstreamConn, err = net.Dial("tcp", wp.remoteAddr)
-	case WssScheme:
-		upstreamConn, err = tls.Dial("tcp", wp.remoteAddr, wp.tlsc)
+	// Extensions are negotiated by the proxy separately on each leg
+	clientExtensions := req.Header.Clone()
+	req.Header.Del(extensionsHeader)
+	if wp.deflate {
+		req.Header.Set(extensionsHeader, deflateExtension)
+	}
+
+	started := time.Now()
+	var proxyHeader []byte
+	if wp.proxyProtocol != 0 {
+		proxyHeader = requestProxyHeader(wp.proxyProtocol, request)
 	}
+	upstreamConn, err := dialUpstream(wp.scheme, wp.remoteAddr, wp.tlsc, handshakeTimeout, proxyHeader)
 	if err != nil {
-		_, _ = writer.Write([]byte(err.Error()))
+		wp.report(started, err)
+		http.Error(writer, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer upstreamConn.Close()
+
+	_ = upstreamConn.SetDeadline(time.Now().Add(handshakeTimeout))
 	err = req.Write(upstreamConn)
 	if err != nil {
-		_, _ = writer.Write([]byte(err.Error()))
+		wp.report(started, err)
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	upstreamBufrw := bufio.NewReadWriter(bufio.NewReader(upstreamConn), bufio.NewWriter(upstreamConn))
+	resp, err := http.ReadResponse(upstreamBufrw.Reader, req)
+	if err != nil {
+		wp.report(started, err)
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			wp.report(started, errors.New("upstream handshake error: "+resp.Status))
+		} else {
+			wp.report(started, fmt.Errorf("%w: %s", domain.ErrUpstreamRefused, resp.Status))
+		}
+		writeUpstreamError(writer, resp)
+		return
+	}
+	_ = upstreamConn.SetDeadline(time.Time{})
+	if err = checkHandshakeResponse(req, resp); err != nil {
+		wp.report(started, err)
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	wp.report(started, nil)
+	upstreamDeflate, err := parseDeflateResponse(resp.Header, wp.deflate)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadGateway)
 		return
 	}
+	if wp.afterHandshake != nil {
+		if err = wp.afterHandshake(resp); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
 
-	downstreamWs := wsConn{downstreamConn, bufrw, req.Header, 1000}
-	upstreamWs := wsConn{conn: upstreamConn, bufrw: bufio.NewReadWriter(bufio.NewReader(upstreamConn), bufio.NewWriter(upstreamConn)), status: 1000}
+	var downstreamDeflate *deflateParams
+	resp.Header.Del(extensionsHeader)
+	if wp.deflate {
+		var extension string
+		if downstreamDeflate, extension = acceptDeflateOffer(clientExtensions); downstreamDeflate != nil {
+			resp.Header.Set(extensionsHeader, extension)
+		}
+	}
+	resp.Header.Set("Sec-WebSocket-Accept", computeAcceptKey(request.Header.Get("Sec-WebSocket-Key")))
 
-	var textOpcodeEvents []domain.ModifierFunc
-	for _, event := range wp.events {
-		if event.On == domain.TextOpcode {
-			textOpcodeEvents = append(textOpcodeEvents, event.Handler)
+	downstreamConn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer downstreamConn.Close()
+	if err = resp.Write(bufrw); err != nil {
+		return
+	}
+	if err = bufrw.Flush(); err != nil {
+		return
+	}
+
+	downstreamWs := &wsConn{conn: downstreamConn, bufrw: bufrw, header: req.Header, status: 1000, role: serverRole}
+	upstreamWs := &wsConn{conn: upstreamConn, bufrw: upstreamBufrw, header: resp.Header, status: 1000, role: clientRole}
+	if downstreamDeflate != nil {
+		downstreamWs.inflater, downstreamWs.deflater = downstreamDeflate.newServerCodec()
+	}
+	if upstreamDeflate != nil {
+		upstreamWs.inflater, upstreamWs.deflater = upstreamDeflate.newClientCodec()
+	}
+
+	s := &session{
+		route:        wp.route,
+		clientAddr:   request.RemoteAddr,
+		upstreamAddr: wp.remoteAddr,
+		started:      time.Now(),
+		downstream:   downstreamWs,
+		upstream:     upstreamWs,
+		done:         make(chan struct{}),
+	}
+	if wp.recorder != nil && rand.Float64() < wp.recordSample {
+		s.recorder = wp.recorder
+	}
+	wp.sessions.add(s)
+	if s.recorder != nil {
+		if err = s.recorder.recordOpen(s, request); err != nil {
+			wp.logger.Println(err)
 		}
 	}
+	wp.metrics.SessionOpened()
+	defer func() {
+		wp.sessions.remove(s)
+		wp.metrics.SessionClosed(time.Since(s.started))
+		close(s.done)
+	}()
 
 	errChan := make(chan error, 2)
 	go func() {
-		for {
-			f, err := downstreamWs.recv()
-			if err != nil {
-				errChan <- err
-				return
+		errChan <- wp.pipe(s, downstreamWs, upstreamWs, domain.ClientDirection)
+	}()
+	go func() {
+		errChan <- wp.pipe(s, upstreamWs, downstreamWs, domain.ServerDirection)
+	}()
+
+	err = <-errChan
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		wp.logger.Println(err)
+	}
+	if s.closing.Load() {
+		// Both legs were sent a close frame, wait for the close reply of the other one too
+		<-errChan
+	}
+}
+
+// report passes the outcome of dialing and handshaking the upstream to the usecase
+func (wp *WebsocketProxy) report(started time.Time, err error) {
+	wp.metrics.UpstreamHandshake(wp.remoteAddr, time.Since(started), err)
+	if wp.handshakeResult != nil {
+		wp.handshakeResult(err)
+	}
+}
+
+// dialUpstream opens the tcp (or tls for wss) connection to the upstream. The PROXY
+// protocol header, if any, is written before the tls handshake.
+func dialUpstream(scheme string, addr string, tlsc *tls.Config, timeout time.Duration, proxyHeader []byte) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if scheme == WssScheme && proxyHeader == nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, tlsc)
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyHeader != nil {
+		if _, err = conn.Write(proxyHeader); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if scheme != WssScheme {
+		return conn, nil
+	}
+
+	if tlsc.ServerName == "" {
+		tlsc = tlsc.Clone()
+		tlsc.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, tlsc)
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// record writes the message to the recording file if the session is sampled
+func (wp *WebsocketProxy) record(s *session, direction domain.Direction, opcode domain.OpcodeType, original []byte, modified []byte) {
+	if s.recorder == nil {
+		return
+	}
+	if err := s.recorder.record(s, direction, opcode, original, modified); err != nil {
+		wp.logger.Println(err)
+	}
+}
+
+// eventsOn returns the modifiers registered for the opcode in the given direction
+func (wp *WebsocketProxy) eventsOn(opcode domain.OpcodeType, direction domain.Direction) []domain.ModifierFunc {
+	var opcodeEvents []domain.ModifierFunc
+	for _, event := range wp.events {
+		if event.On == opcode && event.Direction.Has(direction) {
+			opcodeEvents = append(opcodeEvents, event.Handler)
+		}
+	}
+
+	return opcodeEvents
+}
+
+// pipe reads frames from src, reassembles fragmented messages, applies the modifiers
+// and writes them to dst until a close frame is forwarded
+func (wp *WebsocketProxy) pipe(s *session, src, dst *wsConn, direction domain.Direction) error {
+	textOpcodeEvents := wp.eventsOn(domain.TextOpcode, direction)
+	binaryOpcodeEvents := wp.eventsOn(domain.BinaryOpcode, direction)
+	assembler := newMessageAssembler(wp.maxMessageSize)
+	for {
+		f, err := src.recv(assembler.remaining())
+		if err != nil {
+			if src.status != 1000 {
+				_ = src.close()
+			}
+			return err
+		}
+		if direction == domain.ClientDirection {
+			s.clientBytes.Add(uint64(len(f.Payload)))
+		} else {
+			s.upstreamBytes.Add(uint64(len(f.Payload)))
+		}
+		wp.metrics.Frame(direction, f.Opcode, len(f.Payload))
+		if f.Opcode == domain.CloseOpcode {
+			wp.metrics.Close(direction, closeCode(f))
+		}
+		if s.closing.Load() {
+			// A close frame was sent to both legs, only their close reply is awaited
+			if f.Opcode == domain.CloseOpcode {
+				return nil
 			}
+			continue
+		}
 
-			switch f.Opcode {
-			case domain.CloseOpcode:
-				return
-			case domain.PingOpcode:
-				f.Opcode = domain.PongOpcode
-			case domain.ContinuationOpcode:
-			case domain.TextOpcode:
-				for _, textOpcodeEvent := range textOpcodeEvents {
-					orFr, err := textOpcodeEvent(f)
-					if err != nil {
-						errChan <- err
-						return
-					}
-
-					f = orFr
+		if f.IsControl() {
+			wp.record(s, direction, f.Opcode, f.Payload, f.Payload)
+			if err = dst.send(f); err != nil {
+				return err
+			}
+			if f.Opcode == domain.CloseOpcode {
+				return nil
+			}
+			continue
+		}
+
+		msg, status, err := assembler.push(f)
+		if err != nil {
+			src.status = status
+			_ = src.close()
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.frame.Reserved&compressedBit != 0 {
+			payload, err := src.inflater.inflate(msg.frame.Payload, assembler.maxSize)
+			if err != nil {
+				src.status = 1007
+				if errors.Is(err, ErrMessageTooLarge) {
+					src.status = 1009
 				}
-			case domain.BinaryOpcode:
+				_ = src.close()
+				return err
+			}
+			msg.frame.Payload = payload
+			msg.frame.Length = uint64(len(payload))
+			msg.frame.Reserved &^= compressedBit
+			if msg.frame.Opcode == domain.TextOpcode && !utf8.Valid(payload) {
+				src.status = 1007
+				_ = src.close()
+				return ErrInvalidUTF8
 			}
+		}
 
-			if err = upstreamWs.send(f); err != nil {
-				errChan <- err
-				return
+		original := msg.frame.Payload
+		var opcodeEvents []domain.ModifierFunc
+		switch msg.frame.Opcode {
+		case domain.TextOpcode:
+			opcodeEvents = textOpcodeEvents
+		case domain.BinaryOpcode:
+			opcodeEvents = binaryOpcodeEvents
+		}
+		for _, opcodeEvent := range opcodeEvents {
+			orFr, err := opcodeEvent(msg.frame)
+			if err != nil {
+				return err
 			}
+
+			msg.frame = orFr
 		}
-	}()
-	go func() {
-		buf := make([]byte, 300)
-		_, err := io.CopyBuffer(downstreamConn, upstreamConn, buf)
-		errChan <- err
-	}()
+		wp.record(s, direction, msg.frame.Opcode, original, msg.frame.Payload)
 
-	select {
-	case err = <-errChan:
-		if err != nil {
-			_, _ = writer.Write([]byte(err.Error()))
+		if dst.deflater != nil {
+			payload, err := dst.deflater.deflate(msg.frame.Payload)
+			if err != nil {
+				return err
+			}
+			msg.frame.Payload = payload
+			msg.frame.Length = uint64(len(payload))
+			msg.frame.Reserved |= compressedBit
+		}
+
+		for _, out := range msg.frames(wp.refragment) {
+			if err = dst.send(out); err != nil {
+				return err
+			}
 		}
 	}
 }
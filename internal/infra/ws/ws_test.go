@@ -0,0 +1,92 @@
+//go:build unit
+
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poyaz/reverse-ws-modifier/internal/app/proxy/usecase/adapter"
+	"github.com/poyaz/reverse-ws-modifier/internal/domain"
+)
+
+type fakeMetrics struct {
+	noopMetrics
+	mu         sync.Mutex
+	handshakes []error
+	dropped    int
+}
+
+func (m *fakeMetrics) RecordDropped(string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+func (m *fakeMetrics) UpstreamHandshake(_ string, _ time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handshakes = append(m.handshakes, err)
+}
+
+// upgradeRequest is a client websocket handshake to the url
+func upgradeRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	return req
+}
+
+func TestProxy_UpstreamRefused(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer upstream.Close()
+
+	metrics := &fakeMetrics{}
+	infra, err := NewWsInfra(Config{Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result error
+	proxy, err := infra.New(
+		"ws://"+strings.TrimPrefix(upstream.URL, "http://")+"/ws",
+		"",
+		adapter.WsOption{HandshakeResult: func(err error) { result = err }},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(proxy.Proxy))
+	defer front.Close()
+
+	resp, err := http.DefaultClient.Do(upgradeRequest(t, front.URL+"/ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want the upstream %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if !errors.Is(result, domain.ErrUpstreamRefused) {
+		t.Errorf("HandshakeResult() error = %v, want %v", result, domain.ErrUpstreamRefused)
+	}
+	if len(metrics.handshakes) != 1 || !errors.Is(metrics.handshakes[0], domain.ErrUpstreamRefused) {
+		t.Errorf("UpstreamHandshake() errors = %v, want one %v", metrics.handshakes, domain.ErrUpstreamRefused)
+	}
+}